@@ -11,6 +11,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,6 +46,7 @@ var (
 	termCountBorderRate float64
 	termCountBorder     int
 	showLastText        bool
+	showScore           bool
 	line                string
 	outputFile          string
 	delim               string
@@ -54,24 +56,92 @@ var (
 	_ignorewords        string
 	ignorewords         []string
 	customPhrases       []string
+	contextLines        int
+	showPhraseID        bool
+	outputFormat        string
+	labeledPath         string
+	contentCol          string
+	labelCol            string
+	_sweepMinR          string
+	sweepMinR           []float64
+	_sweepR             string
+	sweepR              []float64
+	phraseID            string
+	expire              string
+	comment             string
+	annotation          rarelogdetector.PhraseAnnotation
+	customAnnotations   map[string]rarelogdetector.PhraseAnnotation
+	_severityWeights    string
+	errorKeywords       string
+	recencyWeight       float64
+	recencyHalfLife     string
+	countHalfLife       string
+	maxTerms            int
+	workers             int
+	lockTimeout         int
+	zThreshold          float64
+	baseline            string
+	tolerance           float64
+	since               string
+	termType            string
+	field               string
+	sessionKey          string
+	sessionEnd          string
+	sessionTimeout      string
+	until               string
+	burstGap            string
+	outlierK            float64
+	modelPath           string
+	_mergeFrom          string
+	maxOrigins          int
 )
 
 type config struct {
-	DataDir             string   `yaml:"dataDir"`
-	LogPath             string   `yaml:"logPath"`
-	SearchStrings       []string `yaml:"searchString"`
-	ExcludeStrings      []string `yaml:"excludeString"`
-	LogFormat           string   `yaml:"logFormat"`
-	TimestampLayout     string   `yaml:"timestampLayout"`
-	Retention           int64    `yaml:"retention"`
-	Frequency           string   `yaml:"frequency"`
-	MinMatchRate        float64  `yaml:"minMatchRate"`
-	MaxMatchRate        float64  `yaml:"maxMatchRate"`
-	TermCountBorderRate float64  `yaml:"termCountBorderRate"`
-	TermCountBorder     int      `yaml:"termCountBorder"`
-	Keywords            []string `yaml:"keywords"`
-	Ignorewords         []string `yaml:"ignorewords"`
-	CustomPhrases       []string `yaml:"phrases"`
+	DataDir             string         `yaml:"dataDir"`
+	LogPath             string         `yaml:"logPath"`
+	SearchStrings       []string       `yaml:"searchString"`
+	ExcludeStrings      []string       `yaml:"excludeString"`
+	LogFormat           string         `yaml:"logFormat"`
+	TimestampLayout     string         `yaml:"timestampLayout"`
+	Retention           int64          `yaml:"retention"`
+	Frequency           string         `yaml:"frequency"`
+	MinMatchRate        float64        `yaml:"minMatchRate"`
+	MaxMatchRate        float64        `yaml:"maxMatchRate"`
+	TermCountBorderRate float64        `yaml:"termCountBorderRate"`
+	TermCountBorder     int            `yaml:"termCountBorder"`
+	Keywords            []string       `yaml:"keywords"`
+	Ignorewords         []string       `yaml:"ignorewords"`
+	CustomPhrases       []customPhrase `yaml:"phrases"`
+	SeverityWeights     string         `yaml:"severityWeights"`
+	ErrorKeywords       string         `yaml:"errorKeywords"`
+	RecencyWeight       float64        `yaml:"recencyWeight"`
+	RecencyHalfLife     string         `yaml:"recencyHalfLife"`
+	CountHalfLife       string         `yaml:"countHalfLife"`
+	MaxTerms            int            `yaml:"maxTerms"`
+	Workers             int            `yaml:"workers"`
+	LockTimeout         int            `yaml:"lockTimeout"`
+	SessionKey          string         `yaml:"sessionKey"`
+	SessionEnd          string         `yaml:"sessionEnd"`
+	SessionTimeout      string         `yaml:"sessionTimeout"`
+}
+
+// an item of "phrases" in the config file.
+// It is either a phrase or a map with the phrase and its annotation.
+type customPhrase struct {
+	Phrase   string `yaml:"phrase"`
+	Label    string `yaml:"label"`
+	Severity string `yaml:"severity"`
+	Owner    string `yaml:"owner"`
+	Notes    string `yaml:"notes"`
+}
+
+func (c *customPhrase) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		c.Phrase = value.Value
+		return nil
+	}
+	type plain customPhrase
+	return value.Decode((*plain)(c))
 }
 
 func init() {
@@ -85,21 +155,60 @@ func init() {
 	flag.StringVar(&frequency, "frequency", "", "Frequency to rotate logs. day|hour")
 	flag.StringVar(&searchString, "s", "", "Search string")
 	flag.StringVar(&excludeString, "x", "", "Exclude string")
-	flag.StringVar(&mode, "m", "", "Run mode: topN|detect|feed|clean|termCounts|analyzeLine|outputPhrases|outputPhrasesHistory")
+	flag.StringVar(&mode, "m", "", "Run mode: topN|detect|reduce|exportStructured|evaluate|sweep|feed|clean|termCounts|analyzeLine|explain|ack|unack|acks|annotate|spikes|missing|newTerms|sessions|timeline|outliers|score|exportModel|importModel|merge|origins|outputPhrases|outputPhrasesHistory")
 	flag.Float64Var(&minMatchRate, "minR", 0.6, "It is considered 2 log lines 'match', if more than matchRate number of terms in a log line matches.")
 	flag.Float64Var(&maxMatchRate, "maxR", 0.0, "Do not check more terms than this rate when grouping lines")
-	flag.IntVar(&N, "N", 0, "Show Top N rare logs in topN mode")
-	flag.IntVar(&M, "M", 0, "Show ony logs appeared M times in topN mode")
+	flag.IntVar(&N, "N", 0, "Show Top N rare logs in topN|origins mode")
+	flag.IntVar(&M, "M", 0, "Show ony logs appeared M times in topN|reduce|sessions mode")
 	flag.Int64Var(&retention, "retention", 0, "Retention in the frequency to show")
 	flag.Float64Var(&termCountBorderRate, "R", 0.999, "Words with less appearance will be replaced by '*'. The border is calculated by this rate.")
 	flag.IntVar(&termCountBorder, "b", 0, "Words with less appearance than this number will be replaced by '*'. If 0, it will be calculated by termCountBorderRate")
 	flag.BoolVar(&showLastText, "showLastText", false, "If show the last text in the phrase group instead of the phrase.")
-	flag.StringVar(&line, "line", "", "Log line to analyze")
-	flag.StringVar(&outputFile, "o", "", "Output file when using -m outputPhrases|outputPhrasesHistory")
-	flag.StringVar(&delim, "delim", "", "Deliminator of CSV file when using -m outputPhrases|outputPhrasesHistory")
+	flag.BoolVar(&showScore, "showScore", false, "Show the rarity, the severity, its source, its weight and the recency boost after the score in topN mode")
+	flag.StringVar(&line, "line", "", "Log line to analyze in analyzeLine|explain mode")
+	flag.StringVar(&outputFile, "o", "", "Output file when using -m reduce|outputPhrases|outputPhrasesHistory|exportModel. Output file prefix when using -m exportStructured")
+	flag.StringVar(&outputFormat, "format", "csv", "Output format when using -m exportStructured. csv|json")
+	flag.StringVar(&delim, "delim", "", "Deliminator of CSV file when using -m reduce|outputPhrases|outputPhrasesHistory")
 	flag.IntVar(&biggestN, "biggestN", 100, "Top N biggest groups when -m outputPhrases|outputPhrasesHistory")
 	flag.StringVar(&_keywords, "k", "", "List of terms to include in all phrases. Comma separated")
 	flag.StringVar(&_ignorewords, "i", "", "List of terms to include in all phrases. Comma separated")
+	flag.StringVar(&labeledPath, "labeled", "", "Labeled CSV file with raw lines and ground truth template IDs like Loghub _structured.csv when using -m evaluate")
+	flag.StringVar(&contentCol, "contentCol", "Content", "Column of the raw line in the labeled file")
+	flag.StringVar(&labelCol, "labelCol", "EventId", "Column of the ground truth template ID in the labeled file")
+	flag.StringVar(&_sweepMinR, "sweepMinR", "0.5,0.6,0.7,0.8", "List of minMatchRate values to try in sweep mode. Comma separated")
+	flag.StringVar(&_sweepR, "sweepR", "0.9,0.95,0.99,0.999", "List of termCountBorderRate values to try in sweep mode. Comma separated")
+	flag.BoolVar(&showPhraseID, "showPhraseID", false, "Add the phrase ID column to the output of reduce mode")
+	flag.StringVar(&phraseID, "id", "", "Phrase ID to ack, unack or annotate")
+	flag.StringVar(&expire, "expire", "", "The ack expires after this duration like 12h, 7d or 2w. Never expires if empty")
+	flag.StringVar(&comment, "comment", "", "Comment of the ack")
+	flag.StringVar(&annotation.Label, "label", "", "Label of the phrase when using -m annotate")
+	flag.StringVar(&annotation.Severity, "severity", "", "Severity of the phrase when using -m annotate. info|warning|error|critical")
+	flag.StringVar(&annotation.Owner, "owner", "", "Team owning the phrase when using -m annotate")
+	flag.StringVar(&annotation.Notes, "notes", "", "Notes of the phrase like a runbook URL when using -m annotate")
+	flag.StringVar(&_severityWeights, "severityWeights", "", "Weights of severities in the score like info=1,warning=1.5,error=2,critical=3. Not weighted by default")
+	flag.StringVar(&errorKeywords, "errorKeywords", "", "Regex of keywords to consider a phrase as an error in the score like failure|failed|error|down|crit. Not used by default")
+	flag.Float64Var(&recencyWeight, "recencyWeight", 0, "Boost of the score of the latest phrase. The boost decays by half in recencyHalfLife. 0 disables it")
+	flag.StringVar(&recencyHalfLife, "recencyHalfLife", "", "Half life of the recency boost like 12h or 1d. Default: 1d")
+	flag.StringVar(&countHalfLife, "countHalfLife", "", "Counts of terms and phrases decay by half in this duration like 7d instead of dropping when their blocks expire. Saved in the data directory. 0 disables it")
+	flag.IntVar(&workers, "workers", 0, "Number of goroutines parsing lines and summing their terms when feeding logs. The phrases are registered on one goroutine. The result does not depend on it. Default: number of CPUs")
+	flag.IntVar(&lockTimeout, "lockTimeout", 0, "Seconds to wait for another rarelog process using the data directory. -1 waits forever. Default: fails at once")
+	flag.IntVar(&maxTerms, "maxTerms", -1, "Max number of distinct terms kept in memory. Rarer terms over it are counted approximately and become * in phrases. Saved in the data directory. 0 disables it")
+	flag.Float64Var(&zThreshold, "z", 3, "Show phrases whose count in the latest time unit is more than z standard deviations away from the baseline in spikes mode")
+	flag.StringVar(&baseline, "baseline", "ewma", "Baseline of the count in spikes mode. ewma|seasonal")
+	flag.Float64Var(&tolerance, "tolerance", 0.5, "Show periodic phrases not seen for period * (1 + tolerance) in missing mode")
+	flag.StringVar(&since, "since", "1d", "Show terms or phrases first seen within this duration before the latest log like 12h, 1d or 1w in newTerms|timeline mode. A date time like \"2006-01-02 15:04:05\" is also accepted in timeline mode")
+	flag.StringVar(&until, "until", "", "End of the window in timeline mode as a duration before the latest log or a date time. Default the latest log")
+	flag.StringVar(&burstGap, "burstGap", "5m", "Phrases first seen within this duration of each other are in the same burst in timeline mode")
+	flag.Float64Var(&outlierK, "outlierK", 3, "Show numbers below p0.1 / outlierK or above p99.9 * outlierK of the same position of the phrase in outliers mode")
+	flag.StringVar(&modelPath, "model", "", "Model file exported by exportModel mode to create the data directory from in importModel mode")
+	flag.StringVar(&_mergeFrom, "from", "", "Data directories or exported models to merge in merge mode like hostA=/data/a,hostB=b.json.gz. Comma separated")
+	flag.IntVar(&maxOrigins, "maxOrigins", 1, "Show phrases seen on this number of hosts or less in origins mode")
+	flag.StringVar(&termType, "termType", "", "Show only new terms of this type in newTerms mode. ipv4|number|hex|id|word")
+	flag.StringVar(&field, "field", "", "Show only new terms captured by this named group of logFormat in newTerms mode")
+	flag.StringVar(&sessionKey, "sessionKey", "", "Regex to capture the correlation key like call-id in sessions mode. The \"key\" named group, the first group or the whole match is used")
+	flag.StringVar(&sessionEnd, "sessionEnd", "", "Regex of the last line of a session in sessions mode")
+	flag.StringVar(&sessionTimeout, "sessionTimeout", "", "Close sessions with no line for this duration like 30s or 5m in sessions mode. Default 5m")
+	flag.IntVar(&contextLines, "context", -1, "Show the file location and N lines before and after each rare log record in topN|detect|outliers mode. 0 shows only the location")
 
 	logFormat = ""
 	timestampLayout = ""
@@ -143,6 +252,13 @@ func main() {
 
 	keywords = strings.Split(_keywords, ",")
 	ignorewords = strings.Split(_ignorewords, ",")
+	var err error
+	if sweepMinR, err = parseFloats(_sweepMinR); err != nil {
+		logrus.WithError(err).Fatal("-sweepMinR must be comma separated numbers")
+	}
+	if sweepR, err = parseFloats(_sweepR); err != nil {
+		logrus.WithError(err).Fatal("-sweepR must be comma separated numbers")
+	}
 
 	// Load configuration
 	if configPath != "" {
@@ -254,12 +370,93 @@ func loadConfig(path string) error {
 	if ignorewords == nil {
 		ignorewords = c.Ignorewords
 	}
+	if _severityWeights == "" {
+		_severityWeights = c.SeverityWeights
+	}
+	if errorKeywords == "" {
+		errorKeywords = c.ErrorKeywords
+	}
+	if recencyWeight == 0 {
+		recencyWeight = c.RecencyWeight
+	}
+	if recencyHalfLife == "" {
+		recencyHalfLife = c.RecencyHalfLife
+	}
+	if countHalfLife == "" {
+		countHalfLife = c.CountHalfLife
+	}
+	if maxTerms < 0 && c.MaxTerms > 0 {
+		maxTerms = c.MaxTerms
+	}
+	if workers == 0 {
+		workers = c.Workers
+	}
+	if lockTimeout == 0 {
+		lockTimeout = c.LockTimeout
+	}
+	if sessionKey == "" {
+		sessionKey = c.SessionKey
+	}
+	if sessionEnd == "" {
+		sessionEnd = c.SessionEnd
+	}
+	if sessionTimeout == "" {
+		sessionTimeout = c.SessionTimeout
+	}
 	if customPhrases == nil {
-		customPhrases = c.CustomPhrases
+		customAnnotations = make(map[string]rarelogdetector.PhraseAnnotation)
+		for _, cp := range c.CustomPhrases {
+			customPhrases = append(customPhrases, cp.Phrase)
+			customAnnotations[cp.Phrase] = rarelogdetector.PhraseAnnotation{
+				Label:    cp.Label,
+				Severity: cp.Severity,
+				Owner:    cp.Owner,
+				Notes:    cp.Notes,
+			}
+		}
 	}
 	return nil
 }
 
+func setScoringModel(a *rarelogdetector.Analyzer) error {
+	m := rarelogdetector.DefaultScoringModel()
+	if _severityWeights != "" {
+		weights, err := rarelogdetector.ParseSeverityWeights(_severityWeights)
+		if err != nil {
+			return err
+		}
+		m.SeverityWeights = weights
+	}
+	if errorKeywords != "" {
+		m.ErrorKeywords = errorKeywords
+	}
+	m.RecencyWeight = recencyWeight
+	if recencyHalfLife != "" {
+		d, err := utils.ParseDuration(recencyHalfLife)
+		if err != nil {
+			return err
+		}
+		m.RecencyHalfLife = d
+	}
+	return a.SetScoringModel(m)
+}
+
+func parseFloats(s string) ([]float64, error) {
+	res := make([]float64, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
 func clean() {
 	// Check if the directory exists
 	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
@@ -296,6 +493,8 @@ func run() error {
 	var err error
 	var a *rarelogdetector.Analyzer
 
+	rarelogdetector.SetLockTimeout(time.Duration(lockTimeout) * time.Second)
+
 	if len(searchStrings) == 0 && searchString != "" {
 		searchStrings = []string{searchString}
 	}
@@ -304,6 +503,38 @@ func run() error {
 	}
 
 	tblDir := fmt.Sprintf("%s/config.tbl.ini", dataDir)
+	if mode == "importModel" {
+		a, err = rarelogdetector.ImportModel(dataDir, modelPath, logPath,
+			searchStrings, excludeStrings)
+		if err != nil {
+			return err
+		}
+		a.Close()
+		return nil
+	}
+	if mode == "merge" {
+		a, err = rarelogdetector.MergeModels(dataDir, strings.Split(_mergeFrom, ","), logPath,
+			searchStrings, excludeStrings)
+		if err != nil {
+			return err
+		}
+		a.Close()
+		return nil
+	}
+	if mode == "score" {
+		// the model is scored against, not updated
+		if !utils.PathExist(tblDir) {
+			return fmt.Errorf("no model in %s to score with", dataDir)
+		}
+		readOnly = true
+	}
+	if mode == "reduce" {
+		// the lines are reduced with the counts of the model, not fed into it
+		if !utils.PathExist(tblDir) {
+			return fmt.Errorf("no model in %s to reduce with", dataDir)
+		}
+		readOnly = true
+	}
 	if utils.PathExist(tblDir) {
 		logrus.Infof("Loading config from %s\n", tblDir)
 		a, err = rarelogdetector.NewAnalyzer2(dataDir,
@@ -324,23 +555,114 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	if countHalfLife != "" {
+		d, err := utils.ParseDuration(countHalfLife)
+		if err != nil {
+			return err
+		}
+		if err := a.SetCountHalfLife(d); err != nil {
+			return err
+		}
+	}
+	if maxTerms >= 0 {
+		if err := a.SetMaxTerms(maxTerms); err != nil {
+			return err
+		}
+	}
+	a.SetWorkers(workers)
+	if err := setScoringModel(a); err != nil {
+		return err
+	}
+	for phrase, an := range customAnnotations {
+		if err := a.SetCustomPhraseAnnotation(phrase, an); err != nil {
+			return err
+		}
+	}
 	switch mode {
 	case "feed":
 		err = a.Feed(0)
 	case "detect":
-		err = a.DetectAndShow(M, termCountBorderRate, termCountBorder)
+		err = a.DetectAndShow(M, termCountBorderRate, termCountBorder, contextLines)
+	case "reduce":
+		_, err = a.Reduce(logPath, M, termCountBorderRate, termCountBorder, showPhraseID, delim, outputFile)
+	case "exportStructured":
+		err = a.ExportStructured(termCountBorderRate, termCountBorder, outputFormat, outputFile)
+	case "evaluate":
+		err = a.EvaluateShow(labeledPath, contentCol, labelCol, termCountBorderRate, termCountBorder)
+	case "sweep":
+		err = a.SweepShow(sweepMinR, sweepR, labeledPath, contentCol, labelCol)
 	case "topN":
-		err = a.TopNShow(N, M, int(retention), showLastText, termCountBorderRate, termCountBorder)
+		err = a.TopNShow(N, M, int(retention), showLastText, showScore, termCountBorderRate, termCountBorder, contextLines)
 	case "termCounts":
 		err = a.TermCountCountsShow(N)
 	case "analyzeLine":
 		err = a.AnalyzeLine(line)
+	case "explain":
+		err = a.ExplainShow(line, termCountBorderRate, termCountBorder)
+	case "ack":
+		var d time.Duration
+		if expire != "" {
+			d, err = utils.ParseDuration(expire)
+			if err != nil {
+				return err
+			}
+		}
+		err = a.Ack(phraseID, d, comment, termCountBorderRate, termCountBorder)
+	case "unack":
+		err = a.Unack(phraseID)
+	case "acks":
+		a.AcksShow()
+	case "annotate":
+		err = a.Annotate(phraseID, annotation, termCountBorderRate, termCountBorder)
 	case "outputPhrases":
 		err = a.OutputPhrases(termCountBorderRate, termCountBorder, biggestN, delim, outputFile)
+	case "spikes":
+		err = a.SpikesShow(zThreshold, baseline, termCountBorderRate, termCountBorder)
+	case "missing":
+		err = a.MissingShow(tolerance, termCountBorderRate, termCountBorder)
+	case "newTerms":
+		var d time.Duration
+		d, err = utils.ParseDuration(since)
+		if err != nil {
+			return err
+		}
+		err = a.NewTermsShow(d, termType, field, termCountBorderRate, termCountBorder)
+	case "outliers":
+		err = a.OutliersShow(outlierK, contextLines)
+	case "timeline":
+		var s, u rarelogdetector.TimeArg
+		if s, err = rarelogdetector.ParseTimeArg(since); err != nil {
+			return err
+		}
+		if u, err = rarelogdetector.ParseTimeArg(until); err != nil {
+			return err
+		}
+		var d time.Duration
+		d, err = utils.ParseDuration(burstGap)
+		if err != nil {
+			return err
+		}
+		err = a.TimelineShow(s, u, d, termCountBorderRate, termCountBorder)
+	case "sessions":
+		if sessionTimeout == "" {
+			sessionTimeout = "5m"
+		}
+		var d time.Duration
+		d, err = utils.ParseDuration(sessionTimeout)
+		if err != nil {
+			return err
+		}
+		err = a.SessionsShow(sessionKey, sessionEnd, d, M, termCountBorderRate, termCountBorder)
+	case "score":
+		err = a.ScoreShow(logPath, termCountBorderRate, termCountBorder)
+	case "exportModel":
+		err = a.ExportModel(outputFile)
+	case "origins":
+		err = a.OriginsShow(N, maxOrigins, termCountBorderRate, termCountBorder)
 	case "outputPhrasesHistory":
 		err = a.OutputPhrasesHistory(termCountBorderRate, termCountBorder, biggestN, delim, outputFile)
 	default:
-		err = errors.New("-m: mode must be one of topN|detect|feed|termCounts|analyzeLine|outputPhrases|outputPhrasesHistory|clean")
+		err = errors.New("-m: mode must be one of topN|detect|reduce|exportStructured|evaluate|sweep|feed|termCounts|analyzeLine|explain|ack|unack|acks|annotate|spikes|missing|newTerms|sessions|timeline|outliers|score|exportModel|importModel|merge|origins|outputPhrases|outputPhrasesHistory|clean")
 	}
 	if err != nil {
 		return err
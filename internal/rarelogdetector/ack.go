@@ -0,0 +1,137 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// a phrase marked as known.
+// A phrase whose template changes gets another stable ID,
+// so the ack does not apply to it any more.
+type ack struct {
+	phraseID string
+	phrase   string
+	ackedAt  int64
+	expireAt int64
+	comment  string
+}
+
+func (k ack) expired(now int64) bool {
+	return k.expireAt > 0 && k.expireAt <= now
+}
+
+// ackedPhrases returns the current phrase IDs which have acks not expired
+func (t *trans) ackedPhrases(now int64) map[int]bool {
+	acked := make(map[int]bool, len(t.acks))
+	for stableID, k := range t.acks {
+		if k.expired(now) {
+			continue
+		}
+		if phraseID := t.findPhrase(stableID); phraseID >= 0 {
+			acked[phraseID] = true
+		}
+	}
+	return acked
+}
+
+func (a *Analyzer) saveAcks() error {
+	if a.dataDir == "" {
+		return nil
+	}
+	if err := a.acksTable.Truncate(); err != nil {
+		return err
+	}
+	for _, k := range a.trans.acks {
+		if err := a.acksTable.InsertRow(nil,
+			k.phraseID, k.phrase, k.ackedAt, k.expireAt, k.comment); err != nil {
+			return err
+		}
+	}
+	return a.acksTable.Flush()
+}
+
+func (a *Analyzer) loadAcks() error {
+	rows, err := a.acksTable.SelectRows(nil, tableDefs["acks"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		var k ack
+		if err := rows.Scan(&k.phraseID, &k.phrase, &k.ackedAt, &k.expireAt, &k.comment); err != nil {
+			return err
+		}
+		a.trans.acks[k.phraseID] = k
+	}
+	return nil
+}
+
+// Ack marks the phrase as known so that topN and detect do not show it
+// until the ack expires. expire=0 means the ack never expires.
+// The phrase ID can be the one shown with the same termCountBorderRate and termCountBorder.
+func (a *Analyzer) Ack(phraseID string, expire time.Duration, comment string,
+	termCountBorderRate float64, termCountBorder int) error {
+	if a.readOnly {
+		return fmt.Errorf("cannot ack in read only mode")
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return err
+	}
+	id := a.trans.findPhrase(phraseID)
+	if id < 0 {
+		return fmt.Errorf("phrase %s not found", phraseID)
+	}
+
+	now := time.Now()
+	k := ack{
+		phraseID: phraseID,
+		phrase:   a.trans.phrases.getMember(id),
+		ackedAt:  now.Unix(),
+		comment:  comment,
+	}
+	if expire > 0 {
+		k.expireAt = now.Add(expire).Unix()
+	}
+	a.trans.acks[phraseID] = k
+	return a.saveAcks()
+}
+
+// Unack removes the ack of the phrase
+func (a *Analyzer) Unack(phraseID string) error {
+	if a.readOnly {
+		return fmt.Errorf("cannot unack in read only mode")
+	}
+	if _, ok := a.trans.acks[phraseID]; !ok {
+		return fmt.Errorf("phrase %s is not acked", phraseID)
+	}
+	delete(a.trans.acks, phraseID)
+	return a.saveAcks()
+}
+
+func (a *Analyzer) AcksShow() {
+	acks := make([]ack, 0, len(a.trans.acks))
+	for _, k := range a.trans.acks {
+		acks = append(acks, k)
+	}
+	sort.Slice(acks, func(i, j int) bool {
+		return acks[i].ackedAt < acks[j].ackedAt
+	})
+
+	format := "2006-01-02 15:04:05"
+	now := time.Now().Unix()
+	for _, k := range acks {
+		expire := "never"
+		if k.expireAt > 0 {
+			expire = time.Unix(k.expireAt, 0).Format(format)
+			if k.expired(now) {
+				expire += " (expired)"
+			}
+		}
+		fmt.Printf("%s,%s,%s,%s,%s\n", k.phraseID,
+			time.Unix(k.ackedAt, 0).Format(format), expire, k.comment, k.phrase)
+	}
+}
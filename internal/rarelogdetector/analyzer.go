@@ -1,14 +1,18 @@
 package rarelogdetector
 
 import (
+	"bufio"
 	"fmt"
 	"goRareLogDetector/pkg/csvdb"
 	"goRareLogDetector/pkg/filepointer"
 	"goRareLogDetector/pkg/utils"
+	"io"
 	"math"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -25,6 +29,15 @@ type Analyzer struct {
 	frequency           string
 	configTable         *csvdb.Table
 	lastStatusTable     *csvdb.Table
+	phraseSourcesTable  *csvdb.Table
+	phraseSourceRows    int
+	acksTable           *csvdb.Table
+	annotationsTable    *csvdb.Table
+	decayTable          *csvdb.Table
+	valueSketchesTable  *csvdb.Table
+	phraseOriginsTable  *csvdb.Table
+	termBudgetTable     *csvdb.Table
+	dataVersionTable    *csvdb.Table
 	trans               *trans
 	fp                  *filepointer.FilePointer
 	filterRe            []*regexp.Regexp
@@ -41,13 +54,28 @@ type Analyzer struct {
 	keywords            []string
 	ignorewords         []string
 	customPhrases       []string
+	countHalfLife       int64
+	maxTerms            int
+	workers             int
+	unlockDataDir       func()
+	committedBlocks     map[string]blockPosition
+}
+
+// blockPosition is the current block of items saved with the last status
+type blockPosition struct {
+	lastIndex int64
+	rowNo     int
 }
 
 type phraseCnt struct {
+	phraseID  string
 	count     int
 	line      string
 	phrasestr string
 	tokens    []int
+	file      string
+	fileEpoch int64
+	row       int
 }
 
 type termCntCount struct {
@@ -146,17 +174,33 @@ func (a *Analyzer) setFilters(searchRegex, exludeRegex []string) {
 	}
 }
 
-func (a *Analyzer) open() error {
+func (a *Analyzer) open() (err error) {
+	if a.dataDir != "" {
+		a.unlockDataDir, err = lockDataDir(a.dataDir, !a.readOnly)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				a.unlockDataDir()
+			}
+		}()
+	}
+
 	if a.dataDir == "" {
 		a.initBlocks()
 		if err := a.init(); err != nil {
 			return err
 		}
 	} else {
-		if utils.PathExist(a.dataDir) {
+		if dataDirExists(a.dataDir) {
 			if err := a.loadStatus(); err != nil {
 				return err
 			}
+			// the tokenizer needs the saved words
+			if err := a.loadKeywords(); err != nil {
+				return err
+			}
 			if err := a.init(); err != nil {
 				return err
 			}
@@ -264,6 +308,8 @@ func (a *Analyzer) init() error {
 		return err
 	}
 	a.trans = trans
+	a.trans.setCountHalfLife(a.countHalfLife)
+	a.trans.setMaxTerms(a.maxTerms)
 	return nil
 }
 
@@ -272,6 +318,9 @@ func (a *Analyzer) loadStatus() error {
 		if err := a.prepareDB(); err != nil {
 			return err
 		}
+		if err := a.checkDataVersion(); err != nil {
+			return err
+		}
 	}
 	/*
 		"config": {"logPath", "blockSize", "maxBlocks", "matchRate",
@@ -296,20 +345,43 @@ func (a *Analyzer) loadStatus() error {
 			&a.rowID, &a.lastFileEpoch, &a.lastFileRow); err != nil {
 			return err
 		}
+		if err := a.loadCommittedBlocks(); err != nil {
+			return err
+		}
+	}
 
+	if err := a.loadDecay(); err != nil {
+		return err
+	}
+	if err := a.loadTermBudget(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func (a *Analyzer) load() error {
-	if err := a.loadKeywords(); err != nil {
+	if err := a.rollbackBlocks(); err != nil {
 		return err
 	}
-
 	if err := a.trans.load(); err != nil {
 		return err
 	}
+	if err := a.loadPhraseSources(); err != nil {
+		return err
+	}
+	if err := a.loadAcks(); err != nil {
+		return err
+	}
+	if err := a.loadAnnotations(); err != nil {
+		return err
+	}
+	if err := a.loadValueSketches(); err != nil {
+		return err
+	}
+	if err := a.loadPhraseOrigins(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -331,15 +403,82 @@ func (a *Analyzer) prepareDB() error {
 	}
 	a.lastStatusTable = ls
 
+	ps, err := d.CreateTableIfNotExists("phraseSources", tableDefs["phraseSources"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.phraseSourcesTable = ps
+
+	ak, err := d.CreateTableIfNotExists("acks", tableDefs["acks"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.acksTable = ak
+
+	an, err := d.CreateTableIfNotExists("annotations", tableDefs["annotations"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.annotationsTable = an
+
+	dt, err := d.CreateTableIfNotExists("decay", tableDefs["decay"], false, 1, 1)
+	if err != nil {
+		return err
+	}
+	a.decayTable = dt
+
+	vs, err := d.CreateTableIfNotExists("valueSketches", tableDefs["valueSketches"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.valueSketchesTable = vs
+
+	po, err := d.CreateTableIfNotExists("phraseOrigins", tableDefs["phraseOrigins"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	a.phraseOriginsTable = po
+
+	tb, err := d.CreateTableIfNotExists("termBudget", tableDefs["termBudget"], false, 1, 1)
+	if err != nil {
+		return err
+	}
+	a.termBudgetTable = tb
+
+	dv, err := d.CreateTableIfNotExists("dataVersion", tableDefs["dataVersion"], false, 1, 1)
+	if err != nil {
+		return err
+	}
+	a.dataVersionTable = dv
+
 	a.CsvDB = d
 	return nil
 }
 
-func (a *Analyzer) saveLastStatus() error {
-	if a.dataDir == "" || a.readOnly {
+// checkDataVersion refuses the data directory written by a newer version,
+// as its tables may have rows this version drops without noticing.
+func (a *Analyzer) checkDataVersion() error {
+	rows, err := a.dataVersionTable.SelectRows(nil, tableDefs["dataVersion"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
 		return nil
 	}
+	version := 0
+	for rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return err
+		}
+	}
+	if version > cDataVersion {
+		return fmt.Errorf("version %d of the data directory %s is not supported. Supported up to %d",
+			version, a.dataDir, cDataVersion)
+	}
+	return nil
+}
 
+func (a *Analyzer) saveLastStatus() error {
 	var epoch int64
 	rowNo := 0
 	if a.fp != nil {
@@ -349,16 +488,77 @@ func (a *Analyzer) saveLastStatus() error {
 		epoch = 0
 		rowNo = 0
 	}
+	return a.saveLastStatusAt(epoch, rowNo)
+}
 
-	err := a.lastStatusTable.Upsert(nil, map[string]interface{}{
+// saveLastStatusAt saves the position of the line read by the pipeline,
+// which can be behind the file pointer
+func (a *Analyzer) saveLastStatusAt(epoch int64, rowNo int) error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+
+	status := map[string]interface{}{
 		"lastRowID":     a.rowID,
 		"lastFileEpoch": epoch,
 		"lastFileRow":   rowNo,
-	})
+	}
+	// the last status of older versions does not have the blocks
+	if a.trans != nil && a.lastStatusTable.GetColIdx("termsRowNo") >= 0 {
+		for _, it := range []*items{a.trans.terms, a.trans.phrases} {
+			_, lastIndex := it.CurrentBlock()
+			status[it.name+"LastIndex"] = lastIndex
+			status[it.name+"RowNo"] = it.RowNo
+		}
+	}
+
+	err := a.lastStatusTable.Upsert(nil, status)
 
 	return err
 }
 
+// loadCommittedBlocks reads the positions of the current blocks
+// committed with the last status
+func (a *Analyzer) loadCommittedBlocks() error {
+	if a.lastStatusTable.GetColIdx("termsRowNo") < 0 {
+		return nil
+	}
+	var terms, phrases blockPosition
+	if err := a.lastStatusTable.Select1Row(nil,
+		[]string{"termsLastIndex", "termsRowNo", "phrasesLastIndex", "phrasesRowNo"},
+		&terms.lastIndex, &terms.rowNo, &phrases.lastIndex, &phrases.rowNo); err != nil {
+		return err
+	}
+	a.committedBlocks = map[string]blockPosition{
+		"terms":   terms,
+		"phrases": phrases,
+	}
+	return nil
+}
+
+// rollbackBlocks removes the rows committed to the blocks after the last status.
+// They were written by a process stopped before saving the last status,
+// and the lines would be counted again from the last status.
+func (a *Analyzer) rollbackBlocks() error {
+	if a.readOnly || a.committedBlocks == nil {
+		return nil
+	}
+	for _, it := range []*items{a.trans.terms, a.trans.phrases} {
+		pos, ok := a.committedBlocks[it.name]
+		if !ok {
+			continue
+		}
+		rolledBack, err := it.Rollback(pos.lastIndex, pos.rowNo)
+		if err != nil {
+			return err
+		}
+		if rolledBack {
+			logrus.Warnf("rolled back the %s committed after the last status", it.name)
+		}
+	}
+	return nil
+}
+
 func (a *Analyzer) saveConfig() error {
 	if a.readOnly {
 		return nil
@@ -379,7 +579,9 @@ func (a *Analyzer) saveConfig() error {
 	}); err != nil {
 		return err
 	}
-	return nil
+	return a.dataVersionTable.Upsert(nil, map[string]interface{}{
+		"version": cDataVersion,
+	})
 }
 
 func (a *Analyzer) getKeywordsFilePath() string {
@@ -388,12 +590,18 @@ func (a *Analyzer) getKeywordsFilePath() string {
 func (a *Analyzer) getIgnorewordsFilePath() string {
 	return fmt.Sprintf("%s/ignorewords.txt", a.dataDir)
 }
+func (a *Analyzer) getCustomPhrasesFilePath() string {
+	return fmt.Sprintf("%s/customphrases.txt", a.dataDir)
+}
 
 func (a *Analyzer) saveKeywords() error {
 	if err := utils.Slice2File(a.keywords, a.getKeywordsFilePath()); err != nil {
 		return err
 	}
-	return utils.Slice2File(a.keywords, a.getIgnorewordsFilePath())
+	if err := utils.Slice2File(a.ignorewords, a.getIgnorewordsFilePath()); err != nil {
+		return err
+	}
+	return utils.Slice2File(a.customPhrases, a.getCustomPhrasesFilePath())
 }
 
 func (a *Analyzer) loadKeywords() error {
@@ -412,6 +620,91 @@ func (a *Analyzer) loadKeywords() error {
 			return err
 		}
 	}
+	// custom phrases given on the command line replace the saved ones
+	customPhrasesPath := a.getCustomPhrasesFilePath()
+	if len(nonEmpty(a.customPhrases)) == 0 && utils.PathExist(customPhrasesPath) {
+		a.customPhrases, err = utils.ReadFile2Slice(customPhrasesPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savePhraseSources appends the sources changed after the last save.
+// The last row of a phrase wins when loading, and the table is rewritten
+// only when most of its rows are outdated.
+func (a *Analyzer) savePhraseSources() error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+	t := a.trans
+	sources := t.changedSources
+	if a.phraseSourceRows+len(sources) > len(t.phraseSources)*cSourcesRewriteRate {
+		if err := a.phraseSourcesTable.Truncate(); err != nil {
+			return err
+		}
+		a.phraseSourceRows = 0
+		sources = make(map[int]bool, len(t.phraseSources))
+		for phraseID := range t.phraseSources {
+			sources[phraseID] = true
+		}
+	}
+	columns := a.phraseSourceColumns()
+	for phraseID := range sources {
+		src, ok := t.phraseSources[phraseID]
+		if !ok {
+			continue
+		}
+		args := []interface{}{t.phrases.getMember(phraseID), src.file, src.row, src.epoch}
+		if err := a.phraseSourcesTable.InsertRow(columns, args[:len(columns)]...); err != nil {
+			return err
+		}
+		a.phraseSourceRows++
+	}
+	if err := a.phraseSourcesTable.Flush(); err != nil {
+		return err
+	}
+	t.changedSources = make(map[int]bool)
+	return nil
+}
+
+// phraseSourceColumns returns the columns of the phraseSources table.
+// Tables created before the epoch was stored do not have it.
+func (a *Analyzer) phraseSourceColumns() []string {
+	columns := tableDefs["phraseSources"]
+	if a.phraseSourcesTable.GetColIdx("epoch") < 0 {
+		return columns[:len(columns)-1]
+	}
+	return columns
+}
+
+func (a *Analyzer) loadPhraseSources() error {
+	columns := a.phraseSourceColumns()
+	rows, err := a.phraseSourcesTable.SelectRows(nil, columns)
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	p := a.trans.phrases
+	a.phraseSourceRows = 0
+	for rows.Next() {
+		var phrase, file string
+		var row int
+		var epoch int64
+		dest := []interface{}{&phrase, &file, &row, &epoch}
+		if err := rows.Scan(dest[:len(columns)]...); err != nil {
+			return err
+		}
+		a.phraseSourceRows++
+		phraseID := p.getItemID(phrase)
+		if phraseID < 0 {
+			continue
+		}
+		a.trans.phraseSources[phraseID] = sourcePos{file, row, epoch}
+	}
 	return nil
 }
 
@@ -434,6 +727,19 @@ func (a *Analyzer) commit(completed bool) error {
 	if err := a.saveKeywords(); err != nil {
 		return err
 	}
+	if err := a.savePhraseSources(); err != nil {
+		return err
+	}
+	if err := a.saveValueSketches(); err != nil {
+		return err
+	}
+	if err := a.savePhraseOrigins(); err != nil {
+		return err
+	}
+	// saved once at the end of the run after the blocks and the last status
+	if err := a.trans.saveSnapshot(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -449,6 +755,9 @@ func (a *Analyzer) Close() {
 	if a.trans != nil {
 		a.trans.close()
 	}
+	if a.unlockDataDir != nil {
+		a.unlockDataDir()
+	}
 }
 
 func (a *Analyzer) Purge() error {
@@ -529,17 +838,26 @@ func (a *Analyzer) Detect(termCountBorderRate float64, termCountBorder int) ([]p
 		a.trans.rearangePhrases(termCountBorderRate, termCountBorder, a.minMatchRate, a.maxMatchRate)
 	}
 	p := a.trans.phrases
+	acked := a.trans.ackedPhrases(time.Now().Unix())
+	notAcked := make([]phraseCnt, 0, len(results))
 	for i := range results {
 		phraseID, phraseStr := a.trans.registerPhrase(results[i].tokens, 0, "", 0, a.minMatchRate, a.maxMatchRate, true, nil)
+		if acked[phraseID] {
+			continue
+		}
 		results[i].count = p.getCount(phraseID)
+		results[i].phraseID = p.getStableID(phraseID)
 		results[i].phrasestr = phraseStr
+		notAcked = append(notAcked, results[i])
 	}
+	results = notAcked
 
 	logrus.Debug("Completed log analyzing")
 	return results, nil
 }
 
-func (a *Analyzer) DetectAndShow(M int, termCountBorderRate float64, termCountBorder int) error {
+func (a *Analyzer) DetectAndShow(M int, termCountBorderRate float64, termCountBorder int,
+	contextLines int) error {
 	results, err := a.Detect(termCountBorderRate, termCountBorder)
 	if err != nil {
 		return err
@@ -547,12 +865,316 @@ func (a *Analyzer) DetectAndShow(M int, termCountBorderRate float64, termCountBo
 	for _, res := range results {
 		if res.count >= M {
 			fmt.Printf("%d,%s\n", res.count, res.line)
-			fmt.Printf("  =>  %s\n\n", res.phrasestr)
+			fmt.Printf("  =>  %s %s\n", res.phraseID, res.phrasestr)
+			if err := showContext(res.file, res.fileEpoch, res.row, contextLines); err != nil {
+				return err
+			}
+			fmt.Println()
 		}
 	}
 	return nil
 }
 
+// showContext prints the location of a log record and contextLines lines
+// before and after it in the original file, in the same format as grep -C.
+// Nothing is shown when contextLines is negative.
+// Only the location is shown if the file was changed after it was read.
+func showContext(file string, epoch int64, row, contextLines int) error {
+	if contextLines < 0 || file == "" || row <= 0 {
+		return nil
+	}
+	if contextLines == 0 {
+		fmt.Printf("  %s:%d\n", file, row)
+		return nil
+	}
+	from, lines, err := filepointer.ReadContext(file, epoch, row, contextLines, contextLines)
+	if err != nil {
+		logrus.Warnf("could not read context from %s: %v", file, err)
+		fmt.Printf("  %s:%d\n", file, row)
+		return nil
+	}
+	for i, line := range lines {
+		sep := "-"
+		if from+i == row {
+			sep = ":"
+		}
+		fmt.Printf("  %s%s%d%s%s\n", file, sep, from+i, sep, line)
+	}
+	fmt.Println("  --")
+	return nil
+}
+
+// Reduce writes out only the log lines of logPath whose phrase count
+// in the model is maxCnt or less, keeping the original text and order.
+// The model is not updated and stdin is read line by line if logPath is empty.
+// The phrase ID is added as the first column if showPhraseID is true.
+// It returns the number of lines written.
+func (a *Analyzer) Reduce(logPath string, maxCnt int,
+	termCountBorderRate float64, termCountBorder int,
+	showPhraseID bool, delim, outfile string) (int, error) {
+	a.readOnly = true
+	a.trans.readOnly = true
+
+	if termCountBorderRate <= 0 && termCountBorder <= 0 {
+		termCountBorderRate = a.termCountBorderRate
+	}
+	if !a.trans.ptRegistered {
+		// force rearangePhrases to rebuild the phrase tree
+		a.trans.termCountBorder = 0
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return 0, err
+	}
+
+	fp, err := filepointer.NewFilePointer(logPath, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err := fp.Open(); err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var out *os.File
+	if outfile == "" {
+		out = os.Stdout
+	} else {
+		f, err := os.Create(outfile)
+		if err != nil {
+			return 0, fmt.Errorf("error creating file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	if delim == "" {
+		delim = ","
+	}
+
+	written := 0
+	for fp.Next() {
+		te := fp.Text()
+		if te == "" {
+			continue
+		}
+		cnt, _, phrasestr, err := a.trans.tokenizeLine(te, 0, fp.CurrFileEpoch(), cStageElse,
+			a.minMatchRate, a.maxMatchRate, true)
+		if err != nil {
+			return written, err
+		}
+		if cnt < 0 || cnt > maxCnt {
+			continue
+		}
+		if showPhraseID {
+			fmt.Fprintf(w, "%s%s", a.trans.phrases.getStableID(a.trans.phrases.getItemID(phrasestr)), delim)
+		}
+		fmt.Fprintln(w, te)
+		written++
+	}
+	if err := fp.Err(); err != nil && err != io.EOF {
+		return written, err
+	}
+	return written, nil
+}
+
+// spoolStdin keeps stdin in a temporary file when no log path is given,
+// because the log is read once per stage and stdin can be read only once.
+// The returned function removes the temporary file.
+func (a *Analyzer) spoolStdin() (func(), error) {
+	if a.logPath != "" {
+		return func() {}, nil
+	}
+	f, err := os.CreateTemp("", "rarelog-stdin-*.log")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	a.logPath = f.Name()
+	a.lastFileEpoch = 0
+	a.lastFileRow = 0
+	// the temporary file must not be recorded as the last read position
+	a.readOnly = true
+	a.trans.readOnly = true
+	return func() { os.Remove(f.Name()) }, nil
+}
+
+// ExportStructured writes every input line as
+// LineId, Timestamp, EventId, EventTemplate, ParameterList
+// to "<outPrefix>_structured.<format>" and the templates with their
+// occurrences to "<outPrefix>_templates.<format>" like Loghub datasets.
+// format is csv or json.
+func (a *Analyzer) ExportStructured(termCountBorderRate float64, termCountBorder int,
+	format, outPrefix string) error {
+	sw, err := newStructuredWriter(outPrefix, format)
+	if err != nil {
+		return err
+	}
+
+	cleanup, err := a.spoolStdin()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := a.Feed(0); err != nil {
+		return err
+	}
+	if termCountBorderRate > 0 {
+		if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+			a.minMatchRate, a.maxMatchRate); err != nil {
+			return err
+		}
+	}
+
+	if err := a.initFilePointer(); err != nil {
+		return err
+	}
+	defer a.fp.Close()
+
+	templates := make([]structuredTemplate, 0)
+	templateIdx := make(map[int]int)
+	lineID := 0
+	for a.fp.Next() {
+		te := a.fp.Text()
+		if te == "" || !a.trans.match(te) {
+			continue
+		}
+		_, _, phrasestr, err := a.trans.tokenizeLine(te, 0, a.fp.CurrFileEpoch(), cStageElse,
+			a.minMatchRate, a.maxMatchRate, true)
+		if err != nil {
+			return err
+		}
+		lineID++
+		phraseID := a.trans.phrases.getItemID(phrasestr)
+		timestamp, message := a.trans.splitLine(te)
+		template, params := a.trans.toTemplate(message, phrasestr)
+
+		idx, ok := templateIdx[phraseID]
+		if !ok {
+			idx = len(templates)
+			templateIdx[phraseID] = idx
+			templates = append(templates, structuredTemplate{
+				EventId:       a.trans.phrases.getStableID(phraseID),
+				EventTemplate: template,
+			})
+		}
+		templates[idx].Occurrences++
+
+		if err := sw.write(structuredLine{
+			LineId:        lineID,
+			Timestamp:     timestamp,
+			EventId:       templates[idx].EventId,
+			EventTemplate: templates[idx].EventTemplate,
+			ParameterList: params,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return sw.close(templates)
+}
+
+// Evaluate analyzes the lines in a labeled CSV file such as Loghub "_structured.csv"
+// and compares the phrases with the labels.
+// contentCol and labelCol are the columns of the raw line and the ground truth template ID.
+// Nothing is written to the data directory.
+func (a *Analyzer) Evaluate(labeledPath, contentCol, labelCol string,
+	termCountBorderRate float64, termCountBorder int) (*evaluation, error) {
+	l, err := a.feedLabeledLines(labeledPath, contentCol, labelCol)
+	if err != nil {
+		return nil, err
+	}
+	if termCountBorderRate > 0 {
+		if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+			a.minMatchRate, a.maxMatchRate); err != nil {
+			return nil, err
+		}
+	}
+
+	predicted, err := a.trans.groupLines(l.contents, a.minMatchRate, a.maxMatchRate)
+	if err != nil {
+		return nil, err
+	}
+	return evaluateGrouping(predicted, l.labels), nil
+}
+
+// feedLabeledLines analyzes the raw lines of a labeled file
+// without writing to the data directory
+func (a *Analyzer) feedLabeledLines(labeledPath, contentCol, labelCol string) (*labeledLines, error) {
+	l, err := readLabeledLines(labeledPath, contentCol, labelCol)
+	if err != nil {
+		return nil, err
+	}
+	l.contents = escapeNewlines(l.contents)
+	tmpPath, cleanup, err := writeTempLog(l.contents)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	a.logPath = tmpPath
+	a.lastFileEpoch = 0
+	a.lastFileRow = 0
+	a.readOnly = true
+	a.trans.readOnly = true
+
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sweep groups the phrases of the loaded model again for every combination
+// of minMatchRates and termCountBorderRates and reports the statistics of each grouping.
+// If labeledPath is given, the model is built from the labeled lines
+// and the accuracy of each grouping is also reported.
+func (a *Analyzer) Sweep(minMatchRates, termCountBorderRates []float64,
+	labeledPath, contentCol, labelCol string) ([]sweepResult, error) {
+	var l *labeledLines
+	var err error
+	if labeledPath != "" {
+		l, err = a.feedLabeledLines(labeledPath, contentCol, labelCol)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	if len(minMatchRates) == 0 {
+		minMatchRates = []float64{a.minMatchRate}
+	}
+	if len(termCountBorderRates) == 0 {
+		termCountBorderRates = []float64{a.termCountBorderRate}
+	}
+	return a.trans.sweep(minMatchRates, termCountBorderRates, a.maxMatchRate, l)
+}
+
+func (a *Analyzer) SweepShow(minMatchRates, termCountBorderRates []float64,
+	labeledPath, contentCol, labelCol string) error {
+	results, err := a.Sweep(minMatchRates, termCountBorderRates, labeledPath, contentCol, labelCol)
+	if err != nil {
+		return err
+	}
+	showSweepResults(results)
+	return nil
+}
+
+func (a *Analyzer) EvaluateShow(labeledPath, contentCol, labelCol string,
+	termCountBorderRate float64, termCountBorder int) error {
+	e, err := a.Evaluate(labeledPath, contentCol, labelCol, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	e.show()
+	return nil
+}
+
 func (a *Analyzer) TopN(N, minCnt, days int,
 	showLastText bool,
 	termCountBorderRate float64, termCountBorder int) ([]phraseScore, error) {
@@ -567,9 +1189,11 @@ func (a *Analyzer) TopN(N, minCnt, days int,
 	return phraseScores, nil
 }
 
+// TopNShow shows the rare phrases. showScore adds the components of the score after it.
 func (a *Analyzer) TopNShow(N, minCnt, days int,
-	showLastText bool,
-	termCountBorderRate float64, termCountBorder int) error {
+	showLastText, showScore bool,
+	termCountBorderRate float64, termCountBorder int,
+	contextLines int) error {
 	var err error
 	var phraseScores []phraseScore
 	phraseScores, err = a.TopN(N, minCnt, days, showLastText, termCountBorderRate, termCountBorder)
@@ -578,7 +1202,279 @@ func (a *Analyzer) TopNShow(N, minCnt, days int,
 	}
 
 	for _, res := range phraseScores {
-		fmt.Printf("%d,%f,%s\n", res.Count, res.Score, res.Text)
+		an := res.Annotation
+		score := fmt.Sprintf("%f", res.Score)
+		if showScore {
+			c := res.Components
+			score = fmt.Sprintf("%f,%f,%s,%s,%g,%f", res.Score,
+				c.Rarity, c.Severity, c.SeveritySource, c.SeverityWeight, c.RecencyBoost)
+		}
+		fmt.Printf("%s,%d,%s,%s,%s,%s,%s,%s\n", res.PhraseID, res.Count, score,
+			an.Label, an.Severity, an.Owner, an.Notes, res.Text)
+		if err := showContext(res.File, res.FileEpoch, res.Row, contextLines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Spikes shows phrases whose count in the latest time unit of the frequency
+// jumps or drops compared with their history.
+// baseline is ewma or seasonal. zThreshold is the z-score to report.
+func (a *Analyzer) Spikes(zThreshold float64, baseline string,
+	termCountBorderRate float64, termCountBorder int) ([]spike, error) {
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	return a.trans.detectSpikes(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate, zThreshold, baseline)
+}
+
+func (a *Analyzer) SpikesShow(zThreshold float64, baseline string,
+	termCountBorderRate float64, termCountBorder int) error {
+	spikes, err := a.Spikes(zThreshold, baseline, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	for _, s := range spikes {
+		fmt.Printf("%s,%s,%d,%f,%f,%f,%s\n", s.PhraseID, s.direction(),
+			s.Count, s.Baseline, s.Z, s.Ratio, s.Text)
+	}
+	return nil
+}
+
+// Missing shows periodic phrases like health checks or cron jobs
+// whose next occurrence has not arrived within period * (1 + tolerance).
+func (a *Analyzer) Missing(tolerance float64,
+	termCountBorderRate float64, termCountBorder int) ([]missingPhrase, error) {
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	return a.trans.detectMissing(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate, tolerance)
+}
+
+func (a *Analyzer) MissingShow(tolerance float64,
+	termCountBorderRate float64, termCountBorder int) error {
+	missing, err := a.Missing(tolerance, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	format := "2006-01-02 15:04:05"
+	for _, m := range missing {
+		fmt.Printf("%s,%s,%s,%s,%s\n", m.PhraseID,
+			time.Duration(m.Period)*time.Second,
+			time.Unix(m.LastSeen, 0).Format(format),
+			time.Duration(m.Overdue)*time.Second, m.Text)
+	}
+	return nil
+}
+
+// NewTerms shows terms first seen within since before the latest log
+// with the phrases where they were seen.
+// termType (ipv4|number|hex|id|word) and field (a named group of logFormat)
+// filter the terms if not empty.
+func (a *Analyzer) NewTerms(since time.Duration, termType, field string,
+	termCountBorderRate float64, termCountBorder int) ([]newTerm, error) {
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	return a.trans.getNewTerms(a.trans.latestUpdate-int64(since.Seconds()),
+		termType, field,
+		termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate)
+}
+
+func (a *Analyzer) NewTermsShow(since time.Duration, termType, field string,
+	termCountBorderRate float64, termCountBorder int) error {
+	newTerms, err := a.NewTerms(since, termType, field, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	format := "2006-01-02 15:04:05"
+	for _, nt := range newTerms {
+		samples := make([]string, len(nt.Samples))
+		for i, s := range nt.Samples {
+			samples[i] = s.PhraseID + " " + s.Text
+		}
+		fmt.Printf("%s,%s,%d,%s,%s,%s\n", nt.Term, nt.Type, nt.Count,
+			time.Unix(nt.FirstSeen, 0).Format(format),
+			strings.Join(nt.Fields, "|"), strings.Join(samples, " | "))
+	}
+	return nil
+}
+
+// Sessions groups the lines into sessions by the correlation key captured by keyRegex
+// like a call-id or a trace-id. A session is closed when no line with the key comes
+// for timeout or a line matches endRegex. The sequence of the phrases in a session
+// is counted as a session template, and the templates seen maxCnt times or less
+// are returned from the rarest like phrases. Nothing is written to the data directory.
+func (a *Analyzer) Sessions(keyRegex, endRegex string, timeout time.Duration, maxCnt int,
+	termCountBorderRate float64, termCountBorder int) ([]sessionTemplate, error) {
+	s, err := newSessionizer(keyRegex, endRegex, timeout)
+	if err != nil {
+		return nil, err
+	}
+	a.readOnly = true
+	a.trans.readOnly = true
+	cleanup, err := a.spoolStdin()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	if termCountBorderRate > 0 {
+		if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+			a.minMatchRate, a.maxMatchRate); err != nil {
+			return nil, err
+		}
+	}
+
+	templates, err := newItems("", "sessionTemplates", 0, 0, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.initFilePointer(); err != nil {
+		return nil, err
+	}
+	defer a.fp.Close()
+
+	for a.fp.Next() {
+		te := a.fp.Text()
+		if te == "" {
+			continue
+		}
+		cnt, _, phrasestr, err := a.trans.tokenizeLine(te, 0, a.fp.CurrFileEpoch(), cStageElse,
+			a.minMatchRate, a.maxMatchRate, true)
+		if err != nil {
+			return nil, err
+		}
+		if cnt < 0 {
+			continue
+		}
+		phraseID := a.trans.phrases.getItemID(phrasestr)
+		for _, ss := range s.add(te, a.trans.lineEpoch(te, a.fp.CurrFileEpoch()), phraseID) {
+			a.trans.registerSession(templates, ss)
+		}
+	}
+	if err := a.fp.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for _, ss := range s.flush() {
+		a.trans.registerSession(templates, ss)
+	}
+	return a.trans.rankSessionTemplates(templates, maxCnt), nil
+}
+
+func (a *Analyzer) SessionsShow(keyRegex, endRegex string, timeout time.Duration, maxCnt int,
+	termCountBorderRate float64, termCountBorder int) error {
+	templates, err := a.Sessions(keyRegex, endRegex, timeout, maxCnt,
+		termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	for _, st := range templates {
+		fmt.Printf("%s,%d,%f,%s,%s\n", st.TemplateID, st.Count, st.Score,
+			st.SampleKey, strings.Join(st.PhraseIDs, " "))
+		for i := range st.PhraseIDs {
+			fmt.Printf("  =>  %s %s\n", st.PhraseIDs[i], st.Texts[i])
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// Timeline shows the phrases first seen between since and until
+// grouped into bursts where the first seen times are not more than burstGap apart,
+// with the pairs of phrases in each burst seen together more often than chance.
+// The earliest phrases of a burst are the candidates of the first cause of an incident.
+func (a *Analyzer) Timeline(since, until TimeArg, burstGap time.Duration,
+	termCountBorderRate float64, termCountBorder int) ([]burst, error) {
+	gap := int64(burstGap.Seconds())
+	if gap <= 0 {
+		return nil, fmt.Errorf("burst gap must be positive")
+	}
+	cleanup, err := a.spoolStdin()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	from := since.epochFrom(a.trans.latestUpdate)
+	to := until.epochFrom(a.trans.latestUpdate)
+	if from > to {
+		return nil, fmt.Errorf("since must be before until")
+	}
+	phrases, err := a.trans.getTimelinePhrases(from, to,
+		termCountBorderRate, termCountBorder, a.minMatchRate, a.maxMatchRate)
+	if err != nil {
+		return nil, err
+	}
+	if len(phrases) == 0 {
+		return []burst{}, nil
+	}
+
+	// time bins where the phrases were seen
+	occurrences := make(map[int]map[int64]bool, len(phrases))
+	for _, tp := range phrases {
+		occurrences[tp.phraseID] = make(map[int64]bool)
+	}
+	if err := a.initFilePointer(); err != nil {
+		return nil, err
+	}
+	defer a.fp.Close()
+	for a.fp.Next() {
+		te := a.fp.Text()
+		if te == "" {
+			continue
+		}
+		epoch := a.trans.lineEpoch(te, a.fp.CurrFileEpoch())
+		if epoch < from || epoch > to {
+			continue
+		}
+		cnt, _, phrasestr, err := a.trans.tokenizeLine(te, 0, a.fp.CurrFileEpoch(), cStageElse,
+			a.minMatchRate, a.maxMatchRate, true)
+		if err != nil {
+			return nil, err
+		}
+		if cnt < 0 {
+			continue
+		}
+		if bins, ok := occurrences[a.trans.phrases.getItemID(phrasestr)]; ok {
+			bins[(epoch-from)/gap] = true
+		}
+	}
+	if err := a.fp.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return groupBursts(phrases, occurrences, (to-from)/gap+1, gap), nil
+}
+
+func (a *Analyzer) TimelineShow(since, until TimeArg, burstGap time.Duration,
+	termCountBorderRate float64, termCountBorder int) error {
+	bursts, err := a.Timeline(since, until, burstGap, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	format := "2006-01-02 15:04:05"
+	for _, b := range bursts {
+		fmt.Printf("burst,%s,%s,%d\n", time.Unix(b.Start, 0).Format(format),
+			time.Unix(b.End, 0).Format(format), len(b.Phrases))
+		for _, tp := range b.Phrases {
+			fmt.Printf("  %s,%s,%d,%f,%s\n", time.Unix(tp.FirstSeen, 0).Format(format),
+				tp.PhraseID, tp.Count, tp.Score, tp.Text)
+		}
+		for _, c := range b.Cooccurrences {
+			fmt.Printf("  co-occur,%s,%s,%d,%f\n", c.PhraseID1, c.PhraseID2, c.Together, c.Lift)
+		}
+		fmt.Println()
 	}
 	return nil
 }
@@ -668,44 +1564,52 @@ func (a *Analyzer) _run(targetLinesCnt int,
 		return nil, err
 	}
 
-	for a.fp.Next() {
-		if linesProcessed > 0 && linesProcessed%cLogPerLines == 0 {
-			logrus.Infof("processed %d lines", linesProcessed)
-		}
-
-		te := a.fp.Text()
-		if te == "" {
-			//linesProcessed++
-			continue
+	lr := a.readLines(targetLinesCnt, stage)
+	defer lr.stop()
+	for b := lr.next(); b != nil; b = lr.next() {
+		if b.terms != nil {
+			a.trans.registerTermCounts(b.terms)
 		}
+		for _, rl := range b.lines {
+			if linesProcessed > 0 && linesProcessed%cLogPerLines == 0 {
+				logrus.Infof("processed %d lines", linesProcessed)
+			}
 
-		_, tokens, _, err := a.trans.tokenizeLine(te, 1, a.fp.CurrFileEpoch(), stage,
-			a.minMatchRate, a.maxMatchRate, false)
-		if err != nil {
-			return nil, err
-		}
+			te := rl.text
+			a.trans.currSource = sourcePos{rl.file, rl.row, rl.fileEpoch}
 
-		if a.fp.IsEOF && (!a.fp.IsLastFile()) {
-			if err := a.saveLastStatus(); err != nil {
+			_, tokens, phrasestr, err := a.trans.tokenizeParsed(rl.parsed, 1, stage,
+				a.minMatchRate, a.maxMatchRate, false)
+			if err != nil {
 				return nil, err
 			}
-		}
-		linesProcessed++
+			if stage == cStageRegisterPhrases && phrasestr != "" {
+				a.trans.observeValues(rl.parsed, phrasestr)
+			}
 
-		if detectMode {
-			if a.trans.match(te) {
-				results = append(results, phraseCnt{
-					tokens: tokens,
-					line:   te,
-				})
+			if rl.eof {
+				if err := a.saveLastStatusAt(rl.fileEpoch, rl.row); err != nil {
+					return nil, err
+				}
+			}
+			linesProcessed++
+
+			if detectMode {
+				if rl.parsed.matched {
+					results = append(results, phraseCnt{
+						tokens:    tokens,
+						line:      te,
+						file:      a.trans.currSource.file,
+						fileEpoch: a.trans.currSource.epoch,
+						row:       a.trans.currSource.row,
+					})
+				}
 			}
-		}
 
-		a.rowID++
-		if targetLinesCnt > 0 && linesProcessed >= targetLinesCnt {
-			break
+			a.rowID++
 		}
 	}
+	lr.stop()
 	if stage == cStageRegisterPhrases && !a.readOnly {
 		if err := a.commit(false); err != nil {
 			return nil, err
@@ -715,13 +1619,16 @@ func (a *Analyzer) _run(targetLinesCnt int,
 
 	switch stage {
 	case cStageRegisterTerms:
+		a.trans.terms.applyDecay()
 		a.trans.calcCountBorder(a.termCountBorderRate, a.termCountBorder)
 	case cStageRegisterPT:
 		a.trans.ptRegistered = true
 	case cStageRegisterPhrases:
+		a.trans.phrases.applyDecay()
 		a.trans.calcPhrasesScore()
 	}
 
+	a.trans.currSource = sourcePos{}
 	a.linesProcessed = linesProcessed
 	a.fp.Close()
 
@@ -734,3 +1641,32 @@ func (a *Analyzer) AnalyzeLine(line string) error {
 	}
 	return a.trans.analyzeLine(line)
 }
+
+// Explain shows how a line is grouped with the phrases in the data directory.
+// The phrase tree is not saved, so it is rebuilt from the phrases
+// if it was not built in this process.
+func (a *Analyzer) Explain(line string,
+	termCountBorderRate float64, termCountBorder int) (*explanation, error) {
+	if a.dataDir != "" && !utils.PathExist(a.dataDir) {
+		return nil, fmt.Errorf("datadir does not exist")
+	}
+	if !a.trans.ptRegistered {
+		// force rearangePhrases to rebuild the phrase tree
+		a.trans.termCountBorder = 0
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return nil, err
+	}
+	return a.trans.explainLine(line, a.minMatchRate, a.maxMatchRate)
+}
+
+func (a *Analyzer) ExplainShow(line string,
+	termCountBorderRate float64, termCountBorder int) error {
+	e, err := a.Explain(line, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	e.show()
+	return nil
+}
@@ -1,8 +1,17 @@
 package rarelogdetector
 
 import (
+	"bufio"
+	"compress/gzip"
 	"fmt"
+	"goRareLogDetector/pkg/filepointer"
 	"goRareLogDetector/pkg/utils"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -137,6 +146,343 @@ func Test_Analyzer_Run(t *testing.T) {
 
 }
 
+func Test_Analyzer_phraseSources(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_phraseSources")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := fmt.Sprintf("%s/sample.log*", testDir)
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+	dataDir := testDir + "/data"
+
+	if _, err := utils.CopyFile("../../test/data/rarelogdetector/analyzer/sample.log.1",
+		fmt.Sprintf("%s/sample.log.1", testDir)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 100, 0, "", 0, 0, 0, 0, nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	phrase := "comterm1 comterm2 comterm3 comterm4 comterm5 comterm6 comterm7 comterm8 part006 *"
+	src := a.trans.phraseSources[a.trans.phrases.getItemID(phrase)]
+	if err := utils.GetGotExpErr("source file", src.file, fmt.Sprintf("%s/sample.log.1", testDir)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("source row", src.row, 20); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	// sources must survive reloads
+	a, err = NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 100, 0, "", 0, 0, 0, 0, nil, nil, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	src = a.trans.phraseSources[a.trans.phrases.getItemID(phrase)]
+	if err := utils.GetGotExpErr("source row after reload", src.row, 20); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	res, err := a.TopN(10, 1, 100, false, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, r := range res {
+		if r.File == "" || r.Row <= 0 {
+			t.Errorf("no source for %s", r.Text)
+			return
+		}
+	}
+	fi, err := os.Stat(src.file)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("source epoch", src.epoch, fi.ModTime().Unix()); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	nSources := len(a.trans.phraseSources)
+	if err := utils.GetGotExpErr("source rows", a.phraseSourceRows, nSources); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	// only the changed sources are appended until the table is rewritten
+	for i, expRows := range []int{nSources * 2, nSources} {
+		logFile := fmt.Sprintf("%s/sample.log.%d", testDir, i+2)
+		if _, err := utils.CopyFile("../../test/data/rarelogdetector/analyzer/sample.log.1", logFile); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		mtime := fi.ModTime().Add(time.Duration(i+1) * time.Minute)
+		if err := os.Chtimes(logFile, mtime, mtime); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := a.Feed(0); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.Close()
+
+		a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		src = a.trans.phraseSources[a.trans.phrases.getItemID(phrase)]
+		a.Close()
+		if err := utils.GetGotExpErr("source file after feed", src.file, logFile); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("source epoch after feed", src.epoch, mtime.Unix()); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("source rows after feed", a.phraseSourceRows, expRows); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+}
+
+func Test_Analyzer_phraseSources_lastLine(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_phraseSources_lastLine")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the last line of the rotated file must keep the epoch of the rotated file
+	rotated := testDir + "/app.log.1"
+	if err := utils.Slice2File([]string{
+		"Aug 01 10:00:00 service started on node alpha",
+		"Aug 01 10:00:01 backup finished on node alpha",
+	}, rotated); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.Slice2File([]string{
+		"Aug 01 11:00:00 service started on node alpha",
+	}, testDir+"/app.log"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(rotated, mtime, mtime); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+	a, err := NewAnalyzer(testDir+"/data", testDir+"/app.log*", logFormat, layout, nil, nil, 100, 100, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the phrase of the backup line
+	src := a.trans.phraseSources[a.trans.phrases.getItemID("* * node alpha")]
+	if err := utils.GetGotExpErr("source file", src.file, rotated); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("source epoch", src.epoch, mtime.Unix()); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	_, lines, err := filepointer.ReadContext(src.file, src.epoch, src.row, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("context", strings.Join(lines, ""), "Aug 01 10:00:01 backup finished on node alpha"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Reduce(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Reduce")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/sample.log.1"
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 100, 0, "", 0, 0, 0, 0, nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	// reducing twice gives the same lines as the model is not updated
+	outfile := testDir + "/reduced.log"
+	for i := 0; i < 2; i++ {
+		a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		written, err := a.Reduce(logPath, 2, 0, 0, true, ",", outfile)
+		a.Close()
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("written lines", written, 3); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+
+	lines, err := utils.ReadFile2Slice(outfile)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("lines in file", len(lines), 3); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// original order and text must be kept
+	for i, uniq := range []string{"uniq001", "uniq002", "uniq003"} {
+		cols := strings.SplitN(lines[i], ",", 2)
+		if err := utils.GetGotExpErr("has phrase ID", len(cols), 2); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if !strings.HasSuffix(cols[1], uniq) {
+			t.Errorf("line %d got=%s expected to end with %s", i, cols[1], uniq)
+			return
+		}
+	}
+}
+
+func Test_Analyzer_ExportStructured(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_ExportStructured")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/sample_various.log"
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) \[\d+\]\[\w+\] (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+
+	a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 100, 100, 0, "", 0, 0, 0, 0, nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.ExportStructured(0, 0, "csv", testDir+"/sample"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	header, records, err := utils.ReadCsv(testDir + "/sample_structured.csv")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("structured header", strings.Join(header, ","),
+		"LineId,Timestamp,EventId,EventTemplate,ParameterList"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("structured lines", len(records), 14); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("timestamp", records[0][1], "Aug 01 10:24:20"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("template", records[0][3], "Zabbix server service started PID=<*>"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("parameters", records[0][4], "['10000']"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	_, templates, err := utils.ReadCsv(testDir + "/sample_templates.csv")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	total := 0
+	for _, tp := range templates {
+		cnt, _ := strconv.Atoi(tp[2])
+		total += cnt
+	}
+	if err := utils.GetGotExpErr("total occurrences", total, 14); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the delimiters are kept and the parameters fill the template again
+	message := "Zabbix server (pid: 10000) took 5321 ms; code 42"
+	_, _, phrasestr, err := a.trans.tokenizeLine(message, 0, 0, cStageElse, a.minMatchRate, a.maxMatchRate, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	template, params := a.trans.toTemplate(message, phrasestr)
+	if err := utils.GetGotExpErr("parameters of the message", formatParameterList(params), "['10000', '5321', '42']"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	filled := template
+	for _, p := range params {
+		filled = strings.Replace(filled, cTemplateParam, p, 1)
+	}
+	if err := utils.GetGotExpErr("filled template", filled, message); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
 func Test_Analyzer_Run2(t *testing.T) {
 	testDir, err := utils.InitTestDir("Test_Analyzer_Run2")
 	if err != nil {
@@ -410,7 +756,7 @@ func Test_Analyzer_Hourly(t *testing.T) {
 		t.Errorf("%v", err)
 		return
 	}
-	if err := utils.GetGotExpErr("len(header)", len(header), 4); err != nil {
+	if err := utils.GetGotExpErr("len(header)", len(header), 8); err != nil {
 		t.Errorf("%v", err)
 		return
 	}
@@ -722,3 +1068,2358 @@ func Test_Analyzer_customPhrases(t *testing.T) {
 	}
 
 }
+
+func Test_Analyzer_Evaluate(t *testing.T) {
+	labeledPath := "../../test/data/rarelogdetector/analyzer/changablephrases_labeled.csv"
+	a, err := NewAnalyzer("", "", "", "", nil, nil, 100, 100, 10, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	e, err := a.Evaluate(labeledPath, "", "", 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("lines", e.Lines, 100); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("templates", e.Templates, e.ExpectedTemplates); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("grouping accuracy", e.GroupingAccuracy, 1.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("f1", e.F1, 1.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// 2 groups of 2 lines are merged into 1 and 1 line is split from a group of 3
+	e = evaluateGrouping([]int{1, 1, 1, 1, 2, 2, 3, -1},
+		[]string{"a", "a", "b", "b", "c", "c", "c", "c"})
+	if err := utils.GetGotExpErr("skipped", e.Skipped, 1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("accuracy", e.GroupingAccuracy, 0.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// true pairs: a(1)+b(1)+c(1)=3, predicted pairs: 6+1=7, labeled pairs: 1+1+3=5
+	if err := utils.GetGotExpErr("precision", e.Precision, 3.0/7.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("recall", e.Recall, 3.0/5.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Sweep(t *testing.T) {
+	labeledPath := "../../test/data/rarelogdetector/analyzer/changablephrases_labeled.csv"
+	a, err := NewAnalyzer("", "", "", "", nil, nil, 100, 100, 10, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	results, err := a.Sweep([]float64{0.3, 0.6}, []float64{0.5, 0.999}, labeledPath, "", "")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("len(results)", len(results), 4); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// minMatchRate=0.3, termCountBorderRate=0.5 groups every 5 labels together
+	r := results[0]
+	if err := utils.GetGotExpErr("phrases", r.Phrases, 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("biggest share", r.BiggestShare, 0.5); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("recall", r.Evaluation.Recall, 1.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// minMatchRate=0.6, termCountBorderRate=0.999 is the best
+	r = results[3]
+	if err := utils.GetGotExpErr("accuracy", r.Evaluation.GroupingAccuracy, 1.0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// phrases of the model must be restored
+	if err := utils.GetGotExpErr("phrases after sweep", len(a.trans.phrases.counts), 10); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Explain(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Explain")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	// the phrase tree must be rebuilt from the saved phrases
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+
+	line := "Com1, grpa10 Com2 uniq0005 grpa50 uniq0105 <coM3> uniq0205 grpa20 uniq0305"
+	e, err := a.Explain(line, 0.5, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrase", e.Phrase, "com1 * com2 * grpa50 * com3 * * *"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("termCountBorder", e.TermCountBorder, 50); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("first sorted token", e.SortedCounts[0], 100); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(e.Path) == 0 {
+		t.Errorf("phrase tree path is empty")
+		return
+	}
+	if err := utils.GetGotExpErr("fallback", e.Fallback, ""); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("word", e.Words[1].Word, "grpa10"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("reason", e.Words[1].Reason, cReasonTermCountBorder); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the words give the phrase made by toPhrase
+	words := make([]string, 0, len(e.Words))
+	for _, ew := range e.Words {
+		switch {
+		case ew.Excluded:
+		case ew.Asterisk:
+			words = append(words, "*")
+		default:
+			words = append(words, ew.Term)
+		}
+	}
+	if err := utils.GetGotExpErr("phrase of the words", strings.Join(words, " "), e.Phrase); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("custom phrase", e.CustomPhrase, ""); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	if err := a.trans.registerCustomPhrase("Com1, * Com2 * grpa50 * <coM3> * grpa20 *",
+		0, 0, 0, ""); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	e, err = a.Explain(line, 0.5, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if e.CustomPhrase == "" {
+		t.Errorf("custom phrase must match")
+		return
+	}
+}
+
+func Test_Analyzer_stableIDs(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_stableIDs")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+
+	line := "Com1, grpa10 Com2 uniq0005 grpa50 uniq0105 <coM3> uniq0205 grpa20 uniq0305"
+	_, _, phrasestr, err := a.trans.tokenizeLine(line, 0, 0, cStageElse,
+		a.minMatchRate, a.maxMatchRate, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	p := a.trans.phrases
+	stableID := p.getStableID(p.getItemID(phrasestr))
+	if err := utils.GetGotExpErr("stable ID", stableID, newStableID(phrasestr)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("stable ID length", len(stableID), cStableIDLen); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// only the phrases have stable IDs
+	if err := utils.GetGotExpErr("stable IDs of terms", len(a.trans.terms.stableIDs), 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	termsIni, err := os.ReadFile(dataDir + "/terms/terms.tbl.ini")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if strings.Contains(string(termsIni), "stableID") {
+		t.Errorf("the terms table has the stableID column")
+		return
+	}
+
+	// the stable ID of the model points to the re-clustered phrase
+	if err := a.trans.rearangePhrases(0.5, 0, a.minMatchRate, a.maxMatchRate); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	phraseID := a.trans.findPhrase(stableID)
+	if err := utils.GetGotExpErr("re-clustered phrase", a.trans.phrases.getMember(phraseID),
+		"com1 * com2 * grpa50 * com3 * * *"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("re-clustered stable ID", a.trans.phrases.getStableID(phraseID),
+		newStableID("com1 * com2 * grpa50 * com3 * * *")); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// rearranged again
+	if err := a.trans.rearangePhrases(0.9, 100, a.minMatchRate, a.maxMatchRate); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if phraseID := a.trans.findPhrase(stableID); phraseID < 0 {
+		t.Errorf("stable ID %s is not found after rearranged twice", stableID)
+		return
+	}
+}
+
+func Test_Analyzer_dataVersion(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_dataVersion")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	version := 0
+	if err := a.dataVersionTable.Select1Row(nil, tableDefs["dataVersion"], &version); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("data version", version, cDataVersion); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the data directory written by a newer version is refused
+	if err := a.dataVersionTable.Upsert(nil, map[string]interface{}{"version": cDataVersion + 1}); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	if _, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true); err == nil {
+		t.Errorf("data directory of a newer version is opened")
+		return
+	}
+}
+
+func Test_Analyzer_Ack(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Ack")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	topN := func(a *Analyzer) map[string]bool {
+		scores, _ := a.TopN(100, 100, 0, false, 0.5, 0)
+		ids := make(map[string]bool, len(scores))
+		for _, s := range scores {
+			ids[s.PhraseID] = true
+		}
+		return ids
+	}
+
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	ids := topN(a)
+	if err := utils.GetGotExpErr("phrases before ack", len(ids), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	phraseID := newStableID("com1 * com2 * grpa50 * com3 * * *")
+	if !ids[phraseID] {
+		t.Errorf("phrase %s must be in topN", phraseID)
+		return
+	}
+	if err := a.Ack(phraseID, 0, "known", 0.5, 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Ack("notexist", 0, "", 0.5, 0); err == nil {
+		t.Errorf("ack of unknown phrase must fail")
+		return
+	}
+	a.Close()
+
+	// acks are saved in the data directory
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	ids = topN(a)
+	if ids[phraseID] {
+		t.Errorf("acked phrase %s must not be in topN", phraseID)
+		return
+	}
+	if err := utils.GetGotExpErr("phrases after ack", len(ids), 1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// expired acks are ignored
+	k := a.trans.acks[phraseID]
+	k.expireAt = time.Now().Unix() - 1
+	a.trans.acks[phraseID] = k
+	if ids = topN(a); !ids[phraseID] {
+		t.Errorf("phrase %s with expired ack must be in topN", phraseID)
+		return
+	}
+
+	if err := a.Unack(phraseID); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("acks", len(a.trans.acks), 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Annotate(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Annotate")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	customPhrases := []string{"Com1, * Com2 * grpb50 * <coM3> * * *"}
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, customPhrases, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	phraseID := newStableID("com1 * com2 * grpa50 * com3 * * *")
+	if err := a.Annotate(phraseID, PhraseAnnotation{Severity: "fatal"}, 0.5, 0); err == nil {
+		t.Errorf("unknown severity must fail")
+		return
+	}
+	if err := a.Annotate(phraseID, PhraseAnnotation{Label: "grp a", Severity: "error"}, 0.5, 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// only fields given are updated
+	if err := a.Annotate(phraseID, PhraseAnnotation{Owner: "team-a"}, 0.5, 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, customPhrases, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	if err := a.SetCustomPhraseAnnotation(customPhrases[0],
+		PhraseAnnotation{Label: "grp b", Notes: "runbook b"}); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	scores, err := a.TopN(100, 100, 0, false, 0.5, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrases", len(scores), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, s := range scores {
+		var expected PhraseAnnotation
+		switch s.Text {
+		case "com1 * com2 * grpa50 * com3 * * *":
+			expected = PhraseAnnotation{Label: "grp a", Severity: "error", Owner: "team-a"}
+		case "com1 * com2 * grpb50 * com3 * * *":
+			expected = PhraseAnnotation{Label: "grp b", Notes: "runbook b"}
+		default:
+			t.Errorf("unexpected phrase %s", s.Text)
+			return
+		}
+		if err := utils.GetGotExpErr("annotation of "+s.Text, s.Annotation, expected); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+}
+
+func Test_Analyzer_scoring(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_scoring")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/severity.log"
+	if err := utils.Slice2File([]string{
+		"2024-10-01 10:00:00 [INFO] service started on node alpha",
+		"2024-10-01 10:00:01 [INFO] service started on node beta",
+		"2024-10-01 10:00:02 [INFO] service started on node gamma",
+		"2024-10-01 10:00:03 [WARN] disk usage high on node alpha",
+		"2024-10-01 10:00:04 connection failed to backend delta",
+		"2024-10-02 10:00:04 [ERROR] database connection lost on node beta",
+	}, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (\[(?P<level>\w+)\] )?(?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the score is the rarity by default
+	scores, err := a.TopN(10, 10, 0, false, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, s := range scores {
+		if err := utils.GetGotExpErr("default score of "+s.Text, s.Score,
+			a.trans.phraseScores[s.phraseID]); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+
+	m := DefaultScoringModel()
+	m.SeverityWeights = map[string]float64{"info": 1, "warning": 1.5, "error": 2, "critical": 3}
+	m.ErrorKeywords = "failure|failed|error|down|crit"
+	m.RecencyWeight = 1
+	if err := a.SetScoringModel(m); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	scores, err = a.TopN(10, 10, 0, false, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	components := make(map[string]scoreComponents)
+	for _, s := range scores {
+		c := s.Components
+		if err := utils.GetGotExpErr("score of "+s.Text, s.Score,
+			c.Rarity*c.SeverityWeight*c.RecencyBoost); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		components[s.Text] = c
+	}
+	for _, tc := range []struct {
+		phrase   string
+		severity string
+		source   string
+		weight   float64
+		recency  float64
+	}{
+		{"* connection * node beta", "error", "field", 2, 2},
+		{"disk usage high node alpha", "warning", "field", 1.5, 1.5},
+		{"connection failed backend delta", "error", "keyword", 2, 1.5},
+	} {
+		c, ok := components[tc.phrase]
+		if !ok {
+			t.Errorf("phrase %s not found", tc.phrase)
+			return
+		}
+		if err := utils.GetGotExpErr("severity of "+tc.phrase, c.Severity, tc.severity); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("severity source of "+tc.phrase, c.SeveritySource, tc.source); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("severity weight of "+tc.phrase, c.SeverityWeight, tc.weight); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("recency boost of "+tc.phrase,
+			utils.Round(c.RecencyBoost, 3), tc.recency); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+}
+
+func Test_Analyzer_countHalfLife(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_countHalfLife")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/decay.log"
+	lines := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		lines = append(lines, fmt.Sprintf("2024-10-01 10:00:0%d user login succeeded", i))
+	}
+	lines = append(lines,
+		"2024-10-03 10:00:00 backup job completed",
+		"2024-10-03 10:00:00 backup job completed",
+	)
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	dataDir := testDir + "/data"
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.SetCountHalfLife(24 * time.Hour); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	check := func(a *Analyzer, title string) error {
+		// 8 lines 2 days ago decay to 2
+		for _, tc := range []struct {
+			term  string
+			count int
+		}{
+			{"login", 2},
+			{"backup", 2},
+		} {
+			termID := a.trans.terms.getItemID(tc.term)
+			if err := utils.GetGotExpErr(title+" count of "+tc.term,
+				a.trans.terms.getCount(termID), tc.count); err != nil {
+				return err
+			}
+		}
+		p := a.trans.phrases
+		if err := utils.GetGotExpErr(title+" count of phrase",
+			p.getCount(p.getItemID("user login succeeded")), 2); err != nil {
+			return err
+		}
+		if err := utils.GetGotExpErr(title+" total count of phrases", p.totalCount, 4); err != nil {
+			return err
+		}
+		// idf of the same count is the same regardless of the age
+		te := a.trans.terms
+		return utils.GetGotExpErr(title+" idf",
+			utils.Round(te.getIdf(te.getItemID("login")), 3),
+			utils.Round(te.getIdf(te.getItemID("backup")), 3))
+	}
+	if err := check(a, "fed"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	// the decayed counts are kept after the blocks are deleted
+	for _, name := range []string{"terms", "phrases"} {
+		if err := os.Remove(fmt.Sprintf("%s/%s/%s/BLK0000000000.csv.gz", dataDir, name, name)); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	if err := utils.GetGotExpErr("saved half life", a.countHalfLife, int64(24*3600)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := check(a, "reloaded"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Spikes(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Spikes")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/spikes.log"
+	lines := make([]string, 0)
+	for hour := 0; hour < 6; hour++ {
+		add := func(cnt int, message string) {
+			for i := 0; i < cnt; i++ {
+				lines = append(lines, fmt.Sprintf("2024-10-01 %02d:%02d:00 %s", hour, i, message))
+			}
+		}
+		add(5, "heartbeat received from scheduler")
+		if hour < 5 {
+			add(2, "disk write error on device")
+			add(20, "cache refresh completed successfully")
+		} else {
+			add(59, "disk write error on device")
+		}
+	}
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	dataDir := testDir + "/data"
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 1000, 10, "hour", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+
+	spikes, err := a.Spikes(3, cBaselineEWMA, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("spikes", len(spikes), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for i, tc := range []struct {
+		word      string
+		direction string
+		count     int
+		baseline  float64
+	}{
+		{"disk", "spike", 59, 2},
+		{"cache", "drop", 0, 20},
+	} {
+		s := spikes[i]
+		if !strings.Contains(s.Text, tc.word) {
+			t.Errorf("spikes[%d] got=%s expected to contain %s", i, s.Text, tc.word)
+			return
+		}
+		if err := utils.GetGotExpErr("direction of "+tc.word, s.direction(), tc.direction); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("count of "+tc.word, s.Count, tc.count); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr("baseline of "+tc.word, utils.Round(s.Baseline, 3), tc.baseline); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+
+	// a day of history is needed to compare with the same hour
+	if _, err := a.Spikes(3, cBaselineSeasonal, 0, 0); err == nil {
+		t.Errorf("seasonal baseline with 6 hours of history expected an error")
+		return
+	}
+
+	// blocks not rotated by the time unit cannot be counted by it
+	days := make([]string, 0)
+	for day := 1; day <= 6; day++ {
+		days = append(days, fmt.Sprintf("2024-10-%02d 10:00:00 disk write error on device", day))
+	}
+	if err := utils.Slice2File(days, testDir+"/days.log"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	b, err := NewAnalyzer(testDir+"/days", testDir+"/days.log", logFormat, layout, nil, nil, 100, 1000, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer b.Close()
+	if _, err := b.Spikes(3, cBaselineEWMA, 0, 0); err == nil {
+		t.Errorf("blocks of several days expected an error")
+		return
+	}
+}
+
+func Test_Analyzer_Missing(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Missing")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/missing.log"
+	lines := make([]string, 0)
+	for hour := 0; hour < 12; hour++ {
+		add := func(minute int, message string) {
+			lines = append(lines, fmt.Sprintf("2024-10-01 %02d:%02d:00 %s", hour, minute, message))
+		}
+		add(0, "request served by frontend")
+		// stopped after 07:00
+		if hour < 8 {
+			add(10, "health check passed for database")
+		}
+		// every 3 hours and the next one is expected at 12:00
+		if hour%3 == 0 {
+			add(20, "backup completed for volume")
+		}
+		// not periodic
+		if hour == 0 || hour == 1 || hour == 5 || hour == 6 || hour == 11 {
+			add(30, "user session expired quietly")
+		}
+	}
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	dataDir := testDir + "/data"
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 1000, 48, "hour", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+
+	missing, err := a.Missing(0.5, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("missing phrases", len(missing), 1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	m := missing[0]
+	if !strings.Contains(m.Text, "health") {
+		t.Errorf("missing phrase got=%s expected to contain health", m.Text)
+		return
+	}
+	if err := utils.GetGotExpErr("period", m.Period, int64(3600)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// seen at 07:10, expected at 08:10 and the latest log is at 11:30
+	if err := utils.GetGotExpErr("overdue", m.Overdue, int64(3*3600+20*60)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// acked phrases are not shown
+	if err := a.Ack(m.PhraseID, 0, "decommissioned", 0, 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	missing, err = a.Missing(0.5, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("missing phrases after ack", len(missing), 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_NewTerms(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_NewTerms")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/newterms.log"
+	lines := make([]string, 0)
+	for day := 1; day <= 3; day++ {
+		for i := 0; i < 3; i++ {
+			lines = append(lines,
+				fmt.Sprintf("2024-10-0%d 08:0%d:00 login accepted for user alice from 10.0.0.1", day, i),
+				fmt.Sprintf("2024-10-0%d 08:0%d:30 disk error code e1000 on sda", day, i))
+		}
+	}
+	lines = append(lines,
+		"2024-10-03 09:00:00 login accepted for user mallory from 10.9.8.7",
+		"2024-10-03 10:00:00 disk error code e5031 on sda")
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// src is captured inside the message
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+?(?: from (?P<src>[0-9.]+))?)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	for _, tc := range []struct {
+		termType string
+		field    string
+		terms    string
+	}{
+		{"", "", "10.9.8.7,e5031,mallory"},
+		{"ipv4", "", "10.9.8.7"},
+		{"id", "", "e5031"},
+		{"", "src", "10.9.8.7"},
+	} {
+		newTerms, err := a.NewTerms(24*time.Hour, tc.termType, tc.field, 0, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		terms := make([]string, len(newTerms))
+		for i, nt := range newTerms {
+			terms[i] = nt.Term
+			if len(nt.Samples) == 0 {
+				t.Errorf("no sample phrase of %s", nt.Term)
+				return
+			}
+		}
+		sort.Strings(terms)
+		if err := utils.GetGotExpErr("new terms of type="+tc.termType+" field="+tc.field,
+			strings.Join(terms, ","), tc.terms); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if tc.field == "src" {
+			if err := utils.GetGotExpErr("fields of "+terms[0],
+				strings.Join(newTerms[0].Fields, "|"), "message|src"); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+	}
+	if _, err := a.NewTerms(24*time.Hour, "uuid", "", 0, 0); err == nil {
+		t.Errorf("unknown term type expected an error")
+		return
+	}
+}
+
+func Test_Analyzer_Sessions(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Sessions")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/sessions.log"
+	dialog := []string{
+		"INVITE sip:bob@example.com call-id=%s",
+		"SIP/2.0 100 Trying call-id=%s",
+		"SIP/2.0 200 OK call-id=%s",
+		"ACK sip:bob@example.com call-id=%s",
+		"BYE sip:bob@example.com call-id=%s",
+	}
+	lines := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		callID := fmt.Sprintf("%d", 10000+i)
+		for j, msg := range dialog {
+			// 10009 has no ACK
+			if callID == "10009" && j == 3 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("2024-10-01 08:%02d:%02d ", i, j)+
+				fmt.Sprintf(msg, callID))
+		}
+	}
+	// the call-id of 10000 is reused an hour later
+	lines = append(lines,
+		"2024-10-01 09:30:00 "+fmt.Sprintf(dialog[0], "10000"),
+		"2024-10-01 09:30:01 "+fmt.Sprintf(dialog[4], "10000"))
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	for _, tc := range []struct {
+		endRegex  string
+		timeout   time.Duration
+		templates string
+	}{
+		// 10000 and the reused one are joined without timeout
+		{"", 0, "1,10000,7|1,10009,4|8,10008,5"},
+		{"", 10 * time.Minute, "1,10000,2|1,10009,4|9,10008,5"},
+		{"^\\S+ \\S+ BYE", 0, "1,10000,2|1,10009,4|9,10008,5"},
+	} {
+		a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		templates, err := a.Sessions(`call-id=(\S+)`, tc.endRegex, tc.timeout, 0, 0, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		got := make([]string, len(templates))
+		for i, st := range templates {
+			got[i] = fmt.Sprintf("%d,%s,%d", st.Count, st.SampleKey, len(st.PhraseIDs))
+			if err := utils.GetGotExpErr("template id of "+st.SampleKey, st.TemplateID,
+				newStableID(strings.Join(st.PhraseIDs, " "))); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+		if err := utils.GetGotExpErr("templates with end="+tc.endRegex+" timeout="+tc.timeout.String(),
+			strings.Join(got, "|"), tc.templates); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		// the rarest first
+		if templates[0].Score <= templates[len(templates)-1].Score {
+			t.Errorf("templates are not ordered by the score")
+			return
+		}
+	}
+
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	templates, err := a.Sessions(`call-id=(?P<key>\S+)`, "", 10*time.Minute, 1, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("templates seen once", len(templates), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if _, err := a.Sessions("", "", 0, 0, 0, 0); err == nil {
+		t.Errorf("empty session key expected an error")
+		return
+	}
+	a.Close()
+
+	// nothing is written to the data directory
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrases after sessions", len(a.trans.phrases.memberMap), 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+}
+
+func Test_Analyzer_Timeline(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Timeline")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/timeline.log"
+	lines := make([]string, 0)
+	for day := 1; day <= 2; day++ {
+		for hour := 0; hour < 24; hour++ {
+			lines = append(lines,
+				fmt.Sprintf("2024-10-0%d %02d:00:00 heartbeat ok from node1", day, hour),
+				fmt.Sprintf("2024-10-0%d %02d:30:00 request served for path index", day, hour))
+			if day == 2 && (hour == 12 || hour == 14) {
+				lines = append(lines,
+					fmt.Sprintf("2024-10-02 %02d:00:10 database connection refused by backend", hour),
+					fmt.Sprintf("2024-10-02 %02d:00:40 upstream timeout returned to client", hour),
+					fmt.Sprintf("2024-10-02 %02d:01:30 circuit breaker opened against storage", hour))
+			}
+		}
+	}
+	lines = append(lines, "2024-10-02 23:50:00 configuration reloaded by operator")
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	for _, tc := range []struct {
+		since    string
+		until    string
+		bursts   string
+		together int
+	}{
+		{"1d", "", "3,3|1,0", 2},
+		// until 13:50 before the second incident
+		{"1d", "10h", "3,3", 1},
+		{"1h", "", "1,0", 0},
+	} {
+		a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		since, err := ParseTimeArg(tc.since)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		until, err := ParseTimeArg(tc.until)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		bursts, err := a.Timeline(since, until, 5*time.Minute, 0, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		got := make([]string, len(bursts))
+		for i, b := range bursts {
+			got[i] = fmt.Sprintf("%d,%d", len(b.Phrases), len(b.Cooccurrences))
+		}
+		if err := utils.GetGotExpErr("bursts since="+tc.since+" until="+tc.until,
+			strings.Join(got, "|"), tc.bursts); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if len(bursts) > 0 && len(bursts[0].Phrases) == 3 {
+			// the first cause candidate first
+			if err := utils.GetGotExpErr("first phrase", bursts[0].Phrases[0].Text,
+				"database connection refused backend"); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+			if err := utils.GetGotExpErr("together", bursts[0].Cooccurrences[0].Together, tc.together); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+	}
+
+	ta, err := ParseTimeArg("2024-10-02 12:00:00")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	exp := time.Date(2024, 10, 2, 12, 0, 0, 0, time.Local).Unix()
+	if err := utils.GetGotExpErr("absolute time", ta.epochFrom(0), exp); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if _, err := ParseTimeArg("yesterday"); err == nil {
+		t.Errorf("invalid time expected an error")
+		return
+	}
+}
+
+func Test_Analyzer_Outliers(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Outliers")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/outliers.log"
+	dataDir := testDir + "/data"
+	latencyLine := func(min, sec, ms int) string {
+		return fmt.Sprintf("2024-10-01 08:%02d:%02d request to api took %d ms with status 200", min, sec, ms)
+	}
+	lines := make([]string, 0)
+	for i := 0; i < 100; i++ {
+		lines = append(lines, latencyLine(i/60, i%60, 80+i%40))
+		if i == 60 {
+			lines = append(lines, latencyLine(i/60, i%60, 5321))
+		}
+	}
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	outliers, err := a.Outliers(3)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	got := make([]string, len(outliers))
+	for i, o := range outliers {
+		got[i] = fmt.Sprintf("%d:%g", o.Pos, o.Value)
+	}
+	if err := utils.GetGotExpErr("outliers", strings.Join(got, ","), "0:5321"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// long numbers are excluded from the phrase as they were before outliers
+	_, _, withoutValue, err := a.trans.tokenizeLine("2024-10-01 08:01:00 request to api took ms with status 200",
+		0, 0, cStageElse, a.minMatchRate, a.maxMatchRate, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrase of the outlier", outliers[0].Text, withoutValue); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// numbers of 3 digits are terms, so 5321 ms is in the phrase of 80-99 ms.
+	// p99.9 of 80-99 ms with the relative error of the sketch
+	if outliers[0].High < 97*3*(1-cSketchAccuracy) || outliers[0].High > 99*3*(1+cSketchAccuracy) {
+		t.Errorf("high bound %g is not p99.9 * k", outliers[0].High)
+		return
+	}
+	a.Close()
+
+	// the distributions are kept in the data directory
+	// and only the new lines are checked
+	lines = append(lines, latencyLine(2, 0, 100), latencyLine(2, 1, 9000), latencyLine(2, 2, 20))
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err = NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	outliers, err = a.Outliers(3)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	got = make([]string, len(outliers))
+	for i, o := range outliers {
+		got[i] = fmt.Sprintf("%d:%g", o.Pos, o.Value)
+	}
+	if err := utils.GetGotExpErr("outliers after reload", strings.Join(got, ","), "0:9000,0:20"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_Score(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Score")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/changablephrases.log*"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, "", "", nil, nil, 100, 100, 10, "", 0.3, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	otherPath := testDir + "/other.log"
+	lines := []string{
+		"Com1, grpa10 Com2 uniq9001 grpa50 uniq9101 <coM3> uniq9201 grpa20 uniq9301",
+		"kernel panic unexpected trap in module xyz",
+	}
+	if err := os.WriteFile(otherPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	snapshot := func() (map[string]string, error) {
+		files := make(map[string]string)
+		err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[path] = fmt.Sprintf("%d %s", info.ModTime().UnixNano(), b)
+			return nil
+		})
+		return files, err
+	}
+	// a model copied without the lock file must not get it by scoring
+	if err := os.Remove(dataDir + "/" + cLockFile); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	before, err := snapshot()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	termCount := a.trans.terms.getCount(a.trans.terms.getItemID("com1"))
+	scored, err := a.Score(otherPath, 0.5, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// scoring again must give the same result as the model is frozen
+	again, err := a.Score(otherPath, 0.5, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("term count",
+		a.trans.terms.getCount(a.trans.terms.getItemID("com1")), termCount); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	if err := utils.GetGotExpErr("lines", len(scored), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("again", fmt.Sprint(again), fmt.Sprint(scored)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("known", scored[0].Novel, false); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrase", scored[0].Phrase, "com1 * com2 * grpa50 * com3 * * *"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if scored[0].PhraseID == "" || scored[0].Count == 0 {
+		t.Errorf("no phrase of the model for the known line: %+v", scored[0])
+		return
+	}
+	if err := utils.GetGotExpErr("novel", scored[1].Novel, true); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("row", scored[1].Row, 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	after, err := snapshot()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("files", len(after), len(before)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for path, content := range before {
+		if after[path] != content {
+			t.Errorf("%s was changed", path)
+			return
+		}
+	}
+}
+
+func Test_Analyzer_ExportModel(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_ExportModel")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logPath := "../../test/data/rarelogdetector/analyzer/sample.log"
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+	dataDir := testDir + "/data"
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 100, 100, 10, "", 0.7, 0, 0, 0,
+		[]string{"uniq021"}, []string{"comterm8"}, []string{"Comterm1 comterm2"}, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	modelPath := testDir + "/model.json.gz"
+	if err := a.ExportModel(modelPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	importedDir := testDir + "/imported"
+	b, err := ImportModel(importedDir, modelPath, "", nil, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	b.Close()
+	if _, err := ImportModel(importedDir, modelPath, "", nil, nil); err == nil {
+		t.Errorf("imported twice to the same directory")
+		return
+	}
+
+	// both are read from the data directories
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	b, err = NewAnalyzer2(importedDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer b.Close()
+
+	if err := utils.GetGotExpErr("config", fmt.Sprint(b.toModel().Config),
+		fmt.Sprint(a.toModel().Config)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("keywords", strings.Join(b.keywords, ","), "uniq021"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("ignorewords", strings.Join(b.ignorewords, ","), "comterm8"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if _, ok := b.trans.keywords["uniq021"]; !ok {
+		t.Errorf("keywords are not used by the tokenizer")
+		return
+	}
+	if err := utils.GetGotExpErr("custom phrases", b.trans.customPhrases.getItemID("Comterm1 comterm2") > 0, true); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, c := range []struct {
+		name string
+		a    *items
+		b    *items
+	}{
+		{"terms", a.trans.terms, b.trans.terms},
+		{"phrases", a.trans.phrases, b.trans.phrases},
+	} {
+		if err := utils.GetGotExpErr(c.name, fmt.Sprint(exportItems(c.b)), fmt.Sprint(exportItems(c.a))); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if len(exportItems(c.a)) == 0 {
+			t.Errorf("no %s in the model", c.name)
+			return
+		}
+	}
+
+	line := "Aug 01 10:24:20 Comterm1 comterm2 comterm3 comterm4 comterm5 comterm6 comterm7 comterm8 part007 uniq099"
+	ea, err := a.Explain(line, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	eb, err := b.Explain(line, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrase", eb.Phrase, ea.Phrase); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// models of newer versions are rejected
+	f, err := os.Create(testDir + "/newer.json.gz")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	zw := gzip.NewWriter(f)
+	zw.Write([]byte(`{"version": 99}`))
+	zw.Close()
+	f.Close()
+	if _, err := ImportModel(testDir+"/newer", testDir+"/newer.json.gz", "", nil, nil); err == nil {
+		t.Errorf("model of a newer version is accepted")
+		return
+	}
+}
+
+func Test_Analyzer_MergeModels(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_MergeModels")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+	hosts := map[string]string{
+		"hostA": "Aug 01 10:40:00 disk sda failure detected on controller",
+		"hostB": "Aug 01 10:50:00 kernel oops happened in driver xyz",
+	}
+	for host, rare := range hosts {
+		lines := make([]string, 0)
+		for i := 0; i < 30; i++ {
+			lines = append(lines, fmt.Sprintf("Aug 01 10:%02d:00 session opened for user u%04d by sshd", i, i))
+		}
+		lines = append(lines, rare)
+		logPath := fmt.Sprintf("%s/%s.log", testDir, host)
+		if err := os.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a, err := NewAnalyzer(testDir+"/"+host, logPath, logFormat, layout, nil, nil, 100, 100, 10, "", 0, 0, 0, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := a.Feed(0); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.Close()
+	}
+
+	// a data directory and an exported model can be merged
+	a, err := NewAnalyzer2(testDir+"/hostB", nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.ExportModel(testDir + "/hostB.json.gz"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	mergedDir := testDir + "/merged"
+	sources := []string{"hostA=" + testDir + "/hostA", "hostB=" + testDir + "/hostB.json.gz"}
+	a, err = MergeModels(mergedDir, sources, "", nil, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	if _, err := MergeModels(mergedDir, sources, "", nil, nil); err == nil {
+		t.Errorf("merged twice to the same directory")
+		return
+	}
+
+	a, err = NewAnalyzer2(mergedDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	te := a.trans.terms
+	if err := utils.GetGotExpErr("term count", te.getCount(te.getItemID("session")), 60); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("term of one host", te.getCount(te.getItemID("oops")), 1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	only, err := a.Origins(0, 1, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("phrases seen only on one host", len(only), 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	got := make(map[string]string)
+	for _, po := range only {
+		got[po.Text] = originsString(po.Origins)
+	}
+	if err := utils.GetGotExpErr("hostA", got["disk sda failure detected controller"], "hostA=1"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("hostB", got["kernel oops happened driver xyz"], "hostB=1"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	all, err := a.Origins(0, 2, 0, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("all phrases", len(all), 3); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	common := all[len(all)-1]
+	if err := utils.GetGotExpErr("common phrase", originsString(common.Origins), "hostA=30 hostB=30"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("common count", common.Count, 60); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_MergeModels_templates(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_MergeModels_templates")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// both hosts have "call-id * start call" with different last lines,
+	// and the call-id of the last line of hostA is frequent on hostB
+	logFormat := `^(?P<timestamp>\w+ \d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "Jan 2 15:04:05"
+	for host, calls := range map[string][2]int{"hostA": {10, 21}, "hostB": {40, 11}} {
+		lines := make([]string, 0)
+		for i := 0; i < calls[1]; i++ {
+			lines = append(lines, fmt.Sprintf("Aug 01 10:%02d:00 call-id c%d start call", i, calls[0]+i))
+		}
+		for i := 0; i < 20 && host == "hostB"; i++ {
+			lines = append(lines, fmt.Sprintf("Aug 01 11:%02d:00 token c30 refreshed", i))
+		}
+		logPath := fmt.Sprintf("%s/%s.log", testDir, host)
+		if err := os.WriteFile(logPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a, err := NewAnalyzer(testDir+"/"+host, logPath, logFormat, layout, nil, nil, 100, 100, 10, "", 0.6, 0, 0.999, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := a.Feed(0); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.Close()
+	}
+
+	mergedDir := testDir + "/merged"
+	a, err := MergeModels(mergedDir, []string{"hostA=" + testDir + "/hostA", "hostB=" + testDir + "/hostB"}, "", nil, nil)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+
+	a, err = NewAnalyzer2(mergedDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	all, err := a.Origins(0, 2, 0.999, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	got := make(map[string]string)
+	for _, po := range all {
+		got[po.Text] = originsString(po.Origins)
+	}
+	if err := utils.GetGotExpErr("phrases", len(got), 2); err != nil {
+		t.Errorf("%v %v", err, got)
+		return
+	}
+	if err := utils.GetGotExpErr("shared template", got["call-id * start call"], "hostA=21 hostB=11"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func Test_Analyzer_MaxTerms(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_MaxTerms")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/budget.log"
+	lines := make([]string, 0)
+	for i := 0; i < 3000; i++ {
+		ts := fmt.Sprintf("2024-10-01 %02d:%02d:%02d ", i/3600, i/60%60, i%60)
+		// session IDs are seen only once
+		lines = append(lines, ts+fmt.Sprintf("user login succeeded session=sess%x from gateway", 0xa0000+i))
+		if i%3 == 0 {
+			lines = append(lines, ts+fmt.Sprintf("disk check done on node%d", i%5))
+		}
+	}
+	if err := utils.Slice2File(lines, logPath); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	phrasesOf := func(a *Analyzer) string {
+		res := make([]string, 0)
+		for phraseID, cnt := range a.trans.phrases.counts {
+			res = append(res, fmt.Sprintf("%s=%d", a.trans.phrases.getMember(phraseID), cnt))
+		}
+		sort.Strings(res)
+		return strings.Join(res, "|")
+	}
+
+	u, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := u.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	unbounded := phrasesOf(u)
+	u.Close()
+
+	dataDir := testDir + "/data"
+	maxTerms := 50
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.SetMaxTerms(maxTerms); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(a.trans.terms.members) > maxTerms {
+		t.Errorf("%d terms are kept over the budget %d", len(a.trans.terms.members), maxTerms)
+		return
+	}
+	for word, cnt := range map[string]int{"login": 3000, "gateway": 3000, "disk": 1000} {
+		if err := utils.GetGotExpErr("count of "+word,
+			a.trans.terms.getCount(a.trans.terms.getItemID(word)), cnt); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	if err := utils.GetGotExpErr("phrases", phrasesOf(a), unbounded); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if a.trans.terms.getTailCount("sessa0001") < 1 {
+		t.Errorf("terms out of the budget are not counted")
+		return
+	}
+	if err := a.SetMaxTerms(-1); err == nil {
+		t.Errorf("negative budget expected an error")
+		return
+	}
+	a.Close()
+
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	if err := utils.GetGotExpErr("saved budget", a.maxTerms, maxTerms); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if len(a.trans.terms.members) > maxTerms {
+		t.Errorf("%d terms are loaded over the budget %d", len(a.trans.terms.members), maxTerms)
+		return
+	}
+	// the sketch is saved in the snapshot
+	if err := utils.GetGotExpErr("replayed blocks", a.trans.terms.replayedBlocks, 0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if a.trans.terms.getTailCount("sessa0001") < 1 {
+		t.Errorf("terms out of the budget are not loaded from the snapshot")
+		return
+	}
+}
+
+func Test_Analyzer_Workers(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Workers")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/workers.log"
+	if err := writeFeedLog(logPath, 0, 5000); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	models := make([]string, 0)
+	for _, workers := range []int{1, 3, 8} {
+		dataDir := fmt.Sprintf("%s/data%d", testDir, workers)
+		a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 10, 500, 0, "", 0, 0, 0, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.SetWorkers(workers)
+		// stop in the middle of a batch
+		if err := a.Feed(2500); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr(fmt.Sprintf("lines with %d workers", workers),
+			fmt.Sprintf("%d,%d", a.linesProcessed, a.fp.Row()), "2500,2500"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.Close()
+
+		a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		a.SetWorkers(workers)
+		if err := a.Feed(0); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		m := a.toModel()
+		m.ExportedAt = 0
+		m.Config.LogPath = ""
+		models = append(models, fmt.Sprintf("%v", *m))
+		a.Close()
+	}
+	for n := range models[1:] {
+		if models[n+1] != models[0] {
+			t.Errorf("the model depends on the number of workers")
+			return
+		}
+	}
+}
+
+// writeFeedLog writes lines from start to start+n-1 of a few messages with IDs and numbers
+func writeFeedLog(logPath string, start, n int) error {
+	msgs := []string{
+		"user login succeeded session=sess%x from gateway",
+		"GET /api/v1/items/%d 200 latency=%dms",
+		"disk check done on node%d usage=%d%%",
+		"connection reset by peer %d.%d.0.1 retry",
+	}
+	lines := make([]string, 0, n)
+	for i := start; i < start+n; i++ {
+		ts := fmt.Sprintf("2024-10-01 %02d:%02d:%02d ", i/3600%24, i/60%60, i%60)
+		msg := msgs[i%len(msgs)]
+		if i%len(msgs) == 0 {
+			lines = append(lines, ts+fmt.Sprintf(msg, 0xa0000+i))
+		} else {
+			lines = append(lines, ts+fmt.Sprintf(msg, i%97, i%13))
+		}
+	}
+	return utils.Slice2File(lines, logPath)
+}
+
+func Benchmark_Analyzer_Feed(b *testing.B) {
+	testDir, err := utils.InitTestDir("Benchmark_Analyzer_Feed")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	logPath := testDir + "/feed.log"
+	if err := writeFeedLog(logPath, 0, 20000); err != nil {
+		b.Fatalf("%v", err)
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	for _, workers := range []int{1, 2, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				a, err := NewAnalyzer("", logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+					nil, nil, nil, false)
+				if err != nil {
+					b.Fatalf("%v", err)
+				}
+				a.SetWorkers(workers)
+				if err := a.Feed(0); err != nil {
+					b.Fatalf("%v", err)
+				}
+			}
+		})
+	}
+}
+
+// itemsState returns the items by their texts to compare items with different IDs
+func itemsState(i *items) map[string]string {
+	res := make(map[string]string)
+	for item, itemID := range i.members {
+		res[item] = fmt.Sprintf("%d,%d,%d,%s,%s,%d,%d", i.counts[itemID],
+			i.createEpochs[itemID], i.lastUpdates[itemID], i.lastValues[itemID],
+			i.getStableID(itemID), i.currCounts[itemID], i.currUpdates[itemID])
+	}
+	res[""] = fmt.Sprintf("%d,%d,%d", i.totalCount, i.lastUpdate, i.currItemCount)
+	return res
+}
+
+// diffStates returns the first item different between the states
+func diffStates(name string, got, exp map[string]string) error {
+	for item, v := range exp {
+		if got[item] != v {
+			return utils.GetGotExpErr(name+" "+item, got[item], v)
+		}
+	}
+	return utils.GetGotExpErr(name+" items", len(got), len(exp))
+}
+
+func phraseScoresState(t *trans) map[string]float64 {
+	res := make(map[string]float64)
+	for phraseID, score := range t.phraseScores {
+		res[t.phrases.getMember(phraseID)] = score
+	}
+	return res
+}
+
+func Test_Analyzer_Snapshot(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Snapshot")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+
+	// rotated log files with the line numbers from start
+	writeLog := func(logPath string, start, n int, mtime time.Time) error {
+		if err := writeFeedLog(logPath, start, n); err != nil {
+			return err
+		}
+		return os.Chtimes(logPath, mtime, mtime)
+	}
+	mtime := time.Now().Add(-time.Hour)
+
+	// loads with the snapshot and without it and compares them
+	// returns the blocks replayed for the terms and the phrases
+	compare := func(name, dataDir string) (int, int, error) {
+		snapshotPath := dataDir + "/snapshot.gob"
+		a, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer a.Close()
+		termsReplayed := a.trans.terms.replayedBlocks
+		phrasesReplayed := a.trans.phrases.replayedBlocks
+		if utils.PathExist(snapshotPath) {
+			if err := os.Rename(snapshotPath, snapshotPath+".bak"); err != nil {
+				return 0, 0, err
+			}
+			defer os.Rename(snapshotPath+".bak", snapshotPath)
+		}
+		b, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer b.Close()
+		if err := diffStates(name+" terms", itemsState(a.trans.terms),
+			itemsState(b.trans.terms)); err != nil {
+			return 0, 0, err
+		}
+		if err := diffStates(name+" phrases", itemsState(a.trans.phrases),
+			itemsState(b.trans.phrases)); err != nil {
+			return 0, 0, err
+		}
+		return termsReplayed, phrasesReplayed, utils.GetGotExpErr(name+" scores",
+			fmt.Sprint(phraseScoresState(a.trans)), fmt.Sprint(phraseScoresState(b.trans)))
+	}
+
+	dataDir := testDir + "/data"
+	logPath := testDir + "/snapshot.log"
+	if err := writeLog(logPath+".2", 0, 3000, mtime); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err := NewAnalyzer(dataDir, logPath+"*", logFormat, layout, nil, nil, 100, 0, 0, "hour", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	termsReplayed, phrasesReplayed, err := compare("after feed", dataDir)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("replayed blocks after feed",
+		fmt.Sprint(termsReplayed, phrasesReplayed), "0 0"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	snapshotPath := dataDir + "/snapshot.gob"
+	saved, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the process stopped before saving the snapshot
+	if err := writeLog(logPath+".1", 3000, 3000, mtime.Add(time.Minute)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	if err := os.WriteFile(snapshotPath, saved, 0644); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the current block of the snapshot and the blocks added after it
+	termsReplayed, phrasesReplayed, err = compare("replayed", dataDir)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if termsReplayed <= 1 || phrasesReplayed <= 1 {
+		t.Errorf("%d and %d blocks are replayed after the snapshot", termsReplayed, phrasesReplayed)
+		return
+	}
+
+	if err := os.WriteFile(snapshotPath, []byte("broken"), 0644); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	termsReplayed, phrasesReplayed, err = compare("broken", dataDir)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("replayed blocks with a broken snapshot",
+		fmt.Sprint(termsReplayed, phrasesReplayed), "-1 -1"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// blocks deleted by the retention
+	dataDir = testDir + "/retention"
+	logPath = testDir + "/retention.log"
+	if err := writeLog(logPath+".2", 0, 3000, mtime); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err = NewAnalyzer(dataDir, logPath+"*", logFormat, layout, nil, nil, 4, 0, 1, "hour", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	if err := writeLog(logPath+".1", 3000, 6000, mtime.Add(time.Minute)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err = NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a.Close()
+	// the rows of the phrases are deleted but the terms are still in the blocks
+	_, phrasesReplayed, err = compare("retention", dataDir)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("replayed blocks after the retention", phrasesReplayed, -1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+// the process stops after committing the blocks but before saving the last status
+func Test_Analyzer_InterruptedCommit(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_InterruptedCommit")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	mtime := time.Now().Add(-time.Hour)
+	logPath := testDir + "/interrupted.log"
+	if err := writeFeedLog(logPath+".2", 0, 500); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := os.Chtimes(logPath+".2", mtime, mtime); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	feed := func(dataDir string) error {
+		a, err := NewAnalyzer(dataDir, logPath+"*", logFormat, layout, nil, nil, 100, 0, 0, "hour", 0, 0, 0, 0,
+			nil, nil, nil, false)
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+		return a.Feed(0)
+	}
+
+	expDir := testDir + "/expected"
+	dataDir := testDir + "/data"
+	for _, dir := range []string{expDir, dataDir} {
+		if err := feed(dir); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	lastStatus, err := os.ReadFile(dataDir + "/lastStatus/lastStatus.csv")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	if err := writeFeedLog(logPath+".1", 500, 250); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := os.Chtimes(logPath+".1", mtime.Add(time.Minute), mtime.Add(time.Minute)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, dir := range []string{expDir, dataDir} {
+		if err := feed(dir); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	// the lines after the last status are read again
+	if err := os.WriteFile(dataDir+"/lastStatus/lastStatus.csv", lastStatus, 0644); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := feed(dataDir); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	a, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	b, err := NewAnalyzer2(expDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer b.Close()
+	if err := diffStates("terms", itemsState(a.trans.terms),
+		itemsState(b.trans.terms)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := diffStates("phrases", itemsState(a.trans.phrases),
+		itemsState(b.trans.phrases)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+// holds the lock of the data directory in another process for Test_Analyzer_Lock
+func Test_Analyzer_LockHolder(t *testing.T) {
+	dataDir := os.Getenv("RARELOG_TEST_LOCK_DATADIR")
+	if dataDir == "" {
+		return
+	}
+	a, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, os.Getenv("RARELOG_TEST_LOCK_READONLY") != "")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer a.Close()
+	fmt.Println("locked")
+	// until the test closes stdin
+	io.ReadAll(os.Stdin)
+}
+
+func Test_Analyzer_Lock(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_Analyzer_Lock")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer SetLockTimeout(0)
+	logFormat := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	layout := "2006-01-02 15:04:05"
+	dataDir := testDir + "/data"
+	logPath := testDir + "/lock.log"
+	if err := writeFeedLog(logPath, 0, 100); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	a, err := NewAnalyzer(dataDir, logPath, logFormat, layout, nil, nil, 0, 0, 0, "", 0, 0, 0, 0,
+		nil, nil, nil, false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := a.Feed(0); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the analyzers of a process share the lock
+	b, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	b.Close()
+	a.Close()
+
+	// returns the function to release the lock held by another process
+	hold := func(readOnly bool) (int, func(), error) {
+		cmd := exec.Command(os.Args[0], "-test.run", "^Test_Analyzer_LockHolder$")
+		cmd.Env = append(os.Environ(), "RARELOG_TEST_LOCK_DATADIR="+dataDir)
+		if readOnly {
+			cmd.Env = append(cmd.Env, "RARELOG_TEST_LOCK_READONLY=1")
+		}
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return 0, nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return 0, nil, err
+		}
+		release := func() {
+			stdin.Close()
+			cmd.Wait()
+		}
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "locked" {
+			release()
+			return 0, nil, fmt.Errorf("failed to lock in another process: %q %v", line, err)
+		}
+		return cmd.Process.Pid, release, nil
+	}
+	open := func(readOnly bool) error {
+		a, err := NewAnalyzer2(dataDir, nil, nil, 0, 0, nil, readOnly)
+		if err == nil {
+			a.Close()
+		}
+		return err
+	}
+	checkLocked := func(title string, err error, pid int, usage string) error {
+		expected := fmt.Sprintf("is being %s by the process with PID %d", usage, pid)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			return fmt.Errorf("%s: got=%v expected=%s", title, err, expected)
+		}
+		return nil
+	}
+
+	// a writer in another process
+	pid, release, err := hold(false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkLocked("writer and writer", open(false), pid, "written"); err != nil {
+		release()
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkLocked("writer and reader", open(true), pid, "written"); err != nil {
+		release()
+		t.Errorf("%v", err)
+		return
+	}
+	// waits until the other process ends
+	SetLockTimeout(time.Minute)
+	released := make(chan struct{})
+	go func(release func()) {
+		defer close(released)
+		time.Sleep(300 * time.Millisecond)
+		release()
+	}(release)
+	err = open(false)
+	<-released
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	SetLockTimeout(0)
+
+	// a reader in another process
+	pid, release, err = hold(true)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer release()
+	if err := open(true); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkLocked("reader and writer", open(false), pid, "read"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// severities accepted in annotations
+var severities = []string{"info", "warning", "error", "critical"}
+
+// PhraseAnnotation is metadata of a phrase edited by users
+type PhraseAnnotation struct {
+	Label    string
+	Severity string
+	Owner    string
+	Notes    string
+}
+
+func (an PhraseAnnotation) isEmpty() bool {
+	return an.Label == "" && an.Severity == "" && an.Owner == "" && an.Notes == ""
+}
+
+// merge overwrites fields with the ones not empty in other
+func (an PhraseAnnotation) merge(other PhraseAnnotation) PhraseAnnotation {
+	if other.Label != "" {
+		an.Label = other.Label
+	}
+	if other.Severity != "" {
+		an.Severity = other.Severity
+	}
+	if other.Owner != "" {
+		an.Owner = other.Owner
+	}
+	if other.Notes != "" {
+		an.Notes = other.Notes
+	}
+	return an
+}
+
+func validateSeverity(severity string) error {
+	if severity == "" {
+		return nil
+	}
+	for _, s := range severities {
+		if s == severity {
+			return nil
+		}
+	}
+	return fmt.Errorf("severity must be one of %s", strings.Join(severities, "|"))
+}
+
+// phraseAnnotations returns the annotations of the current phrases
+func (t *trans) phraseAnnotations() map[int]PhraseAnnotation {
+	res := make(map[int]PhraseAnnotation)
+	for stableID, an := range t.customAnnotations {
+		if phraseID := t.phrases.getItemIDByStableID(stableID); phraseID >= 0 {
+			res[phraseID] = res[phraseID].merge(an)
+		}
+	}
+	for stableID, an := range t.annotations {
+		if phraseID := t.findPhrase(stableID); phraseID >= 0 {
+			res[phraseID] = res[phraseID].merge(an)
+		}
+	}
+	return res
+}
+
+func (a *Analyzer) saveAnnotations() error {
+	if a.dataDir == "" {
+		return nil
+	}
+	if err := a.annotationsTable.Truncate(); err != nil {
+		return err
+	}
+	for stableID, an := range a.trans.annotations {
+		if err := a.annotationsTable.InsertRow(nil,
+			stableID, a.trans.annotatedPhrases[stableID],
+			an.Label, an.Severity, an.Owner, an.Notes); err != nil {
+			return err
+		}
+	}
+	return a.annotationsTable.Flush()
+}
+
+func (a *Analyzer) loadAnnotations() error {
+	rows, err := a.annotationsTable.SelectRows(nil, tableDefs["annotations"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		var stableID, phrase string
+		var an PhraseAnnotation
+		if err := rows.Scan(&stableID, &phrase,
+			&an.Label, &an.Severity, &an.Owner, &an.Notes); err != nil {
+			return err
+		}
+		a.trans.annotations[stableID] = an
+		a.trans.annotatedPhrases[stableID] = phrase
+	}
+	return nil
+}
+
+// Annotate sets the fields not empty in an to the phrase.
+// The phrase ID can be the one shown with the same termCountBorderRate and termCountBorder.
+func (a *Analyzer) Annotate(phraseID string, an PhraseAnnotation,
+	termCountBorderRate float64, termCountBorder int) error {
+	if a.readOnly {
+		return fmt.Errorf("cannot annotate in read only mode")
+	}
+	if err := validateSeverity(an.Severity); err != nil {
+		return err
+	}
+	if an.isEmpty() {
+		return fmt.Errorf("nothing to annotate")
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return err
+	}
+	id := a.trans.findPhrase(phraseID)
+	if id < 0 {
+		return fmt.Errorf("phrase %s not found", phraseID)
+	}
+
+	a.trans.annotations[phraseID] = a.trans.annotations[phraseID].merge(an)
+	a.trans.annotatedPhrases[phraseID] = a.trans.phrases.getMember(id)
+	return a.saveAnnotations()
+}
+
+// SetCustomPhraseAnnotation sets an annotation to a custom phrase.
+// It is not saved in the data directory.
+func (a *Analyzer) SetCustomPhraseAnnotation(phrase string, an PhraseAnnotation) error {
+	if err := validateSeverity(an.Severity); err != nil {
+		return err
+	}
+	tokens, _, err := a.trans.toTermList(phrase, 0, false)
+	if err != nil {
+		return err
+	}
+	words := make([]string, len(tokens))
+	for i, termID := range tokens {
+		words[i] = a.trans.terms.getMember(termID)
+	}
+	a.trans.customAnnotations[newStableID(strings.Join(words, " "))] = an
+	return nil
+}
@@ -0,0 +1,249 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Memory budget of terms.
+// Past maxItems distinct items, new items are counted only in a count-min
+// sketch and become "*" in phrases, so the long tail of IDs like session IDs
+// does not grow the maps. An item seen cMinAdmitCount times in the sketch
+// is tracked again after the least frequent items are pruned to the sketch.
+// Frequent items are kept and phrases of them are not affected.
+
+// countMinSketch counts items approximately in depth rows of width counters.
+// The estimate is not less than the true count unless counts are removed.
+type countMinSketch struct {
+	width    uint64
+	counters [][]uint32
+}
+
+func newCountMinSketch(width int) *countMinSketch {
+	if width < cMinTailWidth {
+		width = cMinTailWidth
+	}
+	s := &countMinSketch{
+		width:    uint64(width),
+		counters: make([][]uint32, cTailDepth),
+	}
+	for d := range s.counters {
+		s.counters[d] = make([]uint32, width)
+	}
+	return s
+}
+
+// indexes returns the counter of the item in each row by double hashing
+func (s *countMinSketch) indexes(item string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	h1 := h.Sum64()
+	h2 := h1>>32 | h1<<32 | 1
+	res := make([]uint64, len(s.counters))
+	for d := range res {
+		res[d] = (h1 + uint64(d)*h2) % s.width
+	}
+	return res
+}
+
+func (s *countMinSketch) add(item string, cnt int) {
+	for d, idx := range s.indexes(item) {
+		v := int64(s.counters[d][idx]) + int64(cnt)
+		if v < 0 {
+			v = 0
+		}
+		s.counters[d][idx] = uint32(v)
+	}
+}
+
+func (s *countMinSketch) clone() *countMinSketch {
+	if s == nil {
+		return nil
+	}
+	c := &countMinSketch{
+		width:    s.width,
+		counters: make([][]uint32, len(s.counters)),
+	}
+	for d, row := range s.counters {
+		c.counters[d] = append([]uint32(nil), row...)
+	}
+	return c
+}
+
+func (s *countMinSketch) estimate(item string) int {
+	est := -1
+	for d, idx := range s.indexes(item) {
+		if v := int(s.counters[d][idx]); est < 0 || v < est {
+			est = v
+		}
+	}
+	return est
+}
+
+// setMaxItems sets the budget and prunes the items over it. 0 disables it.
+func (i *items) setMaxItems(maxItems int) {
+	i.maxItems = maxItems
+	if maxItems <= 0 {
+		return
+	}
+	if i.tail == nil {
+		i.tail = newCountMinSketch(maxItems)
+	}
+	if len(i.members) > maxItems {
+		i.prune()
+	}
+}
+
+// pin keeps the item out of the budget like keywords
+func (i *items) pin(item string) {
+	if i.pinned == nil {
+		i.pinned = make(map[string]bool)
+	}
+	i.pinned[item] = true
+}
+
+// getTailCount returns the approximate count of an item out of the budget
+func (i *items) getTailCount(item string) int {
+	if i.tail == nil {
+		return 0
+	}
+	return i.tail.estimate(item)
+}
+
+// admit counts an item out of the budget in the sketch and tells if it is
+// to be tracked. Then the count in the sketch is returned to be added to
+// the item and the least frequent items are pruned to make room.
+// Lookups with addCount=0 do not add items out of the budget.
+func (i *items) admit(item string, addCount int) (int, bool) {
+	if i.tail == nil {
+		i.tail = newCountMinSketch(i.maxItems)
+	}
+	if i.pinned[item] {
+		extra := i.tail.estimate(item)
+		i.tail.add(item, -extra)
+		if len(i.members) >= i.maxItems {
+			i.prune()
+		}
+		return extra, true
+	}
+	if addCount <= 0 {
+		return 0, false
+	}
+	i.tail.add(item, addCount)
+	est := i.tail.estimate(item)
+	if est < cMinAdmitCount {
+		i.totalCount += addCount
+		return 0, false
+	}
+	i.tail.add(item, -est)
+	i.prune()
+	// the counts in the sketch are already in totalCount
+	return est - addCount, true
+}
+
+// prune moves the least frequent and oldest items to the sketch
+// until a tenth of the budget is free
+func (i *items) prune() {
+	target := i.maxItems - i.maxItems/cPruneDivisor - 1
+	if target < 0 {
+		target = 0
+	}
+	if len(i.members) <= target {
+		return
+	}
+	victims := make([]int, 0, len(i.members))
+	for item, itemID := range i.members {
+		if !i.pinned[item] {
+			victims = append(victims, itemID)
+		}
+	}
+	sort.Slice(victims, func(a, b int) bool {
+		ca, cb := i.counts[victims[a]], i.counts[victims[b]]
+		if ca != cb {
+			return ca < cb
+		}
+		la, lb := i.lastUpdates[victims[a]], i.lastUpdates[victims[b]]
+		if la != lb {
+			return la < lb
+		}
+		return victims[a] < victims[b]
+	})
+	for _, itemID := range victims {
+		if len(i.members) <= target {
+			break
+		}
+		i.evict(itemID)
+	}
+}
+
+// evict forgets the item keeping its count in the sketch
+func (i *items) evict(itemID int) {
+	item := i.memberMap[itemID]
+	if cnt := i.counts[itemID]; cnt > 0 {
+		i.tail.add(item, cnt)
+	}
+	if w, ok := i.decayedCounts[itemID]; ok {
+		i.decayedTotal -= w
+		delete(i.decayedCounts, itemID)
+	}
+	if stableID, ok := i.stableIDs[itemID]; ok {
+		delete(i.stableIDMembers, stableID)
+	}
+	delete(i.members, item)
+	delete(i.memberMap, itemID)
+	delete(i.counts, itemID)
+	delete(i.createEpochs, itemID)
+	delete(i.lastUpdates, itemID)
+	delete(i.lastValues, itemID)
+	delete(i.tokensMap, itemID)
+	delete(i.stableIDs, itemID)
+	delete(i.currCounts, itemID)
+	delete(i.commitCounts, itemID)
+	delete(i.currUpdates, itemID)
+	delete(i.currCreateEpochs, itemID)
+}
+
+func (t *trans) setMaxTerms(maxTerms int) {
+	t.terms.setMaxItems(maxTerms)
+}
+
+func (a *Analyzer) saveTermBudget() error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+	return a.termBudgetTable.Upsert(nil, map[string]interface{}{
+		"maxTerms": a.maxTerms,
+	})
+}
+
+func (a *Analyzer) loadTermBudget() error {
+	rows, err := a.termBudgetTable.SelectRows(nil, tableDefs["termBudget"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		if err := rows.Scan(&a.maxTerms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMaxTerms limits the number of distinct terms kept in memory.
+// Terms out of the budget are counted approximately and become "*" in phrases.
+// The budget is saved in the data directory. 0 disables it.
+func (a *Analyzer) SetMaxTerms(maxTerms int) error {
+	if maxTerms < 0 {
+		return fmt.Errorf("max terms must not be negative")
+	}
+	if maxTerms == a.maxTerms {
+		return nil
+	}
+	a.maxTerms = maxTerms
+	a.trans.setMaxTerms(maxTerms)
+	return a.saveTermBudget()
+}
@@ -16,10 +16,35 @@ const (
 	cMaxRowID            = int64(9223372036854775806)
 	cLogPerLines         = 1000000
 	cDefaultBuffSize     = 10000
-	cErrorKeywords       = "failure|failed|error|down|crit"
 	cNFilesToCheckCount  = 5
 	cTermCountBorderRate = 0.999
 	cCountbyScoreLen     = 100
+	cStableIDLen         = 10
+	cMaxDecayExponent    = 512  // rebase decayed counts before 2^x overflows
+	cMinDecayedCount     = 0.01 // decayed counts less than this are not saved
+	cSpikeAlpha          = 0.3  // smoothing factor of the EWMA baseline
+	cMinSpikeHistory     = 3    // time units needed before the latest one
+	cMinPeriodicCount    = 4    // time units with the phrase to find its period
+	cPeriodJitter        = 0.25 // intervals within period * this are regular
+	cMinPeriodicRatio    = 0.8  // rate of regular intervals of periodic phrases
+	cNewTermSamples      = 3    // phrases shown with each new term
+	cSketchAccuracy      = 0.01 // relative error of quantiles of values
+	cMinSketchValue      = 1e-9 // values less than this are counted as 0
+	cLowValueQuantile    = 0.001
+	cHighValueQuantile   = 0.999
+	cMinValueSamples     = 30 // values seen before finding outliers
+	cMaxValueUnitLen     = 3  // like ms, KB or %
+	cModelVersion        = 1  // version of the exported model
+	cDataVersion         = 1  // version of the tables in the data directory
+	cMinAdmitCount       = 2  // count of a term out of the budget to track it
+	cTailDepth           = 4  // rows of the sketch of terms out of the budget
+	cMinTailWidth        = 1024
+	cPruneDivisor        = 10   // a tenth of the budget is freed at once
+	cFeedBatchSize       = 1024 // lines parsed by a worker at once
+	cSnapshotVersion     = 2    // version of the snapshot of terms and phrases
+	cSourcesRewriteRate  = 2    // phraseSources is rewritten over the rows of the sources times this
+	cLockFile            = "rarelog.lock"
+	cLockRetryMillisecs  = 100 // interval to try the lock of the data directory again
 
 	cStageElse            = -1
 	cStageRegisterTerms   = 1
@@ -27,4 +52,10 @@ const (
 	cStageRegisterPhrases = 3
 
 	cAsteriskItemID = -1
+
+	// how a word of a message is used in the phrase
+	cWordTerm     = 1 // registered as a term
+	cWordKeyword  = 2 // registered as a term and kept in the phrase
+	cWordAsterisk = 3 // "*"
+	cWordExcluded = 4 // excluded from the phrase
 )
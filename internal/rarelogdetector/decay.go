@@ -0,0 +1,244 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Time-decayed counts.
+// Each count is weighted by 2^((lastUpdate - decayBase) / halfLife),
+// so adding a count does not need to decay all the other counts.
+// The count at an epoch is the weight * 2^((decayBase - epoch) / halfLife).
+// counts and totalCount are replaced by the counts decayed to the latest
+// lastUpdate in applyDecay, and do not depend on the blocks any more.
+
+func (i *items) setHalfLife(halfLife int64) {
+	if halfLife == i.halfLife {
+		return
+	}
+	enabled := i.halfLife > 0
+	i.halfLife = halfLife
+	if halfLife <= 0 {
+		// counts stay decayed until the items are loaded again
+		i.decayedCounts = nil
+		i.decayedTotal = 0
+		return
+	}
+	if !enabled {
+		i.seedDecayedCounts()
+	}
+}
+
+// seedDecayedCounts starts decaying from the current counts
+func (i *items) seedDecayedCounts() {
+	i.decayedCounts = make(map[int]float64, len(i.counts))
+	i.decayedTotal = 0
+	i.decayBase = i.lastUpdate
+	for itemID, cnt := range i.counts {
+		i.addDecayedCount(itemID, cnt, i.lastUpdates[itemID])
+	}
+}
+
+func (i *items) decayFactor(from, to int64) float64 {
+	return math.Pow(2, float64(from-to)/float64(i.halfLife))
+}
+
+func (i *items) addDecayedCount(itemID, addCount int, lastUpdate int64) {
+	if addCount == 0 {
+		return
+	}
+	// lines without timestamps are counted as the latest ones
+	if lastUpdate <= 0 {
+		lastUpdate = i.lastUpdate
+	}
+	if i.decayBase == 0 {
+		i.decayBase = lastUpdate
+	}
+	// avoid overflow of the weights
+	if float64(lastUpdate-i.decayBase)/float64(i.halfLife) > cMaxDecayExponent {
+		i.rebaseDecay(lastUpdate)
+	}
+	w := float64(addCount) * i.decayFactor(lastUpdate, i.decayBase)
+	i.decayedCounts[itemID] += w
+	i.decayedTotal += w
+}
+
+// rebaseDecay changes the weights to the counts at epoch
+func (i *items) rebaseDecay(epoch int64) {
+	f := i.decayFactor(i.decayBase, epoch)
+	for itemID, w := range i.decayedCounts {
+		i.decayedCounts[itemID] = w * f
+	}
+	i.decayedTotal *= f
+	i.decayBase = epoch
+}
+
+// getDecayedCount returns the count decayed to epoch
+func (i *items) getDecayedCount(itemID int, epoch int64) float64 {
+	return i.decayedCounts[itemID] * i.decayFactor(i.decayBase, epoch)
+}
+
+// applyDecay replaces counts with the ones decayed to the latest lastUpdate
+func (i *items) applyDecay() {
+	if i.halfLife <= 0 {
+		return
+	}
+	for itemID := range i.counts {
+		i.counts[itemID] = int(math.Round(i.getDecayedCount(itemID, i.lastUpdate)))
+	}
+	i.totalCount = int(math.Round(i.decayedTotal * i.decayFactor(i.decayBase, i.lastUpdate)))
+}
+
+func (i *items) openDecayTable() error {
+	if i.decayTable != nil || i.DataDir == "" {
+		return nil
+	}
+	dt, err := i.CsvDB.CreateTableIfNotExists("decayedCounts", tableDefs["decayedCounts"], false, 0, 0)
+	if err != nil {
+		return err
+	}
+	i.decayTable = dt
+	return nil
+}
+
+// saveDecayedCounts saves the counts decayed to the latest lastUpdate.
+// Items whose blocks were deleted are also saved with their last values.
+func (i *items) saveDecayedCounts() error {
+	if i.DataDir == "" || i.halfLife <= 0 {
+		return nil
+	}
+	if err := i.openDecayTable(); err != nil {
+		return err
+	}
+	if err := i.decayTable.Truncate(); err != nil {
+		return err
+	}
+	i.rebaseDecay(i.lastUpdate)
+	for itemID, cnt := range i.decayedCounts {
+		if cnt < cMinDecayedCount {
+			continue
+		}
+		if err := i.decayTable.InsertRow(nil,
+			i.getMember(itemID), cnt, i.decayBase,
+			i.createEpochs[itemID], i.lastUpdates[itemID],
+			i.getLastValue(itemID), i.getStableID(itemID)); err != nil {
+			return err
+		}
+	}
+	return i.decayTable.Flush()
+}
+
+// loadDecayedCounts overwrites the weights counted from the blocks
+// with the saved ones. The weights from the blocks are used
+// if nothing has been saved yet.
+func (i *items) loadDecayedCounts() error {
+	if i.DataDir == "" || i.halfLife <= 0 {
+		return nil
+	}
+	if err := i.openDecayTable(); err != nil {
+		return err
+	}
+	rows, err := i.decayTable.SelectRows(nil, tableDefs["decayedCounts"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	loaded := false
+	for rows.Next() {
+		var item, lastValue, stableID string
+		var cnt float64
+		var decayEpoch, createEpoch, lastUpdate int64
+		if err := rows.Scan(&item, &cnt, &decayEpoch,
+			&createEpoch, &lastUpdate, &lastValue, &stableID); err != nil {
+			return err
+		}
+		if !loaded {
+			i.decayedCounts = make(map[int]float64, len(i.counts))
+			i.decayedTotal = 0
+			i.decayBase = decayEpoch
+			loaded = true
+		}
+		itemID := i.getItemID(item)
+		if itemID < 0 {
+			itemID = i.register(item, 0, createEpoch, lastUpdate, lastValue, false)
+			// out of the memory budget
+			if itemID < 0 {
+				continue
+			}
+			if stableID != "" {
+				i.setStableID(itemID, stableID)
+			}
+		}
+		w := cnt * i.decayFactor(decayEpoch, i.decayBase)
+		i.decayedCounts[itemID] += w
+		i.decayedTotal += w
+	}
+	return nil
+}
+
+func (t *trans) setCountHalfLife(halfLife int64) {
+	t.terms.setHalfLife(halfLife)
+	t.phrases.setHalfLife(halfLife)
+}
+
+func (t *trans) applyDecay() {
+	t.terms.applyDecay()
+	t.phrases.applyDecay()
+}
+
+func (a *Analyzer) saveDecay() error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+	return a.decayTable.Upsert(nil, map[string]interface{}{
+		"countHalfLife": a.countHalfLife,
+	})
+}
+
+func (a *Analyzer) loadDecay() error {
+	rows, err := a.decayTable.SelectRows(nil, tableDefs["decay"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		if err := rows.Scan(&a.countHalfLife); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCountHalfLife makes the counts of terms and phrases decay by half
+// in every halfLife instead of dropping when their blocks are deleted.
+// The counts start decaying from the current ones. 0 disables it.
+func (a *Analyzer) SetCountHalfLife(halfLife time.Duration) error {
+	secs := int64(halfLife.Seconds())
+	if secs < 0 {
+		return fmt.Errorf("half life must not be negative")
+	}
+	if secs == a.countHalfLife {
+		return nil
+	}
+	a.countHalfLife = secs
+	a.trans.setCountHalfLife(secs)
+	a.trans.applyDecay()
+	if err := a.trans.calcPhrasesScore(); err != nil {
+		return err
+	}
+	if err := a.saveDecay(); err != nil {
+		return err
+	}
+	if a.readOnly {
+		return nil
+	}
+	if err := a.trans.terms.saveDecayedCounts(); err != nil {
+		return err
+	}
+	return a.trans.phrases.saveDecayedCounts()
+}
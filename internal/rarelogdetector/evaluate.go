@@ -0,0 +1,188 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"os"
+	"strings"
+)
+
+// evaluation of the grouping against labeled log lines
+type evaluation struct {
+	Lines             int
+	Skipped           int
+	Templates         int
+	ExpectedTemplates int
+	GroupingAccuracy  float64
+	Precision         float64
+	Recall            float64
+	F1                float64
+}
+
+type labeledLines struct {
+	contents []string
+	labels   []string
+}
+
+// readLabeledLines reads a CSV file with a header like Loghub "_structured.csv"
+// and returns the raw lines in contentCol and the ground truth in labelCol
+func readLabeledLines(path, contentCol, labelCol string) (*labeledLines, error) {
+	if contentCol == "" {
+		contentCol = "Content"
+	}
+	if labelCol == "" {
+		labelCol = "EventId"
+	}
+	header, records, err := utils.ReadCsv(path)
+	if err != nil {
+		return nil, err
+	}
+	contentIdx := -1
+	labelIdx := -1
+	for i, col := range header {
+		switch col {
+		case contentCol:
+			contentIdx = i
+		case labelCol:
+			labelIdx = i
+		}
+	}
+	if contentIdx < 0 || labelIdx < 0 {
+		return nil, fmt.Errorf("%s must have columns %s and %s", path, contentCol, labelCol)
+	}
+
+	l := new(labeledLines)
+	l.contents = make([]string, 0, len(records))
+	l.labels = make([]string, 0, len(records))
+	for _, record := range records {
+		if len(record) <= contentIdx || len(record) <= labelIdx {
+			continue
+		}
+		l.contents = append(l.contents, record[contentIdx])
+		l.labels = append(l.labels, record[labelIdx])
+	}
+	return l, nil
+}
+
+func pairCount(n int) int {
+	return n * (n - 1) / 2
+}
+
+// evaluateGrouping compares the groups predicted by the analyzer with labels.
+// Lines with a negative predicted group are not considered.
+//
+// GroupingAccuracy is the rate of lines whose predicted group has exactly
+// the same lines as their labeled group.
+// Precision, Recall and F1 are calculated on pairs of lines in the same group.
+func evaluateGrouping(predicted []int, labels []string) *evaluation {
+	e := new(evaluation)
+	predSizes := make(map[int]int)
+	labelSizes := make(map[string]int)
+	// number of lines for each predicted group and label pair
+	pairSizes := make(map[int]map[string]int)
+	for i, p := range predicted {
+		if p < 0 {
+			e.Skipped++
+			continue
+		}
+		e.Lines++
+		predSizes[p]++
+		labelSizes[labels[i]]++
+		if _, ok := pairSizes[p]; !ok {
+			pairSizes[p] = make(map[string]int)
+		}
+		pairSizes[p][labels[i]]++
+	}
+	e.Templates = len(predSizes)
+	e.ExpectedTemplates = len(labelSizes)
+	if e.Lines == 0 {
+		return e
+	}
+
+	correct := 0
+	truePairs := 0
+	for p, byLabel := range pairSizes {
+		for label, n := range byLabel {
+			truePairs += pairCount(n)
+			if len(byLabel) == 1 && labelSizes[label] == predSizes[p] {
+				correct += n
+			}
+		}
+	}
+	predPairs := 0
+	for _, n := range predSizes {
+		predPairs += pairCount(n)
+	}
+	labelPairs := 0
+	for _, n := range labelSizes {
+		labelPairs += pairCount(n)
+	}
+
+	e.GroupingAccuracy = float64(correct) / float64(e.Lines)
+	if predPairs > 0 {
+		e.Precision = float64(truePairs) / float64(predPairs)
+	} else {
+		e.Precision = 1
+	}
+	if labelPairs > 0 {
+		e.Recall = float64(truePairs) / float64(labelPairs)
+	} else {
+		e.Recall = 1
+	}
+	if e.Precision+e.Recall > 0 {
+		e.F1 = 2 * e.Precision * e.Recall / (e.Precision + e.Recall)
+	}
+	return e
+}
+
+// groupLines returns the phrase ID of each line with the current phrases.
+// Lines filtered out get -1.
+func (t *trans) groupLines(lines []string, minMatchRate, maxMatchRate float64) ([]int, error) {
+	predicted := make([]int, len(lines))
+	for i, line := range lines {
+		_, _, phrasestr, err := t.tokenizeLine(line, 0, 0, cStageElse,
+			minMatchRate, maxMatchRate, true)
+		if err != nil {
+			return nil, err
+		}
+		predicted[i] = t.phrases.getItemID(phrasestr)
+	}
+	return predicted, nil
+}
+
+func (e *evaluation) show() {
+	fmt.Printf("lines: %d\n", e.Lines)
+	if e.Skipped > 0 {
+		fmt.Printf("skipped lines: %d\n", e.Skipped)
+	}
+	fmt.Printf("templates: %d\n", e.Templates)
+	fmt.Printf("expected templates: %d\n", e.ExpectedTemplates)
+	fmt.Printf("grouping accuracy: %f\n", e.GroupingAccuracy)
+	fmt.Printf("precision: %f\n", e.Precision)
+	fmt.Printf("recall: %f\n", e.Recall)
+	fmt.Printf("f1: %f\n", e.F1)
+}
+
+// writeTempLog writes lines to a temporary file so that they can be read
+// through the file pointer. The returned function removes the file.
+func writeTempLog(lines []string) (string, func(), error) {
+	f, err := os.CreateTemp("", "rarelog-eval-*.log")
+	if err != nil {
+		return "", nil, err
+	}
+	path := f.Name()
+	f.Close()
+	if err := utils.Slice2File(lines, path); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+	return path, func() { os.Remove(path) }, nil
+}
+
+func escapeNewlines(lines []string) []string {
+	res := make([]string, len(lines))
+	for i, line := range lines {
+		res[i] = strings.ReplaceAll(line, "\n", " ")
+	}
+	return res
+}
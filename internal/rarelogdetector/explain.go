@@ -0,0 +1,204 @@
+package rarelogdetector
+
+import (
+	"fmt"
+)
+
+// reasons why a word does not appear as it is in the phrase
+const (
+	cReasonIgnoreword      = "ignoreword"
+	cReasonStopword        = "stopword"
+	cReasonDigits          = "number longer than 3 digits"
+	cReasonShort           = "shorter than 3 letters"
+	cReasonTermCountBorder = "count < termCountBorder"
+	cReasonMinCnt          = "count < minCnt"
+	cReasonOutOfBudget     = "out of the memory budget of terms"
+)
+
+// one word of the line and what happened to it
+type explainedWord struct {
+	Word     string
+	Term     string
+	TermID   int
+	Count    int
+	Keyword  bool
+	Excluded bool
+	Asterisk bool
+	Reason   string
+}
+
+// one node of the phrase tree walked by searchPt
+type ptStep struct {
+	Term  string
+	Count int
+}
+
+// explanation of how a line was grouped into a phrase
+type explanation struct {
+	Filtered        bool
+	Message         string
+	Words           []explainedWord
+	SortedTerms     []string
+	SortedCounts    []int
+	Path            []ptStep
+	Pos             int
+	MinLen          int
+	MaxLen          int
+	MinCnt          int
+	TermCountBorder int
+	CustomPhrase    string
+	Fallback        string
+	Phrase          string
+	PhraseCount     int
+}
+
+// explainWords splits the message with splitTerms and tells why each word
+// was replaced by "*" or excluded. The terms are looked up without registering them.
+func (t *trans) explainWords(message string) []explainedWord {
+	split := t.splitTerms(message)
+	words := make([]explainedWord, len(split))
+	for i, tw := range split {
+		ew := explainedWord{Word: tw.orig, TermID: cAsteriskItemID, Reason: tw.reason}
+		switch tw.kind {
+		case cWordTerm, cWordKeyword:
+			ew.Keyword = tw.kind == cWordKeyword
+			ew.Term = tw.word
+			ew.TermID = t.terms.getItemID(tw.word)
+			ew.Count = t.terms.getCount(ew.TermID)
+			if ew.TermID < 0 && t.terms.maxItems > 0 {
+				ew.Count = t.terms.getTailCount(tw.word)
+				ew.Asterisk = true
+				ew.Reason = cReasonOutOfBudget
+			}
+		case cWordAsterisk:
+			ew.Term = tw.word
+			ew.Asterisk = true
+		default:
+			ew.Excluded = true
+		}
+		words[i] = ew
+	}
+	return words
+}
+
+// walkPt returns the nodes of the phrase tree along sortedTerms
+func (t *trans) walkPt(sortedTerms []int) []ptStep {
+	path := make([]ptStep, 0)
+	pt := t.pt
+	for _, termID := range sortedTerms {
+		child, ok := pt.childNodes[termID]
+		if !ok {
+			break
+		}
+		path = append(path, ptStep{Term: t.terms.getMember(termID), Count: child.count})
+		pt = child
+	}
+	return path
+}
+
+// explainLine groups a line in the same way as tokenizeLine in cStageElse
+// and records each decision made on the way.
+func (t *trans) explainLine(line string, minMatchRate, maxMatchRate float64) (*explanation, error) {
+	e := new(explanation)
+	if !t.match(line) {
+		e.Filtered = true
+		return e, nil
+	}
+	phraseCnt, tokens, phrasestr, err := t.tokenizeLine(line, 0, 0, cStageElse,
+		minMatchRate, maxMatchRate, true)
+	if err != nil {
+		return nil, err
+	}
+	e.Message = t.lastMessage
+	e.Phrase = phrasestr
+	e.PhraseCount = phraseCnt
+	e.TermCountBorder = t.termCountBorder
+	e.Words = t.explainWords(e.Message)
+
+	sortedTerms, sortedCounts := t.sortTokensByCount(tokens)
+	e.SortedTerms = make([]string, len(sortedTerms))
+	for i, termID := range sortedTerms {
+		e.SortedTerms[i] = t.terms.getMember(termID)
+	}
+	e.SortedCounts = sortedCounts
+
+	d := t.decidePhrase(tokens, minMatchRate, maxMatchRate, true, make(map[string]string))
+	if d.customID > 0 {
+		e.CustomPhrase = t.customPhrases.getMember(d.customID)
+		return e, nil
+	}
+	e.MinLen, e.MaxLen, e.MinCnt, e.Pos = d.minLen, d.maxLen, d.minCnt, d.pos
+	e.Path = t.walkPt(sortedTerms)
+	e.Fallback = d.fallback
+
+	// the tokens are the words which are not excluded
+	n := 0
+	for i := range e.Words {
+		if e.Words[i].Excluded {
+			continue
+		}
+		if n < len(d.reasons) && d.reasons[n] != "" {
+			e.Words[i].Asterisk = true
+			e.Words[i].Reason = d.reasons[n]
+		}
+		n++
+	}
+	return e, nil
+}
+
+func (e *explanation) show() {
+	if e.Filtered {
+		fmt.Println("the line is filtered out by -s or -x")
+		return
+	}
+	fmt.Printf("message: %s\n", e.Message)
+	fmt.Printf("phrase: %s\n", e.Phrase)
+	fmt.Printf("phrase count: %d\n", e.PhraseCount)
+	fmt.Printf("termCountBorder: %d\n", e.TermCountBorder)
+	if e.CustomPhrase != "" {
+		fmt.Printf("custom phrase matched: %s\n", e.CustomPhrase)
+	} else {
+		fmt.Println("custom phrase matched: none")
+		fmt.Printf("minLen: %d\n", e.MinLen)
+		fmt.Printf("maxLen: %d\n", e.MaxLen)
+		fmt.Printf("minCnt: %d\n", e.MinCnt)
+	}
+
+	fmt.Println("\nsorted tokens:")
+	for i, term := range e.SortedTerms {
+		fmt.Printf("  %s: %d\n", term, e.SortedCounts[i])
+	}
+
+	if e.CustomPhrase == "" {
+		fmt.Println("\nphrase tree path:")
+		for i, step := range e.Path {
+			used := ""
+			if e.Pos >= 0 && i >= e.Pos {
+				used = " (not used)"
+			}
+			fmt.Printf("  %s: %d%s\n", step.Term, step.Count, used)
+		}
+		if e.Pos >= 0 {
+			fmt.Printf("  searchPt stopped at position %d\n", e.Pos)
+		}
+		if e.Fallback != "" {
+			fmt.Printf("  %s, so the tokens are used as they are\n", e.Fallback)
+		}
+	}
+
+	fmt.Println("\nwords:")
+	for _, ew := range e.Words {
+		switch {
+		case ew.Excluded:
+			fmt.Printf("  %s: excluded (%s)\n", ew.Word, ew.Reason)
+		case ew.Asterisk && ew.Reason != "":
+			fmt.Printf("  %s: * (%s)\n", ew.Word, ew.Reason)
+		case ew.Asterisk:
+			fmt.Printf("  %s: *\n", ew.Word)
+		case ew.Keyword:
+			fmt.Printf("  %s: %s %d (keyword)\n", ew.Word, ew.Term, ew.Count)
+		default:
+			fmt.Printf("  %s: %s %d\n", ew.Word, ew.Term, ew.Count)
+		}
+	}
+}
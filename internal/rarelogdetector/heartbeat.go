@@ -0,0 +1,107 @@
+package rarelogdetector
+
+import (
+	"math"
+	"sort"
+)
+
+// a periodic phrase whose next occurrence has not arrived
+type missingPhrase struct {
+	phraseID int
+	PhraseID string
+	Period   int64 // seconds
+	LastSeen int64
+	Overdue  int64 // seconds after the expected time
+	Text     string
+}
+
+// periodOf returns the period of the series in time units
+// if the phrase appears at regular intervals
+func periodOf(series []float64) (int, bool) {
+	positions := make([]int, 0)
+	for i, x := range series {
+		if x > 0 {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < cMinPeriodicCount {
+		return 0, false
+	}
+	gaps := make([]int, len(positions)-1)
+	for i := range gaps {
+		gaps[i] = positions[i+1] - positions[i]
+	}
+	sorted := make([]int, len(gaps))
+	copy(sorted, gaps)
+	sort.Ints(sorted)
+	period := sorted[len(sorted)/2]
+
+	jitter := float64(period) * cPeriodJitter
+	regular := 0
+	for _, gap := range gaps {
+		if math.Abs(float64(gap-period)) <= jitter {
+			regular++
+		}
+	}
+	if float64(regular)/float64(len(gaps)) < cMinPeriodicRatio {
+		return 0, false
+	}
+	return period, true
+}
+
+// detectMissing finds periodic phrases from the counts by time unit and
+// reports the ones not seen for period * (1 + tolerance) until the latest log.
+func (t *trans) detectMissing(termCountBorderRate float64, termCountBorder int,
+	minMatchRate, maxMatchRate float64,
+	tolerance float64) ([]missingPhrase, error) {
+	if err := t.rearangePhrases(termCountBorderRate, termCountBorder,
+		minMatchRate, maxMatchRate); err != nil {
+		return nil, err
+	}
+
+	phraseRanks := t.phrases.biggestNItems(0)
+	rankMap := make(map[int]int)
+	for _, phraseID := range phraseRanks {
+		rankMap[phraseID] = t.phrases.getCount(phraseID)
+	}
+	h, err := t.getPhraseHistory(rankMap)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, nil
+	}
+
+	acked := t.ackedPhrases(t.latestUpdate)
+	res := make([]missingPhrase, 0)
+	for _, phraseID := range phraseRanks {
+		text := t.phrases.getMember(phraseID)
+		if !t.match(text) || acked[phraseID] {
+			continue
+		}
+		period, ok := periodOf(h.series(phraseID))
+		if !ok {
+			continue
+		}
+		periodSecs := int64(period) * h.unitsecs
+		lastSeen := t.phrases.getLastUpdate(phraseID)
+		expected := lastSeen + periodSecs
+		if t.latestUpdate <= expected+int64(float64(periodSecs)*tolerance) {
+			continue
+		}
+		res = append(res, missingPhrase{
+			phraseID: phraseID,
+			PhraseID: t.phrases.getStableID(phraseID),
+			Period:   periodSecs,
+			LastSeen: lastSeen,
+			Overdue:  t.latestUpdate - expected,
+			Text:     text,
+		})
+	}
+	// the most overdue relative to its period first
+	sort.Slice(res, func(i, j int) bool {
+		return float64(res[i].Overdue)/float64(res[i].Period) >
+			float64(res[j].Overdue)/float64(res[j].Period)
+	})
+	return res, nil
+}
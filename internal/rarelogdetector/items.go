@@ -1,6 +1,8 @@
 package rarelogdetector
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"math"
 	"sort"
 
@@ -12,6 +14,8 @@ import (
 type items struct {
 	*csvdb.CircuitDB
 	name             string
+	columns          []string
+	withStableIDs    bool // only the phrases are identified by the stable IDs
 	maxItemID        int
 	members          map[string]int
 	memberMap        map[int]string
@@ -21,18 +25,38 @@ type items struct {
 	lastUpdate       int64
 	lastValues       map[int]string
 	tokensMap        map[int][]int
+	stableIDs        map[int]string
+	stableIDMembers  map[string]int
 	currCounts       map[int]int
+	commitCounts     map[int]int // currCounts written to the current block
 	currUpdates      map[int]int64
 	currCreateEpochs map[int]int64
 	currItemCount    int
 	totalCount       int
+	halfLife         int64
+	decayBase        int64
+	decayedCounts    map[int]float64
+	decayedTotal     float64
+	decayTable       *csvdb.Table
+	maxItems         int
+	tail             *countMinSketch
+	pinned           map[string]bool
+	snapshot         *itemsSnapshot
+	blocks           map[int]int64 // lastIndex by the blocks counted in memory
+	staleBlocks      bool          // some blocks counted were deleted
+	replayedBlocks   int           // blocks loaded after the snapshot. -1 without it
 }
 
 func newItems(dataDir, name string, maxBlocks int,
 	retention int64, frequency string, useGzip bool) (*items, error) {
 	i := new(items)
+	i.withStableIDs = hasStableIDs(name)
+	i.columns = tableDefs["terms"]
+	if i.withStableIDs {
+		i.columns = tableDefs["items"]
+	}
 	// Now: maxRowsInBlock=0 TODO: support rotation and change this
-	d, err := csvdb.NewCircuitDB(dataDir, name, tableDefs["items"], maxBlocks, 0, retention, frequency, useGzip)
+	d, err := csvdb.NewCircuitDB(dataDir, name, i.columns, maxBlocks, 0, retention, frequency, useGzip)
 	if err != nil {
 		return nil, err
 	}
@@ -42,23 +66,40 @@ func newItems(dataDir, name string, maxBlocks int,
 	i.counts = make(map[int]int, 10000)
 	i.members = make(map[string]int, 10000)
 	i.currCounts = make(map[int]int, 10000)
+	i.commitCounts = make(map[int]int, 10000)
 	i.lastUpdates = make(map[int]int64, 10000)
 	i.createEpochs = make(map[int]int64, 10000)
 	i.currUpdates = make(map[int]int64, 10000)
 	i.currCreateEpochs = make(map[int]int64, 10000)
 	i.lastValues = make(map[int]string, 10000)
 	i.tokensMap = make(map[int][]int, 0)
+	i.stableIDs = make(map[int]string, 10000)
+	i.stableIDMembers = make(map[string]int, 10000)
 	i.maxItemID = 0
+	i.replayedBlocks = -1
 
 	return i, nil
 }
 
+// hasStableIDs tells if the items are phrases
+func hasStableIDs(name string) bool {
+	switch name {
+	case "phrases", "customPhrases", "rearranged_phrase":
+		return true
+	}
+	return false
+}
+
 func (i *items) load() error {
 	if i.DataDir != "" {
 		if err := i.loadDB(); err != nil {
 			return err
 		}
+		if err := i.loadDecayedCounts(); err != nil {
+			return err
+		}
 	}
+	i.applyDecay()
 	return nil
 }
 
@@ -69,11 +110,20 @@ func (i *items) register(item string, addCount int,
 		return -1
 	}
 	itemID, ok := i.members[item]
+	extra := 0
+	if !ok && i.maxItems > 0 && len(i.members) >= i.maxItems {
+		// out of the memory budget
+		var admitted bool
+		if extra, admitted = i.admit(item, addCount); !admitted {
+			return -1
+		}
+	}
 	if ok {
 		if lastUpdate > i.lastUpdates[itemID] {
 			i.lastUpdates[itemID] = lastUpdate
 		}
-		if createEpoch < i.createEpochs[itemID] {
+		// createEpoch=0 is for items looked up without timestamps
+		if createEpoch > 0 && (createEpoch < i.createEpochs[itemID] || i.createEpochs[itemID] == 0) {
 			i.createEpochs[itemID] = createEpoch
 		}
 
@@ -84,6 +134,9 @@ func (i *items) register(item string, addCount int,
 		i.memberMap[itemID] = item
 		i.lastUpdates[itemID] = lastUpdate
 		i.createEpochs[itemID] = createEpoch
+		if i.withStableIDs {
+			i.setStableID(itemID, newStableID(item))
+		}
 
 		if isNew {
 			i.currItemCount++
@@ -114,6 +167,9 @@ func (i *items) register(item string, addCount int,
 	} else {
 		i.counts[itemID] += addCount
 	}
+	if i.halfLife > 0 {
+		i.addDecayedCount(itemID, addCount, lastUpdate)
+	}
 
 	i.lastValues[itemID] = lastValue
 
@@ -125,12 +181,21 @@ func (i *items) register(item string, addCount int,
 		}
 	}
 	i.totalCount += addCount
+	if extra > 0 {
+		i.counts[itemID] += extra
+		if isNew {
+			i.currCounts[itemID] += extra
+		}
+	}
 	return itemID
 }
 
 func (i *items) update(itemID int, addCount int, lastUpdate int64, lastValue string, isNew bool) {
 	var createEpoch int64
 	i.counts[itemID] += addCount
+	if i.halfLife > 0 {
+		i.addDecayedCount(itemID, addCount, lastUpdate)
+	}
 	i.lastUpdates[itemID] = lastUpdate
 	if lastUpdate < i.createEpochs[itemID] {
 		createEpoch = lastUpdate
@@ -151,6 +216,36 @@ func (i *items) getMember(itemID int) string {
 	return i.memberMap[itemID]
 }
 
+// newStableID returns a short hash of the item, so that the same phrase
+// gets the same ID regardless of the order of registration or the machine
+func newStableID(item string) string {
+	sum := sha1.Sum([]byte(item))
+	return hex.EncodeToString(sum[:])[:cStableIDLen]
+}
+
+func (i *items) setStableID(itemID int, stableID string) {
+	if old, ok := i.stableIDs[itemID]; ok {
+		delete(i.stableIDMembers, old)
+	}
+	i.stableIDs[itemID] = stableID
+	i.stableIDMembers[stableID] = itemID
+}
+
+func (i *items) getStableID(itemID int) string {
+	if itemID < 0 {
+		return ""
+	}
+	return i.stableIDs[itemID]
+}
+
+func (i *items) getItemIDByStableID(stableID string) int {
+	itemID, ok := i.stableIDMembers[stableID]
+	if !ok {
+		return -1
+	}
+	return itemID
+}
+
 func (i *items) getCreateEpoch(itemID int) int64 {
 	if itemID < 0 {
 		return 0
@@ -173,6 +268,14 @@ func (i *items) getLastValue(itemID int) string {
 }
 
 func (i *items) getIdf(itemID int) float64 {
+	if i.halfLife > 0 {
+		// the decay factors of the count and the total cancel out
+		w := i.decayedCounts[itemID]
+		if w == 0 || i.decayedTotal == 0 {
+			return 0
+		}
+		return math.Log(i.decayedTotal/w) + 1
+	}
 	if i.totalCount == 0 {
 		return 0
 	}
@@ -198,6 +301,7 @@ func (i *items) getItemID(term string) int {
 
 func (i *items) clearCurrCount() {
 	i.currCounts = make(map[int]int, 10000)
+	i.commitCounts = make(map[int]int, 10000)
 	i.currUpdates = make(map[int]int64, 10000)
 	i.currCreateEpochs = make(map[int]int64, 10000)
 	i.currItemCount = 0
@@ -207,16 +311,36 @@ func (i *items) loadDB() error {
 	if i.DataDir == "" {
 		return nil
 	}
+	if err := i.LoadCircuitDBStatus(); err != nil {
+		return err
+	}
 	cnt := i.CountFromStatusTable(nil)
 	if cnt <= 0 {
 		return nil
 	}
 
-	if err := i.LoadCircuitDBStatus(); err != nil {
+	loaded, err := i.loadSnapshot()
+	if err != nil {
 		return err
 	}
+	if !loaded {
+		if err := i.registerBlocks(nil); err != nil {
+			return err
+		}
+		if err := i.trackBlocks(); err != nil {
+			return err
+		}
+	}
+	// the rows of the current block are already written
+	for itemID, cnt := range i.currCounts {
+		i.commitCounts[itemID] = cnt
+	}
+	return nil
+}
 
-	rows, err := i.SelectRows(nil, nil, tableDefs["items"])
+// registerBlocks registers the rows of the blocks. nil for all the blocks.
+func (i *items) registerBlocks(blockNos []int) error {
+	rows, err := i.SelectRows(nil, blockNos, i.columns)
 	if err != nil {
 		return err
 	}
@@ -225,20 +349,40 @@ func (i *items) loadDB() error {
 	}
 
 	for rows.Next() {
-		var item string
-		var itemCount int
-		var createEpoch int64
-		var lastUpdate int64
-		var lastValue string
-		err = rows.Scan(&itemCount, &createEpoch, &lastUpdate, &item, &lastValue)
+		r, err := i.scanRow(rows)
 		if err != nil {
 			return err
 		}
-		i.register(item, itemCount, createEpoch, lastUpdate, lastValue, !rows.BlockCompleted)
+		itemID := i.register(r.item, r.count, r.createEpoch, r.lastUpdate, r.lastValue, !rows.BlockCompleted)
+		// data saved by older versions do not have stableID
+		if r.stableID != "" && itemID >= 0 {
+			i.setStableID(itemID, r.stableID)
+		}
 	}
 	return nil
 }
 
+// itemRow is a row of the blocks
+type itemRow struct {
+	count       int
+	createEpoch int64
+	lastUpdate  int64
+	item        string
+	lastValue   string
+	stableID    string
+}
+
+// scanRow reads a row of the blocks. The terms do not have stableID.
+func (i *items) scanRow(rows interface{ Scan(...interface{}) error }) (itemRow, error) {
+	var r itemRow
+	args := []interface{}{&r.count, &r.createEpoch, &r.lastUpdate, &r.item, &r.lastValue}
+	if i.withStableIDs {
+		args = append(args, &r.stableID)
+	}
+	err := rows.Scan(args...)
+	return r, err
+}
+
 // expected to be called from trans.go
 func (i *items) next() error {
 	//i.RowNo++
@@ -248,10 +392,13 @@ func (i *items) next() error {
 
 	i.clearCurrCount()
 	i.NextBlock(i.lastUpdate)
+	if err := i.trackCurrentBlock(); err != nil {
+		return err
+	}
 
 	// in case the block table already exists and will be overrided
 	// we subtract counts in the block table from total item counts
-	rows, err := i.SelectFromCurrentTable(nil, tableDefs["items"])
+	rows, err := i.SelectFromCurrentTable(nil, i.columns)
 	if err != nil {
 		return err
 	}
@@ -260,17 +407,20 @@ func (i *items) next() error {
 	}
 
 	for rows.Next() {
-		var item string
-		var itemCount int
-		var createEpoch int64
-		var lastUpdate int64
-		var lastValue string
-		err = rows.Scan(&itemCount, &createEpoch, &lastUpdate, &item, &lastValue)
+		r, err := i.scanRow(rows)
 		if err != nil {
 			return err
 		}
-		itemID := i.getItemID(item)
-		i.counts[itemID] -= itemCount
+		itemCount, createEpoch, lastUpdate := r.count, r.createEpoch, r.lastUpdate
+		itemID := i.getItemID(r.item)
+		// out of the memory budget
+		if itemID < 0 {
+			continue
+		}
+		// decayed counts do not depend on the blocks
+		if i.halfLife <= 0 {
+			i.counts[itemID] -= itemCount
+		}
 		i.currCreateEpochs[itemID] = createEpoch
 		i.currUpdates[itemID] = lastUpdate
 		if lastUpdate > i.lastUpdates[itemID] {
@@ -279,7 +429,7 @@ func (i *items) next() error {
 		if createEpoch > 0 && createEpoch < i.createEpochs[itemID] {
 			i.createEpochs[itemID] = createEpoch
 		}
-		i.lastValues[itemID] = lastValue
+		i.lastValues[itemID] = r.lastValue
 	}
 
 	return nil
@@ -295,6 +445,9 @@ func (i *items) commit(completed bool) error {
 	if err := i.UpdateBlockStatus(completed); err != nil {
 		return err
 	}
+	if err := i.saveDecayedCounts(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -302,7 +455,10 @@ func (i *items) flush() error {
 	if i.DataDir == "" {
 		return nil
 	}
-	for itemID, cnt := range i.currCounts {
+	// only the counts added after the last flush are appended
+	// and the rows of an item are summed up when loaded
+	for itemID, currCount := range i.currCounts {
+		cnt := currCount - i.commitCounts[itemID]
 		if cnt <= 0 {
 			continue
 		}
@@ -310,12 +466,16 @@ func (i *items) flush() error {
 		createEpoch := i.currCreateEpochs[itemID]
 		lastUpdate := i.currUpdates[itemID]
 		lastValue := i.getLastValue(itemID)
-		if err := i.InsertRow(tableDefs["items"],
-			cnt, createEpoch, lastUpdate, member, lastValue); err != nil {
+		row := []interface{}{cnt, createEpoch, lastUpdate, member, lastValue}
+		if i.withStableIDs {
+			row = append(row, i.getStableID(itemID))
+		}
+		if err := i.InsertRow(i.columns, row...); err != nil {
 			return err
 		}
+		i.commitCounts[itemID] = currCount
 	}
-	if err := i.FlushOverwriteCurrentTable(); err != nil {
+	if err := i.FlushCurrentTable(); err != nil {
 		return errors.WithStack(err)
 	}
 	return nil
@@ -324,6 +484,8 @@ func (i *items) flush() error {
 func (i *items) DeepCopy() *items {
 	copyItems := &items{
 		name:             i.name,
+		columns:          i.columns,
+		withStableIDs:    i.withStableIDs,
 		maxItemID:        i.maxItemID,
 		members:          make(map[string]int),
 		memberMap:        make(map[int]string),
@@ -332,10 +494,18 @@ func (i *items) DeepCopy() *items {
 		lastUpdates:      make(map[int]int64),
 		lastValues:       make(map[int]string),
 		currCounts:       make(map[int]int),
+		commitCounts:     make(map[int]int),
 		currItemCount:    i.currItemCount,
 		currUpdates:      make(map[int]int64),
 		currCreateEpochs: make(map[int]int64),
+		stableIDs:        make(map[int]string),
+		stableIDMembers:  make(map[string]int),
 		totalCount:       i.totalCount,
+		halfLife:         i.halfLife,
+		decayBase:        i.decayBase,
+		decayedTotal:     i.decayedTotal,
+		maxItems:         i.maxItems,
+		tail:             i.tail.clone(),
 	}
 
 	for k, v := range i.members {
@@ -374,6 +544,29 @@ func (i *items) DeepCopy() *items {
 		copyItems.currCounts[k] = v
 	}
 
+	for k, v := range i.commitCounts {
+		copyItems.commitCounts[k] = v
+	}
+
+	if i.pinned != nil {
+		copyItems.pinned = make(map[string]bool, len(i.pinned))
+		for k, v := range i.pinned {
+			copyItems.pinned[k] = v
+		}
+	}
+
+	for k, v := range i.stableIDs {
+		copyItems.stableIDs[k] = v
+		copyItems.stableIDMembers[v] = k
+	}
+
+	if i.decayedCounts != nil {
+		copyItems.decayedCounts = make(map[int]float64, len(i.decayedCounts))
+		for k, v := range i.decayedCounts {
+			copyItems.decayedCounts[k] = v
+		}
+	}
+
 	return copyItems
 }
 
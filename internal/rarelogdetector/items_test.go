@@ -357,8 +357,9 @@ func Test_Items(t *testing.T) {
 		return
 	}
 
+	// 5 rows loaded and 8 rows of the counts added
 	if err := checkCircuitDBStatus(it, 1,
-		[]interface{}{4, "BLK0000000001", 8, true}); err != nil {
+		[]interface{}{4, "BLK0000000001", 13, true}); err != nil {
 		t.Errorf("%v", err)
 		return
 	}
@@ -545,4 +546,19 @@ func Test_ItemsFuncs(t *testing.T) {
 		return
 	}
 
+	// the copy does not share the sketch and the pinned items
+	its.pin("com01")
+	its.setMaxItems(5)
+	tailCount := its.getTailCount("unq01")
+	copied := its.DeepCopy()
+	copied.pin("unq01")
+	copied.tail.add("unq01", 10)
+	if err := utils.GetGotExpErr("tail count of the original", its.getTailCount("unq01"), tailCount); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if its.pinned["unq01"] {
+		t.Errorf("the item pinned in the copy is pinned in the original")
+		return
+	}
 }
@@ -0,0 +1,196 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The data directory is locked with an advisory lock of the lock file in it,
+// so that rarelog processes do not write the tables at the same time.
+// A process writing the data directory holds an exclusive lock and
+// a process only reading it holds a shared lock.
+// The lock is released by the OS when the process stops.
+// The analyzers of a process share one lock of the data directory
+// as a record lock on unix belongs to the process.
+// The lock of the file is implemented by lock_unix.go and lock_windows.go.
+
+type dataDirLock struct {
+	f       *os.File
+	readers int
+	writers int
+}
+
+var (
+	dataDirLocks   = make(map[string]*dataDirLock)
+	dataDirLocksMu sync.Mutex
+	lockTimeout    time.Duration
+)
+
+// SetLockTimeout sets how long to wait for the lock of the data directory
+// held by another process. 0 does not wait and a negative value waits forever.
+func SetLockTimeout(timeout time.Duration) {
+	dataDirLocksMu.Lock()
+	defer dataDirLocksMu.Unlock()
+	lockTimeout = timeout
+}
+
+// lockDataDir locks the data directory and returns the function to unlock it.
+// The lock is tried without waiting under dataDirLocksMu and the retries
+// sleep without it, so a waiting analyzer does not block the others.
+func lockDataDir(dataDir string, exclusive bool) (func(), error) {
+	key, err := filepath.Abs(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dataDirLocksMu.Lock()
+	timeout := lockTimeout
+	dataDirLocksMu.Unlock()
+
+	start := time.Now()
+	for {
+		unlock, held, err := tryLockDataDir(key, dataDir, exclusive)
+		if err != nil || unlock != nil {
+			return unlock, err
+		}
+		if timeout >= 0 && time.Since(start) >= timeout {
+			if timeout > 0 {
+				return nil, fmt.Errorf("%w after waiting %v", held, timeout)
+			}
+			return nil, held
+		}
+		time.Sleep(cLockRetryMillisecs * time.Millisecond)
+	}
+}
+
+// tryLockDataDir returns the unlock function if locked.
+// Otherwise it returns the error naming the process holding the lock.
+// The file is locked under dataDirLocksMu because closing another descriptor
+// of the lock file would release the lock of the process on unix.
+func tryLockDataDir(key, dataDir string, exclusive bool) (func(), error, error) {
+	dataDirLocksMu.Lock()
+	defer dataDirLocksMu.Unlock()
+
+	l, ok := dataDirLocks[key]
+	if !ok {
+		f, err := openLockFile(key, exclusive)
+		if err != nil {
+			return nil, nil, err
+		}
+		// read without the lock
+		if f == nil {
+			return func() {}, nil, nil
+		}
+		locked, err := tryLockFile(f, exclusive)
+		if err != nil || !locked {
+			held := lockedError(f, dataDir, exclusive)
+			f.Close()
+			return nil, held, err
+		}
+		l = &dataDirLock{f: f}
+		dataDirLocks[key] = l
+	} else if exclusive && l.writers == 0 {
+		locked, err := tryLockFile(l.f, true)
+		if err != nil || !locked {
+			return nil, lockedError(l.f, dataDir, true), err
+		}
+	}
+
+	if exclusive {
+		l.writers++
+	} else {
+		l.readers++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unlockDataDir(key, exclusive)
+		})
+	}, nil, nil
+}
+
+func unlockDataDir(key string, exclusive bool) {
+	dataDirLocksMu.Lock()
+	defer dataDirLocksMu.Unlock()
+
+	l, ok := dataDirLocks[key]
+	if !ok {
+		return
+	}
+	if exclusive {
+		l.writers--
+	} else {
+		l.readers--
+	}
+	if l.writers <= 0 && l.readers <= 0 {
+		// closing the file releases the lock
+		l.f.Close()
+		delete(dataDirLocks, key)
+		return
+	}
+	if exclusive && l.writers <= 0 {
+		if err := downgradeLockFile(l.f); err != nil {
+			logrus.Warnf("failed to release the write lock of %s: %v", key, err)
+		}
+	}
+}
+
+// openLockFile returns nil without an error if the data directory is read
+// without the lock. Readers never create the lock file, so that reading
+// does not change the data directory.
+func openLockFile(dataDir string, exclusive bool) (*os.File, error) {
+	path := fmt.Sprintf("%s/%s", dataDir, cLockFile)
+	if exclusive {
+		if err := utils.EnsureDir(dataDir); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if !utils.PathExist(path) {
+		return nil, nil
+	}
+	// writable for a writer of the process to turn the lock into an exclusive one
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		// the data directory may be read by a user who cannot read the lock file
+		logrus.Warnf("reading %s without the lock: %v", dataDir, err)
+		return nil, nil
+	}
+	return f, nil
+}
+
+// lockedError names the process holding the lock if known
+func lockedError(f *os.File, dataDir string, exclusive bool) error {
+	pid, writing := lockHolder(f, exclusive)
+	if pid <= 0 {
+		return fmt.Errorf("the data directory %s is locked by another process", dataDir)
+	}
+	usage := "read"
+	if writing {
+		usage = "written"
+	}
+	return fmt.Errorf("the data directory %s is being %s by the process with PID %d",
+		dataDir, usage, pid)
+}
+
+// dataDirExists tells if the data directory has more than the lock file
+func dataDirExists(dataDir string) bool {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Name() != cLockFile {
+			return true
+		}
+	}
+	return false
+}
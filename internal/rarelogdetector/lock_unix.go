@@ -0,0 +1,50 @@
+//go:build unix
+
+package rarelogdetector
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// The lock file is locked with a record lock of fcntl, which tells the PID
+// of the process holding it.
+
+func newLockRecord(exclusive bool) syscall.Flock_t {
+	lk := syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: io.SeekStart,
+	}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	return lk
+}
+
+// tryLockFile returns false if another process holds the lock
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	lk := newLockRecord(exclusive)
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// downgradeLockFile turns the exclusive lock into a shared one
+func downgradeLockFile(f *os.File) error {
+	lk := newLockRecord(false)
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
+
+// lockHolder returns the PID of a process holding a lock conflicting with
+// the lock and if it is writing
+func lockHolder(f *os.File, exclusive bool) (int, bool) {
+	lk := newLockRecord(exclusive)
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk); err != nil ||
+		lk.Type == syscall.F_UNLCK {
+		return 0, false
+	}
+	return int(lk.Pid), lk.Type == syscall.F_WRLCK
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package rarelogdetector
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The lock file is locked with LockFileEx. A lock of Windows belongs to
+// the handle and does not tell the process holding it.
+
+const cLockBytes = 1
+
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	h := windows.Handle(f.Fd())
+	// a shared lock is not turned into an exclusive one
+	if exclusive {
+		windows.UnlockFileEx(h, 0, cLockBytes, 0, new(windows.Overlapped))
+	}
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	err := windows.LockFileEx(h, flags, 0, cLockBytes, 0, new(windows.Overlapped))
+	if err == windows.ERROR_LOCK_VIOLATION {
+		if exclusive {
+			// keep the shared lock held before
+			windows.LockFileEx(h, windows.LOCKFILE_FAIL_IMMEDIATELY, 0, cLockBytes, 0, new(windows.Overlapped))
+		}
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func downgradeLockFile(f *os.File) error {
+	h := windows.Handle(f.Fd())
+	if err := windows.UnlockFileEx(h, 0, cLockBytes, 0, new(windows.Overlapped)); err != nil {
+		return err
+	}
+	return windows.LockFileEx(h, windows.LOCKFILE_FAIL_IMMEDIATELY, 0, cLockBytes, 0, new(windows.Overlapped))
+}
+
+func lockHolder(f *os.File, exclusive bool) (int, bool) {
+	return 0, false
+}
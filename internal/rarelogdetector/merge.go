@@ -0,0 +1,359 @@
+package rarelogdetector
+
+import (
+	"errors"
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Models of several hosts are merged by summing the counts of the terms
+// and grouping the phrases again with the summed counts in the same way
+// as rearangePhrases, as the same message can be different phrases on
+// hosts with different term counts. The phrases are grouped from their
+// templates rather than their last lines, so "*" stays "*".
+// The counts of each phrase by the hosts are kept as its origins.
+
+// a data directory or an exported model to merge
+type mergeSource struct {
+	origin string
+	path   string
+}
+
+// a phrase with the hosts it was seen on
+type phraseOrigin struct {
+	PhraseID string
+	Count    int
+	Score    float64
+	Origins  map[string]int
+	Text     string
+}
+
+// parseMergeSource parses "origin=path" or "path" whose origin is the path itself.
+func parseMergeSource(s string) mergeSource {
+	if pos := strings.Index(s, "="); pos > 0 {
+		return mergeSource{origin: s[:pos], path: s[pos+1:]}
+	}
+	return mergeSource{origin: filepath.Clean(s), path: s}
+}
+
+// loadModel reads the model of a data directory or an exported model file
+func loadModel(path string) (*model, error) {
+	if !utils.PathExist(fmt.Sprintf("%s/config.tbl.ini", path)) {
+		return readModel(path)
+	}
+	a, err := NewAnalyzer2(path, nil, nil, 0, 0, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.toModel(), nil
+}
+
+// addModelItem sums the counts and keeps the first and the latest timestamps
+func addModelItem(dst *modelItem, src modelItem) {
+	dst.Count += src.Count
+	if src.CreateEpoch > 0 && (dst.CreateEpoch == 0 || src.CreateEpoch < dst.CreateEpoch) {
+		dst.CreateEpoch = src.CreateEpoch
+	}
+	if src.LastUpdate >= dst.LastUpdate {
+		dst.LastUpdate = src.LastUpdate
+		dst.LastValue = src.LastValue
+	}
+}
+
+func sortedModelItems(merged map[string]*modelItem) []modelItem {
+	res := make([]modelItem, 0, len(merged))
+	for _, mi := range merged {
+		res = append(res, *mi)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Item < res[j].Item
+	})
+	return res
+}
+
+// unionWords returns the words in any of the lists in the order of appearance
+func unionWords(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	res := make([]string, 0)
+	for _, words := range lists {
+		for _, w := range nonEmpty(words) {
+			if !seen[w] {
+				seen[w] = true
+				res = append(res, w)
+			}
+		}
+	}
+	return res
+}
+
+// mergeModels sums the terms of the models and groups their phrases again.
+// The config of the first model is used. The models must have the same log format.
+func mergeModels(models []*model, origins []string) (*model, error) {
+	if len(models) == 0 {
+		return nil, errors.New("no models to merge")
+	}
+	c := models[0].Config
+	merged := &model{
+		Version:    cModelVersion,
+		ExportedAt: models[0].ExportedAt,
+		Config:     c,
+	}
+	for n, m := range models {
+		if m.Config.LogFormat != c.LogFormat || m.Config.TimestampLayout != c.TimestampLayout {
+			return nil, fmt.Errorf("log format of %s is different from %s", origins[n], origins[0])
+		}
+		if m.ExportedAt > merged.ExportedAt {
+			merged.ExportedAt = m.ExportedAt
+		}
+		merged.Keywords = unionWords(merged.Keywords, m.Keywords)
+		merged.Ignorewords = unionWords(merged.Ignorewords, m.Ignorewords)
+		merged.CustomPhrases = unionWords(merged.CustomPhrases, m.CustomPhrases)
+	}
+
+	terms := make(map[string]*modelItem)
+	for _, m := range models {
+		for _, mi := range m.Terms {
+			if _, ok := terms[mi.Item]; !ok {
+				terms[mi.Item] = &modelItem{Item: mi.Item, StableID: mi.StableID}
+			}
+			addModelItem(terms[mi.Item], mi)
+		}
+	}
+	merged.Terms = sortedModelItems(terms)
+
+	t, err := newTrans("", c.LogFormat, c.TimestampLayout, 0, 0, 0, "",
+		c.TermCountBorderRate, nil, nil,
+		merged.Keywords, merged.Ignorewords, merged.CustomPhrases, false, false)
+	if err != nil {
+		return nil, err
+	}
+	importItems(t.terms, merged.Terms)
+	t.calcCountBorder(c.TermCountBorderRate, c.TermCountBorder)
+
+	phrases := make(map[string]*modelItem)
+	for _, stage := range []int{cStageRegisterPT, cStageRegisterPhrases} {
+		for n, m := range models {
+			for _, mi := range m.Phrases {
+				_, _, phrasestr, err := t.tokenizeParsed(t.parseTemplate(mi), mi.Count, stage,
+					c.MinMatchRate, c.MaxMatchRate, stage == cStageRegisterPhrases)
+				if err != nil {
+					return nil, err
+				}
+				if stage == cStageRegisterPT {
+					continue
+				}
+				// phrases without terms are kept as they are
+				if phrasestr == "" {
+					phrasestr = mi.Item
+				}
+				p, ok := phrases[phrasestr]
+				if !ok {
+					p = &modelItem{
+						Item:     phrasestr,
+						StableID: newStableID(phrasestr),
+						Origins:  make(map[string]int),
+					}
+					phrases[phrasestr] = p
+				}
+				addModelItem(p, mi)
+				if len(mi.Origins) == 0 {
+					p.Origins[origins[n]] += mi.Count
+				}
+				for origin, cnt := range mi.Origins {
+					p.Origins[origin] += cnt
+				}
+			}
+		}
+		if stage == cStageRegisterPT {
+			t.ptRegistered = true
+		}
+	}
+	merged.Phrases = sortedModelItems(phrases)
+	return merged, nil
+}
+
+// parseTemplate parses the phrase of the model instead of its last line,
+// so that the terms of one line are not given to all the lines of the phrase.
+// "*" in the phrase stays "*" and the last line is kept as the last value.
+func (t *trans) parseTemplate(mi modelItem) *parsedLine {
+	return &parsedLine{
+		line:       mi.LastValue,
+		message:    mi.Item,
+		matched:    true,
+		lastUpdate: mi.LastUpdate,
+		epoch:      mi.LastUpdate,
+		words:      t.splitTerms(mi.Item),
+	}
+}
+
+// MergeModels creates the data directory from the models of several hosts.
+// Each source is a data directory or a file exported by ExportModel
+// given as "origin=path" or "path", and the counts of the phrases are kept
+// by the origins. logPath replaces the log path of the first model if not empty.
+func MergeModels(dataDir string, sources []string, logPath string,
+	searchRegex, exludeRegex []string) (*Analyzer, error) {
+	if err := checkNewDataDir(dataDir); err != nil {
+		return nil, err
+	}
+	if len(sources) < 2 {
+		return nil, errors.New("two or more data directories or models are required to merge")
+	}
+	models := make([]*model, len(sources))
+	origins := make([]string, len(sources))
+	seen := make(map[string]bool)
+	for n, s := range sources {
+		src := parseMergeSource(s)
+		if seen[src.origin] {
+			return nil, fmt.Errorf("origin %s is given twice", src.origin)
+		}
+		seen[src.origin] = true
+		m, err := loadModel(src.path)
+		if err != nil {
+			return nil, err
+		}
+		models[n] = m
+		origins[n] = src.origin
+	}
+	m, err := mergeModels(models, origins)
+	if err != nil {
+		return nil, err
+	}
+	return importModel(dataDir, m, logPath, searchRegex, exludeRegex)
+}
+
+func (a *Analyzer) savePhraseOrigins() error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+	if err := a.phraseOriginsTable.Truncate(); err != nil {
+		return err
+	}
+	for stableID, origins := range a.trans.phraseOrigins {
+		for origin, cnt := range origins {
+			if err := a.phraseOriginsTable.InsertRow(nil,
+				stableID, origin, cnt); err != nil {
+				return err
+			}
+		}
+	}
+	return a.phraseOriginsTable.Flush()
+}
+
+func (a *Analyzer) loadPhraseOrigins() error {
+	rows, err := a.phraseOriginsTable.SelectRows(nil, tableDefs["phraseOrigins"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		var stableID, origin string
+		var cnt int
+		if err := rows.Scan(&stableID, &origin, &cnt); err != nil {
+			return err
+		}
+		if _, ok := a.trans.phraseOrigins[stableID]; !ok {
+			a.trans.phraseOrigins[stableID] = make(map[string]int)
+		}
+		a.trans.phraseOrigins[stableID][origin] += cnt
+	}
+	return nil
+}
+
+// originsByPhrase sums the origins of the saved phrases
+// into the phrases they are grouped into now
+func (t *trans) originsByPhrase() map[int]map[string]int {
+	res := make(map[int]map[string]int)
+	for stableID, origins := range t.phraseOrigins {
+		phraseID := t.findPhrase(stableID)
+		if phraseID < 0 {
+			continue
+		}
+		if _, ok := res[phraseID]; !ok {
+			res[phraseID] = make(map[string]int)
+		}
+		for origin, cnt := range origins {
+			res[phraseID][origin] += cnt
+		}
+	}
+	return res
+}
+
+// Origins returns the phrases of a merged model seen on maxOrigins hosts or less
+// ordered by the score. maxOrigins=1 shows the phrases seen only on one host.
+func (a *Analyzer) Origins(N, maxOrigins int,
+	termCountBorderRate float64, termCountBorder int) ([]phraseOrigin, error) {
+	if len(a.trans.phraseOrigins) == 0 {
+		return nil, errors.New("the data directory is not merged from other ones")
+	}
+	if !a.trans.ptRegistered {
+		// the merged phrases are grouped by the border of the config,
+		// and regrouping them from their last lines would split them again
+		a.trans.calcCountBorder(a.termCountBorderRate, a.termCountBorder)
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return nil, err
+	}
+
+	p := a.trans.phrases
+	acked := a.trans.ackedPhrases(a.trans.latestUpdate)
+	annotations := a.trans.phraseAnnotations()
+	res := make([]phraseOrigin, 0)
+	for phraseID, origins := range a.trans.originsByPhrase() {
+		text := p.getMember(phraseID)
+		if acked[phraseID] || len(origins) > maxOrigins || !a.trans.match(text) {
+			continue
+		}
+		score, _ := a.trans.scorePhrase(phraseID, annotations[phraseID])
+		res = append(res, phraseOrigin{
+			PhraseID: p.getStableID(phraseID),
+			Count:    p.getCount(phraseID),
+			Score:    score,
+			Origins:  origins,
+			Text:     text,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].PhraseID < res[j].PhraseID
+	})
+	if N > 0 && len(res) > N {
+		res = res[:N]
+	}
+	return res, nil
+}
+
+// originsString formats the origins like "host1=3 host2=1"
+func originsString(origins map[string]int) string {
+	names := make([]string, 0, len(origins))
+	for origin := range origins {
+		names = append(names, origin)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, origin := range names {
+		parts[i] = fmt.Sprintf("%s=%d", origin, origins[origin])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a *Analyzer) OriginsShow(N, maxOrigins int,
+	termCountBorderRate float64, termCountBorder int) error {
+	res, err := a.Origins(N, maxOrigins, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	for _, po := range res {
+		fmt.Printf("%s,%d,%f,%s,%s\n", po.PhraseID, po.Count, po.Score,
+			originsString(po.Origins), po.Text)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package rarelogdetector
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A model is the config, the tokenizer settings and the counts of terms and
+// phrases in a data directory exported to a single gzipped JSON file,
+// so that a model trained on one host can be used on another.
+
+type modelConfig struct {
+	LogPath             string  `json:"logPath"`
+	LogFormat           string  `json:"logFormat"`
+	TimestampLayout     string  `json:"timestampLayout"`
+	BlockSize           int     `json:"blockSize"`
+	MaxBlocks           int     `json:"maxBlocks"`
+	Retention           int64   `json:"retention"`
+	Frequency           string  `json:"frequency"`
+	MinMatchRate        float64 `json:"minMatchRate"`
+	MaxMatchRate        float64 `json:"maxMatchRate"`
+	TermCountBorderRate float64 `json:"termCountBorderRate"`
+	TermCountBorder     int     `json:"termCountBorder"`
+	CountHalfLife       int64   `json:"countHalfLife"`
+}
+
+// a term or a phrase with its count
+type modelItem struct {
+	Item        string `json:"item"`
+	StableID    string `json:"stableID"`
+	Count       int    `json:"count"`
+	CreateEpoch int64  `json:"createEpoch"`
+	LastUpdate  int64  `json:"lastUpdate"`
+	LastValue   string `json:"lastValue,omitempty"`
+	// counts by the hosts the phrase was seen on in merged models
+	Origins map[string]int `json:"origins,omitempty"`
+}
+
+type model struct {
+	Version       int         `json:"version"`
+	ExportedAt    int64       `json:"exportedAt"`
+	Config        modelConfig `json:"config"`
+	Keywords      []string    `json:"keywords"`
+	Ignorewords   []string    `json:"ignorewords"`
+	CustomPhrases []string    `json:"customPhrases"`
+	Terms         []modelItem `json:"terms"`
+	Phrases       []modelItem `json:"phrases"`
+}
+
+// exportItems returns the items with counts in the order of the items
+// so that exported models can be compared
+func exportItems(i *items) []modelItem {
+	res := make([]modelItem, 0, len(i.counts))
+	for itemID, cnt := range i.counts {
+		if cnt <= 0 {
+			continue
+		}
+		res = append(res, modelItem{
+			Item:        i.getMember(itemID),
+			StableID:    i.getStableID(itemID),
+			Count:       i.getCount(itemID),
+			CreateEpoch: i.getCreateEpoch(itemID),
+			LastUpdate:  i.getLastUpdate(itemID),
+			LastValue:   i.getLastValue(itemID),
+		})
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Item < res[b].Item
+	})
+	return res
+}
+
+// importItems registers the items as new ones to be saved in the current block
+func importItems(i *items, mis []modelItem) {
+	for _, mi := range mis {
+		itemID := i.register(mi.Item, mi.Count, mi.CreateEpoch, mi.LastUpdate, mi.LastValue, true)
+		if mi.StableID != "" && itemID >= 0 && i.withStableIDs {
+			i.setStableID(itemID, mi.StableID)
+		}
+	}
+}
+
+func nonEmpty(words []string) []string {
+	res := make([]string, 0, len(words))
+	for _, w := range words {
+		if w != "" {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+func (a *Analyzer) toModel() *model {
+	m := &model{
+		Version:    cModelVersion,
+		ExportedAt: time.Now().Unix(),
+		Config: modelConfig{
+			LogPath:             a.logPath,
+			LogFormat:           a.logFormat,
+			TimestampLayout:     a.timestampLayout,
+			BlockSize:           a.blockSize,
+			MaxBlocks:           a.maxBlocks,
+			Retention:           a.retention,
+			Frequency:           a.frequency,
+			MinMatchRate:        a.minMatchRate,
+			MaxMatchRate:        a.maxMatchRate,
+			TermCountBorderRate: a.termCountBorderRate,
+			TermCountBorder:     a.termCountBorder,
+			CountHalfLife:       a.countHalfLife,
+		},
+		Keywords:      nonEmpty(a.keywords),
+		Ignorewords:   nonEmpty(a.ignorewords),
+		CustomPhrases: nonEmpty(a.customPhrases),
+		Terms:         exportItems(a.trans.terms),
+		Phrases:       exportItems(a.trans.phrases),
+	}
+	for n, mi := range m.Phrases {
+		m.Phrases[n].Origins = a.trans.phraseOrigins[mi.StableID]
+	}
+	return m
+}
+
+// ExportModel writes the model in the data directory to outputFile as gzipped JSON.
+// The data directory is not changed.
+func (a *Analyzer) ExportModel(outputFile string) error {
+	if outputFile == "" {
+		return errors.New("output file of the model is required")
+	}
+	m := a.toModel()
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	logrus.Infof("exported %d terms and %d phrases to %s",
+		len(m.Terms), len(m.Phrases), outputFile)
+	return f.Close()
+}
+
+func readModel(modelPath string) (*model, error) {
+	f, err := os.Open(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a gzipped model: %w", modelPath, err)
+	}
+	defer zr.Close()
+	m := new(model)
+	if err := json.NewDecoder(zr).Decode(m); err != nil {
+		return nil, fmt.Errorf("%s is not a model: %w", modelPath, err)
+	}
+	if m.Version <= 0 || m.Version > cModelVersion {
+		return nil, fmt.Errorf("version %d of the model %s is not supported. Supported up to %d",
+			m.Version, modelPath, cModelVersion)
+	}
+	return m, nil
+}
+
+// ImportModel creates the data directory from the model exported by ExportModel.
+// logPath replaces the log path of the model if not empty.
+// The data directory must not have a model yet.
+func ImportModel(dataDir, modelPath, logPath string,
+	searchRegex, exludeRegex []string) (*Analyzer, error) {
+	if err := checkNewDataDir(dataDir); err != nil {
+		return nil, err
+	}
+	m, err := readModel(modelPath)
+	if err != nil {
+		return nil, err
+	}
+	return importModel(dataDir, m, logPath, searchRegex, exludeRegex)
+}
+
+func checkNewDataDir(dataDir string) error {
+	if dataDir == "" {
+		return errors.New("data directory to import the model is required")
+	}
+	if utils.PathExist(fmt.Sprintf("%s/config.tbl.ini", dataDir)) {
+		return fmt.Errorf("%s already has a model", dataDir)
+	}
+	return nil
+}
+
+func importModel(dataDir string, m *model, logPath string,
+	searchRegex, exludeRegex []string) (*Analyzer, error) {
+	c := m.Config
+	if logPath == "" {
+		logPath = c.LogPath
+	}
+	a, err := NewAnalyzer(dataDir, logPath, c.LogFormat, c.TimestampLayout,
+		searchRegex, exludeRegex,
+		c.MaxBlocks, c.BlockSize,
+		c.Retention, c.Frequency,
+		c.MinMatchRate, c.MaxMatchRate,
+		c.TermCountBorderRate, c.TermCountBorder,
+		m.Keywords, m.Ignorewords, m.CustomPhrases,
+		false)
+	if err != nil {
+		return nil, err
+	}
+
+	importItems(a.trans.terms, m.Terms)
+	importItems(a.trans.phrases, m.Phrases)
+	for _, mi := range m.Phrases {
+		if len(mi.Origins) > 0 {
+			a.trans.phraseOrigins[mi.StableID] = mi.Origins
+		}
+	}
+	a.trans.latestUpdate = a.trans.phrases.lastUpdate
+	if err := a.trans.calcPhrasesScore(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if err := a.commit(false); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if c.CountHalfLife > 0 {
+		if err := a.SetCountHalfLife(time.Duration(c.CountHalfLife) * time.Second); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+	logrus.Infof("imported %d terms and %d phrases to %s",
+		len(m.Terms), len(m.Phrases), dataDir)
+	return a, nil
+}
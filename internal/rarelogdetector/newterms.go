@@ -0,0 +1,177 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// types of terms by their shape
+var termTypes = []string{"ipv4", "number", "hex", "id", "word"}
+
+var (
+	ipv4Re     = regexp.MustCompile(`^[0-9]{1,3}(\.[0-9]{1,3}){3}$`)
+	numberRe   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	hexRe      = regexp.MustCompile(`^(0x)?[0-9a-f]{6,}$`)
+	hasDigitRe = regexp.MustCompile(`[0-9]`)
+)
+
+// a term first seen in the window
+type newTerm struct {
+	termID    int
+	Term      string
+	Type      string
+	Count     int
+	FirstSeen int64
+	Fields    []string
+	Samples   []termSample
+}
+
+// a phrase where a new term was seen
+type termSample struct {
+	PhraseID string
+	Text     string
+}
+
+func termType(term string) string {
+	switch {
+	case ipv4Re.MatchString(term):
+		return "ipv4"
+	case numberRe.MatchString(term):
+		return "number"
+	case hexRe.MatchString(term) && hasDigitRe.MatchString(term):
+		return "hex"
+	case hasDigitRe.MatchString(term):
+		return "id"
+	}
+	return "word"
+}
+
+func validateTermType(typ string) error {
+	if typ == "" {
+		return nil
+	}
+	for _, tt := range termTypes {
+		if tt == typ {
+			return nil
+		}
+	}
+	return fmt.Errorf("term type must be one of %s", strings.Join(termTypes, "|"))
+}
+
+// fieldsOf returns the named groups of logFormat other than timestamp
+// which captured the term in the line
+func (t *trans) fieldsOf(line, term string) []string {
+	fields := make([]string, 0)
+	match := t.logFormatRe.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return fields
+	}
+	for i, name := range t.logFormatRe.SubexpNames() {
+		if name == "" || i == t.timestampPos {
+			continue
+		}
+		if strings.Contains(strings.ToLower(match[i]), term) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// getNewTerms returns the terms first seen at or after since
+// with the phrases whose last line has the term.
+// termType and field filter the terms if not empty.
+func (t *trans) getNewTerms(since int64, typ, field string,
+	termCountBorderRate float64, termCountBorder int,
+	minMatchRate, maxMatchRate float64) ([]newTerm, error) {
+	if err := validateTermType(typ); err != nil {
+		return nil, err
+	}
+	if err := t.rearangePhrases(termCountBorderRate, termCountBorder,
+		minMatchRate, maxMatchRate); err != nil {
+		return nil, err
+	}
+
+	te := t.terms
+	candidates := make(map[int]*newTerm)
+	for termID, createEpoch := range te.createEpochs {
+		// 0 is for terms not seen in the logs like the ones in custom phrases
+		if createEpoch <= 0 || createEpoch < since || te.getCount(termID) <= 0 {
+			continue
+		}
+		term := te.getMember(termID)
+		tt := termType(term)
+		if typ != "" && tt != typ {
+			continue
+		}
+		candidates[termID] = &newTerm{
+			termID:    termID,
+			Term:      term,
+			Type:      tt,
+			Count:     te.getCount(termID),
+			FirstSeen: createEpoch,
+			Fields:    make([]string, 0),
+			Samples:   make([]termSample, 0),
+		}
+	}
+	if len(candidates) == 0 {
+		return []newTerm{}, nil
+	}
+
+	p := t.phrases
+	for _, phraseID := range p.biggestNItems(0) {
+		line := p.getLastValue(phraseID)
+		if line == "" || !t.match(line) {
+			continue
+		}
+		message := line
+		if t.messagePos >= 0 {
+			match := t.logFormatRe.FindStringSubmatch(line)
+			if len(match) > t.messagePos {
+				message = match[t.messagePos]
+			}
+		}
+		// explainWords looks up the terms without registering them
+		seen := make(map[int]bool)
+		for _, ew := range t.explainWords(message) {
+			termID := ew.TermID
+			if ew.Excluded || ew.Asterisk {
+				continue
+			}
+			nt, ok := candidates[termID]
+			if !ok || seen[termID] {
+				continue
+			}
+			seen[termID] = true
+			for _, f := range t.fieldsOf(line, nt.Term) {
+				if !slices.Contains(nt.Fields, f) {
+					nt.Fields = append(nt.Fields, f)
+				}
+			}
+			if len(nt.Samples) < cNewTermSamples {
+				nt.Samples = append(nt.Samples, termSample{
+					PhraseID: p.getStableID(phraseID),
+					Text:     p.getMember(phraseID),
+				})
+			}
+		}
+	}
+
+	res := make([]newTerm, 0, len(candidates))
+	for _, nt := range candidates {
+		if field != "" && !slices.Contains(nt.Fields, field) {
+			continue
+		}
+		sort.Strings(nt.Fields)
+		res = append(res, *nt)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].FirstSeen != res[j].FirstSeen {
+			return res[i].FirstSeen > res[j].FirstSeen
+		}
+		return res[i].Term < res[j].Term
+	})
+	return res, nil
+}
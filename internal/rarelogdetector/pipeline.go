@@ -0,0 +1,229 @@
+package rarelogdetector
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Lines are read by a reader goroutine, parsed by the workers in batches
+// and registered to the terms and the phrases in the order of the lines
+// by the caller, so the result does not depend on the number of workers.
+// Parsing lines with the regexes and splitting them into words is most of the
+// cost of feeding, and registration is kept on one goroutine as it updates
+// the counts, the blocks and the phrase tree.
+// When the terms are counted, the workers also sum the terms of each batch,
+// so that the caller registers each term once per batch instead of once per line.
+
+// a word of a message normalized by splitTerms
+type termWord struct {
+	word   string
+	kind   int
+	orig   string // the word in the message
+	reason string // why the word is "*" or excluded
+}
+
+// a line parsed by parseLine
+type parsedLine struct {
+	line         string
+	message      string
+	matched      bool  // not filtered by the search and exclude regexes
+	lastUpdate   int64 // timestamp used to register the line
+	epoch        int64 // timestamp of the line or the file like lineEpoch
+	retentionPos int
+	words        []termWord
+	values       []float64 // numbers of the message by position, read only by observeValues
+	termsCounted bool      // the words are registered by registerTermCounts with the batch
+}
+
+// a term summed over the lines of a batch by countTerms
+type termCount struct {
+	word        string
+	keyword     bool
+	count       int
+	createEpoch int64
+	lastUpdate  int64
+}
+
+// a line read from the log files with its position
+type readLine struct {
+	text      string
+	file      string
+	row       int
+	fileEpoch int64
+	eof       bool // the end of a file which is not the last one
+	parsed    *parsedLine
+}
+
+type lineBatch struct {
+	lines  []readLine
+	terms  []termCount // nil if the terms are registered line by line
+	parsed chan struct{}
+}
+
+// lineReader reads the log files ahead of the registration
+type lineReader struct {
+	batches chan *lineBatch
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// SetWorkers sets the number of goroutines parsing lines when feeding.
+// 0 uses all the CPUs.
+func (a *Analyzer) SetWorkers(workers int) {
+	a.workers = workers
+}
+
+func (a *Analyzer) getWorkers() int {
+	if a.workers > 0 {
+		return a.workers
+	}
+	return runtime.NumCPU()
+}
+
+// readLines starts reading up to targetLinesCnt non empty lines with
+// the file pointer and parsing them for the stage. The batches are returned
+// in the order of the lines. stop must be called before the file pointer is used again.
+func (a *Analyzer) readLines(targetLinesCnt int, stage int) *lineReader {
+	workers := a.getWorkers()
+	// the memory budget and the decay depend on the order of each count
+	sumTerms := stage == cStageRegisterTerms &&
+		a.trans.terms.maxItems == 0 && a.trans.terms.halfLife == 0
+	lr := &lineReader{
+		batches: make(chan *lineBatch, workers*2),
+		quit:    make(chan struct{}),
+	}
+	jobs := make(chan *lineBatch, workers*2)
+
+	for w := 0; w < workers; w++ {
+		lr.wg.Add(1)
+		go func() {
+			defer lr.wg.Done()
+			for b := range jobs {
+				for n := range b.lines {
+					b.lines[n].parsed = a.trans.parseLine(b.lines[n].text, b.lines[n].fileEpoch)
+				}
+				if sumTerms {
+					b.terms = countTerms(b.lines)
+				}
+				close(b.parsed)
+			}
+		}()
+	}
+
+	lr.wg.Add(1)
+	go func() {
+		defer lr.wg.Done()
+		defer close(lr.batches)
+		defer close(jobs)
+
+		send := func(b *lineBatch) bool {
+			select {
+			case jobs <- b:
+			case <-lr.quit:
+				return false
+			}
+			select {
+			case lr.batches <- b:
+			case <-lr.quit:
+				return false
+			}
+			return true
+		}
+
+		linesRead := 0
+		b := &lineBatch{parsed: make(chan struct{})}
+		for a.fp.Next() {
+			te := a.fp.Text()
+			if te == "" {
+				continue
+			}
+			b.lines = append(b.lines, readLine{
+				text:      te,
+				file:      a.fp.CurrFileName(),
+				row:       a.fp.Row(),
+				fileEpoch: a.fp.TextFileEpoch(),
+				eof:       a.fp.IsEOF && !a.fp.IsLastFile(),
+			})
+			linesRead++
+			if len(b.lines) >= cFeedBatchSize {
+				if !send(b) {
+					return
+				}
+				b = &lineBatch{parsed: make(chan struct{})}
+			}
+			if targetLinesCnt > 0 && linesRead >= targetLinesCnt {
+				break
+			}
+		}
+		if len(b.lines) > 0 {
+			send(b)
+		}
+	}()
+	return lr
+}
+
+// countTerms sums the terms of the lines in the order they first appear,
+// which is the order registerTerms gives them their IDs.
+// nil if a line has no timestamp, as registerTerms keeps the creation epoch
+// of the first line in a block then.
+func countTerms(lines []readLine) []termCount {
+	for _, rl := range lines {
+		if rl.parsed.matched && rl.parsed.lastUpdate <= 0 {
+			return nil
+		}
+	}
+	terms := make([]termCount, 0)
+	termPos := make(map[string]int)
+	for _, rl := range lines {
+		pl := rl.parsed
+		if !pl.matched {
+			continue
+		}
+		for _, tw := range pl.words {
+			if tw.kind != cWordTerm && tw.kind != cWordKeyword {
+				continue
+			}
+			pos, ok := termPos[tw.word]
+			if !ok {
+				pos = len(terms)
+				termPos[tw.word] = pos
+				terms = append(terms, termCount{word: tw.word,
+					createEpoch: pl.lastUpdate, lastUpdate: pl.lastUpdate})
+			}
+			tc := &terms[pos]
+			tc.count++
+			if tw.kind == cWordKeyword {
+				tc.keyword = true
+			}
+			if pl.lastUpdate < tc.createEpoch {
+				tc.createEpoch = pl.lastUpdate
+			}
+			if pl.lastUpdate > tc.lastUpdate {
+				tc.lastUpdate = pl.lastUpdate
+			}
+		}
+		pl.termsCounted = true
+	}
+	return terms
+}
+
+// next returns the next batch of parsed lines. nil at the end.
+func (lr *lineReader) next() *lineBatch {
+	b, ok := <-lr.batches
+	if !ok {
+		return nil
+	}
+	<-b.parsed
+	return b
+}
+
+// stop stops reading and waits for the goroutines
+func (lr *lineReader) stop() {
+	lr.once.Do(func() {
+		close(lr.quit)
+		for range lr.batches {
+		}
+		lr.wg.Wait()
+	})
+}
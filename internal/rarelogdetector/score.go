@@ -0,0 +1,201 @@
+package rarelogdetector
+
+import (
+	"errors"
+	"fmt"
+	"goRareLogDetector/pkg/filepointer"
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// a line of another log scored with the frozen model
+type scoredLine struct {
+	File      string
+	Row       int
+	Line      string
+	PhraseID  string // the nearest phrase. Empty if no phrase shares a term
+	Phrase    string
+	Count     int     // count of the nearest phrase in the model
+	MatchRate float64 // rate of the terms of the line found in the nearest phrase
+	Novel     bool
+}
+
+// phraseIndex maps terms to the phrases having them
+// to find the nearest phrase of a line
+type phraseIndex struct {
+	termPhrases map[int][]int
+	nTerms      map[int]int
+}
+
+func (t *trans) newPhraseIndex() *phraseIndex {
+	idx := &phraseIndex{
+		termPhrases: make(map[int][]int),
+		nTerms:      make(map[int]int),
+	}
+	for phraseID, member := range t.phrases.memberMap {
+		seen := make(map[int]bool)
+		for _, w := range strings.Split(member, " ") {
+			termID := t.terms.getItemID(w)
+			if termID < 0 || seen[termID] {
+				continue
+			}
+			seen[termID] = true
+			idx.termPhrases[termID] = append(idx.termPhrases[termID], phraseID)
+		}
+		idx.nTerms[phraseID] = len(seen)
+	}
+	return idx
+}
+
+// frozenTokens splits the message into terms like toTermList
+// without registering anything. Unknown words become "*".
+func (t *trans) frozenTokens(message string) []int {
+	tokens := make([]int, 0)
+	for _, ew := range t.explainWords(message) {
+		if ew.Excluded {
+			continue
+		}
+		tokens = append(tokens, ew.TermID)
+	}
+	return tokens
+}
+
+// nearestPhrase returns the phrase having the most terms of the line.
+// Ties are broken by the rate of the terms of the phrase found in the line,
+// then by the count of the phrase.
+func (t *trans) nearestPhrase(idx *phraseIndex, tokens []int) (int, map[int]int, int) {
+	terms := make(map[int]bool)
+	for _, termID := range tokens {
+		if termID >= 0 {
+			terms[termID] = true
+		}
+	}
+	hits := make(map[int]int)
+	for termID := range terms {
+		for _, phraseID := range idx.termPhrases[termID] {
+			hits[phraseID]++
+		}
+	}
+	best := -1
+	for phraseID, hit := range hits {
+		if best < 0 || hit > hits[best] {
+			best = phraseID
+			continue
+		}
+		if hit < hits[best] {
+			continue
+		}
+		cover := float64(hit) / float64(idx.nTerms[phraseID])
+		bestCover := float64(hits[best]) / float64(idx.nTerms[best])
+		if cover > bestCover || cover == bestCover &&
+			(t.phrases.getCount(phraseID) > t.phrases.getCount(best) ||
+				t.phrases.getCount(phraseID) == t.phrases.getCount(best) && phraseID < best) {
+			best = phraseID
+		}
+	}
+	return best, hits, len(terms)
+}
+
+// scoreLine groups the line with the frozen phrase tree.
+// The line is novel if it is not grouped into a phrase of the model
+// and no phrase has minMatchRate of its terms.
+func (t *trans) scoreLine(idx *phraseIndex, line string,
+	minMatchRate, maxMatchRate float64) scoredLine {
+	_, message := t.splitLine(line)
+	tokens := t.frozenTokens(message)
+	phrase := t.toPhrase(tokens, minMatchRate, maxMatchRate, true, make(map[string]string))
+	words := make([]string, len(phrase))
+	for i, termID := range phrase {
+		words[i] = t.terms.getMember(termID)
+	}
+	groupedID := t.phrases.getItemID(strings.Join(words, " "))
+
+	nearest, hits, nTerms := t.nearestPhrase(idx, tokens)
+	phraseID := groupedID
+	if phraseID < 0 {
+		phraseID = nearest
+	}
+	sl := scoredLine{Line: line}
+	if phraseID >= 0 {
+		sl.PhraseID = t.phrases.getStableID(phraseID)
+		sl.Phrase = t.phrases.getMember(phraseID)
+		sl.Count = t.phrases.getCount(phraseID)
+		if nTerms > 0 {
+			sl.MatchRate = float64(hits[phraseID]) / float64(nTerms)
+		}
+	}
+	sl.Novel = groupedID < 0 && sl.MatchRate < minMatchRate
+	return sl
+}
+
+// Score groups each line of logPath with the terms and phrases of the model
+// in the data directory and tells the nearest phrase and whether the line is novel.
+// The model is not changed and nothing is written to the data directory.
+func (a *Analyzer) Score(logPath string,
+	termCountBorderRate float64, termCountBorder int) ([]scoredLine, error) {
+	if logPath == "" {
+		return nil, errors.New("log file to score is required")
+	}
+	a.readOnly = true
+	a.trans.readOnly = true
+
+	if termCountBorderRate <= 0 && termCountBorder <= 0 {
+		termCountBorderRate = a.termCountBorderRate
+	}
+	if !a.trans.ptRegistered {
+		// force rearangePhrases to rebuild the phrase tree
+		a.trans.termCountBorder = 0
+	}
+	if err := a.trans.rearangePhrases(termCountBorderRate, termCountBorder,
+		a.minMatchRate, a.maxMatchRate); err != nil {
+		return nil, err
+	}
+	idx := a.trans.newPhraseIndex()
+
+	fp, err := filepointer.NewFilePointer(logPath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := fp.Open(); err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	res := make([]scoredLine, 0)
+	for fp.Next() {
+		te := fp.Text()
+		if te == "" || !a.trans.match(te) {
+			continue
+		}
+		sl := a.trans.scoreLine(idx, te, a.minMatchRate, a.maxMatchRate)
+		sl.File = fp.CurrFileName()
+		sl.Row = fp.Row()
+		res = append(res, sl)
+	}
+	if err := fp.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (a *Analyzer) ScoreShow(logPath string,
+	termCountBorderRate float64, termCountBorder int) error {
+	lines, err := a.Score(logPath, termCountBorderRate, termCountBorder)
+	if err != nil {
+		return err
+	}
+	novel := 0
+	for _, sl := range lines {
+		status := "known"
+		if sl.Novel {
+			status = "novel"
+			novel++
+		}
+		fmt.Printf("%d,%s,%f,%s,%d,%s\n", sl.Row, status, sl.MatchRate,
+			sl.PhraseID, sl.Count, sl.Line)
+	}
+	logrus.Infof("%d of %d lines are novel", novel, len(lines))
+	return nil
+}
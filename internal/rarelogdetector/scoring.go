@@ -0,0 +1,164 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScoringModel is how the score of phrases is calculated.
+// score = rarity * severity weight * recency boost
+// rarity is the mean IDF of the terms in the phrase.
+// The severity is taken from the annotation, the "severity" or "level" field
+// of logFormat, or ErrorKeywords in this order.
+// A severity without a weight is weighted by 1.
+// The recency boost is 1 + RecencyWeight for the latest phrase and
+// decays to 1 by half in every RecencyHalfLife. RecencyWeight=0 disables it.
+type ScoringModel struct {
+	SeverityWeights map[string]float64
+	ErrorKeywords   string
+	RecencyWeight   float64
+	RecencyHalfLife time.Duration
+}
+
+// DefaultScoringModel scores phrases by the rarity only.
+// The severity weights, the error keywords and the recency boost are opted in.
+func DefaultScoringModel() ScoringModel {
+	return ScoringModel{
+		SeverityWeights: map[string]float64{},
+		ErrorKeywords:   "",
+		RecencyWeight:   0,
+		RecencyHalfLife: 24 * time.Hour,
+	}
+}
+
+// ParseSeverityWeights parses weights like "info=1,warning=1.5,error=2,critical=3"
+func ParseSeverityWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("severity weight must be like error=2: %s", kv)
+		}
+		if err := validateSeverity(pair[0]); err != nil {
+			return nil, err
+		}
+		w, err := strconv.ParseFloat(pair[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		weights[pair[0]] = w
+	}
+	return weights, nil
+}
+
+type scoring struct {
+	severityWeights map[string]float64
+	errorKeywordsRe *regexp.Regexp
+	recencyWeight   float64
+	recencyHalfLife int64
+}
+
+func newScoring(m ScoringModel) (*scoring, error) {
+	s := new(scoring)
+	s.severityWeights = make(map[string]float64)
+	for severity, w := range m.SeverityWeights {
+		if err := validateSeverity(severity); err != nil {
+			return nil, err
+		}
+		s.severityWeights[severity] = w
+	}
+	if m.ErrorKeywords != "" {
+		re, err := regexp.Compile(`(?i)\b(?:` + m.ErrorKeywords + `)`)
+		if err != nil {
+			return nil, err
+		}
+		s.errorKeywordsRe = re
+	}
+	s.recencyWeight = m.RecencyWeight
+	s.recencyHalfLife = int64(m.RecencyHalfLife.Seconds())
+	return s, nil
+}
+
+// components of the score shown in topN
+type scoreComponents struct {
+	Rarity         float64
+	Severity       string
+	SeveritySource string
+	SeverityWeight float64
+	RecencyBoost   float64
+}
+
+// normalizeSeverity maps levels of syslog and popular loggers to the severities
+func normalizeSeverity(level string) string {
+	switch strings.ToLower(level) {
+	case "emerg", "emergency", "alert", "crit", "critical", "fatal", "panic":
+		return "critical"
+	case "err", "error", "eror":
+		return "error"
+	case "warn", "warning":
+		return "warning"
+	}
+	return "info"
+}
+
+// phraseSeverity returns the severity of the phrase and where it came from
+func (t *trans) phraseSeverity(phraseID int, an PhraseAnnotation) (string, string) {
+	if an.Severity != "" {
+		return an.Severity, "annotation"
+	}
+	if t.severityPos >= 0 {
+		match := t.logFormatRe.FindStringSubmatch(t.phrases.getLastValue(phraseID))
+		if len(match) > t.severityPos && match[t.severityPos] != "" {
+			return normalizeSeverity(match[t.severityPos]), "field"
+		}
+	}
+	// the phrase may not have the keywords when they are rare
+	if t.scoring.errorKeywordsRe != nil &&
+		t.scoring.errorKeywordsRe.MatchString(t.phrases.getLastValue(phraseID)) {
+		return "error", "keyword"
+	}
+	return "info", ""
+}
+
+func (t *trans) recencyBoost(lastUpdate int64) float64 {
+	s := t.scoring
+	if s.recencyWeight == 0 || s.recencyHalfLife <= 0 || lastUpdate <= 0 {
+		return 1
+	}
+	age := t.latestUpdate - lastUpdate
+	if age < 0 {
+		age = 0
+	}
+	return 1 + s.recencyWeight*math.Pow(0.5, float64(age)/float64(s.recencyHalfLife))
+}
+
+// scorePhrase combines the rarity calculated by calcPhrasesScore
+// with the severity and the recency of the phrase
+func (t *trans) scorePhrase(phraseID int, an PhraseAnnotation) (float64, scoreComponents) {
+	c := scoreComponents{Rarity: t.phraseScores[phraseID]}
+	c.Severity, c.SeveritySource = t.phraseSeverity(phraseID, an)
+	c.SeverityWeight = 1
+	if w, ok := t.scoring.severityWeights[c.Severity]; ok {
+		c.SeverityWeight = w
+	}
+	c.RecencyBoost = t.recencyBoost(t.phrases.getLastUpdate(phraseID))
+	return c.Rarity * c.SeverityWeight * c.RecencyBoost, c
+}
+
+// SetScoringModel changes how the score of phrases is calculated
+func (a *Analyzer) SetScoringModel(m ScoringModel) error {
+	s, err := newScoring(m)
+	if err != nil {
+		return err
+	}
+	a.trans.scoring = s
+	return nil
+}
@@ -0,0 +1,215 @@
+package rarelogdetector
+
+import (
+	"errors"
+	"goRareLogDetector/pkg/utils"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lines with the same correlation key like a call-id or a trace-id
+type session struct {
+	key       string
+	start     int64
+	end       int64
+	phraseIDs []int
+}
+
+// sessionizer groups lines into sessions by the correlation key.
+// A session is closed when no line with the key comes for timeout seconds
+// or a line matches endRe.
+type sessionizer struct {
+	keyRe     *regexp.Regexp
+	keyPos    int
+	endRe     *regexp.Regexp
+	timeout   int64
+	open      map[string]*session
+	lastSweep int64
+}
+
+// a sequence of phrases in sessions
+type sessionTemplate struct {
+	templateID int
+	TemplateID string
+	Count      int
+	Score      float64
+	PhraseIDs  []string
+	Texts      []string
+	SampleKey  string
+	LastSeen   int64
+}
+
+// newSessionizer compiles keyRegex and endRegex.
+// The key is the "key" named group, the first group or the whole match of keyRegex.
+// endRegex may be empty, and timeout=0 closes sessions only at the end of the logs.
+func newSessionizer(keyRegex, endRegex string, timeout time.Duration) (*sessionizer, error) {
+	if keyRegex == "" {
+		return nil, errors.New("session key regex is required")
+	}
+	if timeout < 0 {
+		return nil, errors.New("session timeout must not be negative")
+	}
+	s := new(sessionizer)
+	var err error
+	if s.keyRe, err = regexp.Compile(keyRegex); err != nil {
+		return nil, err
+	}
+	s.keyPos = s.keyRe.SubexpIndex("key")
+	if s.keyPos < 0 {
+		if s.keyRe.NumSubexp() > 0 {
+			s.keyPos = 1
+		} else {
+			s.keyPos = 0
+		}
+	}
+	if endRegex != "" {
+		if s.endRe, err = regexp.Compile(endRegex); err != nil {
+			return nil, err
+		}
+	}
+	s.timeout = int64(timeout.Seconds())
+	s.open = make(map[string]*session)
+	return s, nil
+}
+
+func (s *sessionizer) keyOf(line string) string {
+	match := s.keyRe.FindStringSubmatch(line)
+	if len(match) <= s.keyPos {
+		return ""
+	}
+	return match[s.keyPos]
+}
+
+// add puts the phrase of the line to its session and
+// returns the sessions closed by the line
+func (s *sessionizer) add(line string, epoch int64, phraseID int) []*session {
+	closed := s.expire(epoch)
+	key := s.keyOf(line)
+	if key == "" {
+		return closed
+	}
+	ss, ok := s.open[key]
+	if ok && s.timeout > 0 && epoch-ss.end > s.timeout {
+		closed = append(closed, ss)
+		ok = false
+	}
+	if !ok {
+		ss = &session{key: key, start: epoch, end: epoch}
+		s.open[key] = ss
+	}
+	if epoch > ss.end {
+		ss.end = epoch
+	}
+	ss.phraseIDs = append(ss.phraseIDs, phraseID)
+
+	if s.endRe != nil && s.endRe.MatchString(line) {
+		delete(s.open, key)
+		closed = append(closed, ss)
+	}
+	return closed
+}
+
+// expire closes the sessions idle for timeout.
+// Open sessions are checked at most once in a timeout.
+func (s *sessionizer) expire(epoch int64) []*session {
+	if s.timeout <= 0 || epoch-s.lastSweep < s.timeout {
+		return nil
+	}
+	s.lastSweep = epoch
+	closed := make([]*session, 0)
+	for key, ss := range s.open {
+		if epoch-ss.end > s.timeout {
+			delete(s.open, key)
+			closed = append(closed, ss)
+		}
+	}
+	sortSessions(closed)
+	return closed
+}
+
+// flush closes all the open sessions at the end of the logs
+func (s *sessionizer) flush() []*session {
+	closed := make([]*session, 0, len(s.open))
+	for _, ss := range s.open {
+		closed = append(closed, ss)
+	}
+	s.open = make(map[string]*session)
+	sortSessions(closed)
+	return closed
+}
+
+func sortSessions(sessions []*session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].start != sessions[j].start {
+			return sessions[i].start < sessions[j].start
+		}
+		return sessions[i].key < sessions[j].key
+	})
+}
+
+// lineEpoch returns the timestamp of the line or fileEpoch if it has none
+func (t *trans) lineEpoch(line string, fileEpoch int64) int64 {
+	timestamp, _ := t.splitLine(line)
+	if timestamp == "" || t.timestampLayout == "" {
+		return fileEpoch
+	}
+	dt, err := utils.Str2date(t.timestampLayout, timestamp)
+	if err != nil {
+		return fileEpoch
+	}
+	return dt.Unix()
+}
+
+// registerSession counts the sequence of the phrases of the session
+// as a template. The key of the latest session is kept as the sample.
+func (t *trans) registerSession(templates *items, ss *session) {
+	stableIDs := make([]string, len(ss.phraseIDs))
+	for i, phraseID := range ss.phraseIDs {
+		stableIDs[i] = t.phrases.getStableID(phraseID)
+	}
+	template := strings.Join(stableIDs, " ")
+	templateID := templates.register(template, 1, ss.start, ss.end, ss.key, false)
+	if templates.getStableID(templateID) == "" {
+		templates.setStableID(templateID, newStableID(template))
+	}
+	templates.tokensMap[templateID] = ss.phraseIDs
+}
+
+// rankSessionTemplates returns the templates seen maxCnt times or less
+// ordered by the rarity, which is the IDF of the template among sessions.
+func (t *trans) rankSessionTemplates(templates *items, maxCnt int) []sessionTemplate {
+	res := make([]sessionTemplate, 0)
+	for templateID, cnt := range templates.counts {
+		if maxCnt > 0 && cnt > maxCnt {
+			continue
+		}
+		phraseIDs := templates.tokensMap[templateID]
+		st := sessionTemplate{
+			templateID: templateID,
+			TemplateID: templates.getStableID(templateID),
+			Count:      cnt,
+			Score:      templates.getIdf(templateID),
+			PhraseIDs:  make([]string, len(phraseIDs)),
+			Texts:      make([]string, len(phraseIDs)),
+			SampleKey:  templates.getLastValue(templateID),
+			LastSeen:   templates.getLastUpdate(templateID),
+		}
+		for i, phraseID := range phraseIDs {
+			st.PhraseIDs[i] = t.phrases.getStableID(phraseID)
+			st.Texts[i] = t.phrases.getMember(phraseID)
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		if res[i].LastSeen != res[j].LastSeen {
+			return res[i].LastSeen > res[j].LastSeen
+		}
+		return res[i].TemplateID < res[j].TemplateID
+	})
+	return res
+}
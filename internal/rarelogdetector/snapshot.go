@@ -0,0 +1,320 @@
+package rarelogdetector
+
+import (
+	"encoding/gob"
+	"fmt"
+	"goRareLogDetector/pkg/csvdb"
+	"goRareLogDetector/pkg/utils"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A snapshot is the terms and the phrases in memory saved in a binary file
+// after the last commit of a run, so that opening a data directory does not replay every row of
+// the blocks and tokenize every phrase again.
+// It is used if the blocks are the same as when it was saved. The block
+// being written then and the blocks added after it are replayed.
+// Counts in memory are not reduced when the retention deletes blocks,
+// so no snapshot is saved then and the next load replays all the blocks.
+
+type itemsSnapshot struct {
+	Blocks           []csvdb.BlockStatus
+	CurrBlockNo      int
+	CurrLastIndex    int64
+	MaxItemID        int
+	MemberMap        map[int]string
+	Counts           map[int]int
+	CreateEpochs     map[int]int64
+	LastUpdates      map[int]int64
+	LastUpdate       int64
+	LastValues       map[int]string
+	StableIDs        map[int]string
+	CurrCounts       map[int]int
+	CurrUpdates      map[int]int64
+	CurrCreateEpochs map[int]int64
+	CurrItemCount    int
+	TotalCount       int
+	Tail             [][]uint32 // counters of the sketch of the items out of the budget
+}
+
+type snapshot struct {
+	Version      int
+	Terms        itemsSnapshot
+	Phrases      itemsSnapshot
+	PhraseTokens map[string][]int
+}
+
+// trackBlocks keeps the blocks counted in memory after loading
+func (i *items) trackBlocks() error {
+	statuses, err := i.BlockStatuses()
+	if err != nil {
+		return err
+	}
+	i.blocks = make(map[int]int64, len(statuses)+1)
+	for _, bs := range statuses {
+		i.blocks[bs.BlockNo] = bs.LastIndex
+	}
+	blockNo, lastIndex := i.CurrentBlock()
+	i.blocks[blockNo] = lastIndex
+	i.staleBlocks = false
+	return nil
+}
+
+// trackCurrentBlock is called when the block is switched.
+// The rows of the block overwritten are subtracted by next.
+func (i *items) trackCurrentBlock() error {
+	if i.DataDir == "" {
+		return nil
+	}
+	if err := i.checkBlocks(); err != nil {
+		return err
+	}
+	if i.blocks == nil {
+		i.blocks = make(map[int]int64)
+	}
+	blockNo, lastIndex := i.CurrentBlock()
+	i.blocks[blockNo] = lastIndex
+	return nil
+}
+
+// checkBlocks finds the blocks counted in memory deleted by the retention
+func (i *items) checkBlocks() error {
+	statuses, err := i.BlockStatuses()
+	if err != nil {
+		return err
+	}
+	lastIndexes := make(map[int]int64, len(statuses))
+	for _, bs := range statuses {
+		lastIndexes[bs.BlockNo] = bs.LastIndex
+	}
+	for blockNo, lastIndex := range i.blocks {
+		if idx, ok := lastIndexes[blockNo]; !ok || idx != lastIndex {
+			i.staleBlocks = true
+		}
+	}
+	return nil
+}
+
+// toSnapshot returns false if the counts in memory are not the same
+// as the blocks
+func (i *items) toSnapshot() (itemsSnapshot, bool, error) {
+	// phrases rearranged in memory
+	if i.DataDir == "" {
+		return itemsSnapshot{}, false, nil
+	}
+	if err := i.checkBlocks(); err != nil {
+		return itemsSnapshot{}, false, err
+	}
+	if i.staleBlocks {
+		return itemsSnapshot{}, false, nil
+	}
+	statuses, err := i.BlockStatuses()
+	if err != nil {
+		return itemsSnapshot{}, false, err
+	}
+	blockNo, lastIndex := i.CurrentBlock()
+	var tail [][]uint32
+	if i.tail != nil {
+		tail = i.tail.counters
+	}
+	return itemsSnapshot{
+		Blocks:           statuses,
+		CurrBlockNo:      blockNo,
+		CurrLastIndex:    lastIndex,
+		MaxItemID:        i.maxItemID,
+		MemberMap:        i.memberMap,
+		Counts:           i.counts,
+		CreateEpochs:     i.createEpochs,
+		LastUpdates:      i.lastUpdates,
+		LastUpdate:       i.lastUpdate,
+		LastValues:       i.lastValues,
+		StableIDs:        i.stableIDs,
+		CurrCounts:       i.currCounts,
+		CurrUpdates:      i.currUpdates,
+		CurrCreateEpochs: i.currCreateEpochs,
+		CurrItemCount:    i.currItemCount,
+		TotalCount:       i.totalCount,
+		Tail:             tail,
+	}, true, nil
+}
+
+// blocksToReplay compares the blocks with the blocks when the snapshot
+// was saved and returns the blocks to replay in the order of the index.
+// The current block of the snapshot is replayed if rows are added to it.
+func (s *itemsSnapshot) blocksToReplay(statuses []csvdb.BlockStatus) (bool, []csvdb.BlockStatus, bool) {
+	saved := make(map[int]csvdb.BlockStatus, len(s.Blocks))
+	for _, bs := range s.Blocks {
+		saved[bs.BlockNo] = bs
+	}
+	grown := false
+	replay := make([]csvdb.BlockStatus, 0)
+	for _, bs := range statuses {
+		sbs, ok := saved[bs.BlockNo]
+		switch {
+		case ok && sbs == bs:
+		case ok && bs.BlockNo == s.CurrBlockNo && bs.LastIndex == s.CurrLastIndex:
+			grown = true
+			replay = append(replay, bs)
+		case !ok && bs.LastIndex > s.CurrLastIndex:
+			replay = append(replay, bs)
+		default:
+			return false, nil, false
+		}
+		delete(saved, bs.BlockNo)
+	}
+	// deleted by the retention
+	if len(saved) > 0 {
+		return false, nil, false
+	}
+	sort.Slice(replay, func(a, b int) bool {
+		return replay[a].LastIndex < replay[b].LastIndex
+	})
+	return grown, replay, true
+}
+
+// loadSnapshot restores the items from the snapshot and replays the blocks
+// changed after it. It returns false if the snapshot is not usable.
+func (i *items) loadSnapshot() (bool, error) {
+	s := i.snapshot
+	i.snapshot = nil
+	if s == nil {
+		return false, nil
+	}
+	statuses, err := i.BlockStatuses()
+	if err != nil {
+		return false, err
+	}
+	grown, replay, ok := s.blocksToReplay(statuses)
+	if !ok {
+		logrus.Infof("the snapshot of %s is outdated. loading all the blocks", i.name)
+		return false, nil
+	}
+
+	i.maxItemID = s.MaxItemID
+	i.memberMap = s.MemberMap
+	i.members = make(map[string]int, len(s.MemberMap))
+	for itemID, item := range s.MemberMap {
+		i.members[item] = itemID
+	}
+	i.counts = s.Counts
+	i.createEpochs = s.CreateEpochs
+	i.lastUpdates = s.LastUpdates
+	i.lastUpdate = s.LastUpdate
+	i.lastValues = s.LastValues
+	i.stableIDs = s.StableIDs
+	i.stableIDMembers = make(map[string]int, len(s.StableIDs))
+	for itemID, stableID := range s.StableIDs {
+		i.stableIDMembers[stableID] = itemID
+	}
+	i.currCounts = s.CurrCounts
+	i.currUpdates = s.CurrUpdates
+	i.currCreateEpochs = s.CurrCreateEpochs
+	i.currItemCount = s.CurrItemCount
+	i.totalCount = s.TotalCount
+	if len(s.Tail) > 0 {
+		i.tail = &countMinSketch{
+			width:    uint64(len(s.Tail[0])),
+			counters: s.Tail,
+		}
+	}
+
+	if grown {
+		// the rows of the block in the snapshot are replaced by the block
+		for itemID, cnt := range i.currCounts {
+			i.counts[itemID] -= cnt
+			i.totalCount -= cnt
+		}
+		currItemCount := i.currItemCount
+		i.clearCurrCount()
+		if !replay[0].Completed {
+			i.currItemCount = currItemCount
+		}
+	}
+	blockNos := make([]int, len(replay))
+	for n, bs := range replay {
+		blockNos[n] = bs.BlockNo
+	}
+	if len(blockNos) > 0 {
+		if err := i.registerBlocks(blockNos); err != nil {
+			return false, err
+		}
+	}
+	if i.maxItems > 0 && len(i.members) > i.maxItems {
+		i.prune()
+	}
+	i.replayedBlocks = len(blockNos)
+	return true, i.trackBlocks()
+}
+
+func (t *trans) getSnapshotFilePath() string {
+	return fmt.Sprintf("%s/snapshot.gob", t.dataDir)
+}
+
+// saveSnapshot writes the snapshot through a synced temporary file,
+// so that the snapshot is not broken if the process stops while writing it.
+// It is saved once after the blocks and the last status are committed.
+func (t *trans) saveSnapshot() error {
+	if t.dataDir == "" || t.readOnly {
+		return nil
+	}
+	terms, ok, err := t.terms.toSnapshot()
+	if err != nil || !ok {
+		return err
+	}
+	phrases, ok, err := t.phrases.toSnapshot()
+	if err != nil || !ok {
+		return err
+	}
+
+	s := &snapshot{
+		Version:      cSnapshotVersion,
+		Terms:        terms,
+		Phrases:      phrases,
+		PhraseTokens: make(map[string][]int, len(t.phraseTokens)),
+	}
+	// terms evicted by the budget are registered again with other IDs
+	for phrase, tokens := range t.phraseTokens {
+		valid := true
+		for _, termID := range tokens {
+			if _, ok := t.terms.memberMap[termID]; termID >= 0 && !ok {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			s.PhraseTokens[phrase] = tokens
+		}
+	}
+
+	return csvdb.WriteFile(t.getSnapshotFilePath(), 0644, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(s)
+	})
+}
+
+// readSnapshot returns nil if the snapshot does not exist or cannot be read
+// so that all the blocks are loaded
+func (t *trans) readSnapshot() *snapshot {
+	path := t.getSnapshotFilePath()
+	if t.dataDir == "" || !utils.PathExist(path) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logrus.Warnf("failed to open the snapshot %s: %v", path, err)
+		return nil
+	}
+	defer f.Close()
+	s := new(snapshot)
+	if err := gob.NewDecoder(f).Decode(s); err != nil {
+		logrus.Warnf("failed to read the snapshot %s: %v", path, err)
+		return nil
+	}
+	if s.Version != cSnapshotVersion {
+		logrus.Infof("version %d of the snapshot %s is not supported", s.Version, path)
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,280 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"math"
+	"sort"
+	"time"
+)
+
+// baselines of the count of phrases in the latest time unit
+const (
+	cBaselineEWMA     = "ewma"
+	cBaselineSeasonal = "seasonal"
+)
+
+// count of phrases in each time unit of the frequency
+type phraseHistory struct {
+	counts    map[int]map[int64]int
+	minTime   int64
+	maxTime   int64
+	unitsecs  int64
+	frequency string
+}
+
+// a phrase whose count in the latest time unit is far from its baseline
+type spike struct {
+	phraseID int
+	PhraseID string
+	Count    int
+	Baseline float64
+	Z        float64
+	Ratio    float64
+	Text     string
+}
+
+func (s spike) direction() string {
+	if s.Z < 0 {
+		return "drop"
+	}
+	return "spike"
+}
+
+// getPhraseHistory reads the blocks of the phrases and counts the phrases
+// in rankMap by the time unit of the frequency.
+// The rows are mapped to the rearranged phrases without registering them again,
+// so nothing is written to the blocks.
+// The count of a row is of its whole block and is counted in the time unit
+// of its lastUpdate, so the blocks must be rotated by the time unit,
+// otherwise an error is returned.
+func (t *trans) getPhraseHistory(rankMap map[int]int) (*phraseHistory, error) {
+	// only hour and day rotate the blocks, see retentionPos
+	if (t.frequency != "hour" && t.frequency != "day") || t.timestampPos < 0 {
+		return nil, fmt.Errorf("the blocks are not rotated by the time unit. " +
+			"The data directory needs -frequency hour or day and the timestamp in -logFormat")
+	}
+	h := &phraseHistory{
+		counts:    make(map[int]map[int64]int, 0),
+		unitsecs:  utils.GetUnitsecs(t.frequency),
+		frequency: t.frequency,
+	}
+
+	// phrase item to read database
+	var p *items
+	if t.orgPhrases != nil {
+		p = t.orgPhrases
+	} else {
+		p = t.phrases
+	}
+	rows, err := p.SelectRows(nil, nil, tableDefs["items"])
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		return nil, nil
+	}
+
+	first := true
+	for rows.Next() {
+		var item string
+		var itemCount int
+		var createEpoch int64
+		var lastUpdate int64
+		var lastValue string
+		var stableID string
+		err = rows.Scan(&itemCount, &createEpoch, &lastUpdate, &item, &lastValue, &stableID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !t.match(lastValue) {
+			continue
+		}
+		phraseID := p.getItemID(item)
+		if t.orgPhrases != nil {
+			rearrangedID, ok := t.rearrangedIDs[phraseID]
+			if !ok {
+				continue
+			}
+			phraseID = rearrangedID
+		}
+
+		if _, ok := rankMap[phraseID]; !ok {
+			continue
+		}
+
+		unitTime := h.unitTime(lastUpdate)
+		if _, ok := h.counts[phraseID]; !ok {
+			h.counts[phraseID] = make(map[int64]int, 0)
+		}
+		h.counts[phraseID][unitTime] += itemCount
+		if first || unitTime < h.minTime {
+			h.minTime = unitTime
+		}
+		if first || unitTime > h.maxTime {
+			h.maxTime = unitTime
+		}
+		first = false
+	}
+	return h, nil
+}
+
+// unitTime returns the start of the time unit of epoch in the local time,
+// which is how the blocks are rotated by the frequency
+func (h *phraseHistory) unitTime(epoch int64) int64 {
+	tm := time.Unix(epoch, 0)
+	switch h.frequency {
+	case "hour":
+		return time.Date(tm.Year(), tm.Month(), tm.Day(), tm.Hour(), 0, 0, 0, time.Local).Unix()
+	default:
+		return time.Date(tm.Year(), tm.Month(), tm.Day(), 0, 0, 0, 0, time.Local).Unix()
+	}
+}
+
+// unitIndex returns the position of the time unit from minTime.
+// It is rounded as a day is not always 24 hours with the daylight saving time.
+func (h *phraseHistory) unitIndex(unitTime int64) int {
+	return int(math.Round(float64(unitTime-h.minTime) / float64(h.unitsecs)))
+}
+
+// series returns the counts of the phrase from minTime to maxTime
+func (h *phraseHistory) series(phraseID int) []float64 {
+	res := make([]float64, h.unitIndex(h.maxTime)+1)
+	for ep, cnt := range h.counts[phraseID] {
+		res[h.unitIndex(ep)] = float64(cnt)
+	}
+	return res
+}
+
+// ewma returns the exponentially weighted moving average and standard deviation
+func ewma(history []float64, alpha float64) (float64, float64) {
+	mean := history[0]
+	variance := 0.0
+	for _, x := range history[1:] {
+		diff := x - mean
+		incr := alpha * diff
+		mean += incr
+		variance = (1 - alpha) * (variance + diff*incr)
+	}
+	return mean, math.Sqrt(variance)
+}
+
+// seasonal returns the average and standard deviation of the counts
+// at the same position of the previous seasons
+func seasonal(history []float64, period int) (float64, float64) {
+	samples := make([]float64, 0)
+	for i := len(history) - period; i >= 0; i -= period {
+		samples = append(samples, history[i])
+	}
+	mean := 0.0
+	for _, x := range samples {
+		mean += x
+	}
+	mean /= float64(len(samples))
+	variance := 0.0
+	for _, x := range samples {
+		variance += (x - mean) * (x - mean)
+	}
+	variance /= float64(len(samples))
+	return mean, math.Sqrt(variance)
+}
+
+// seasonPeriod returns the number of time units in a season:
+// a day for hourly logs, a week for daily logs
+func (t *trans) seasonPeriod() int {
+	switch t.frequency {
+	case "minute":
+		return 60
+	case "hour":
+		return 24
+	default:
+		return 7
+	}
+}
+
+// detectSpikes compares the count of each phrase in the latest time unit
+// with the baseline calculated from the previous time units.
+func (t *trans) detectSpikes(termCountBorderRate float64, termCountBorder int,
+	minMatchRate, maxMatchRate float64,
+	zThreshold float64, baseline string) ([]spike, error) {
+	if baseline != cBaselineEWMA && baseline != cBaselineSeasonal {
+		return nil, fmt.Errorf("baseline must be %s or %s", cBaselineEWMA, cBaselineSeasonal)
+	}
+	if err := t.rearangePhrases(termCountBorderRate, termCountBorder,
+		minMatchRate, maxMatchRate); err != nil {
+		return nil, err
+	}
+
+	phraseRanks := t.phrases.biggestNItems(0)
+	rankMap := make(map[int]int)
+	for _, phraseID := range phraseRanks {
+		rankMap[phraseID] = t.phrases.getCount(phraseID)
+	}
+	h, err := t.getPhraseHistory(rankMap)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, nil
+	}
+
+	n := h.unitIndex(h.maxTime) + 1
+	minUnits := cMinSpikeHistory + 1
+	if baseline == cBaselineSeasonal {
+		minUnits = 2*t.seasonPeriod() + 1
+	}
+	if n < minUnits {
+		return nil, fmt.Errorf("%s baseline needs %d time units of history, but there are %d",
+			baseline, minUnits, n)
+	}
+
+	spikes := make([]spike, 0)
+	for _, phraseID := range phraseRanks {
+		text := t.phrases.getMember(phraseID)
+		if !t.match(text) {
+			continue
+		}
+		series := h.series(phraseID)
+		history := series[:n-1]
+		latest := series[n-1]
+
+		// new phrases are shown as rare ones in topN and detect
+		seen := false
+		for _, x := range history {
+			if x > 0 {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			continue
+		}
+
+		var mean, std float64
+		if baseline == cBaselineSeasonal {
+			mean, std = seasonal(history, t.seasonPeriod())
+		} else {
+			mean, std = ewma(history, cSpikeAlpha)
+		}
+		// counts of rare phrases vary at least like a Poisson distribution
+		sigma := math.Max(std, math.Sqrt(math.Max(mean, 1)))
+		z := (latest - mean) / sigma
+		if math.Abs(z) < zThreshold {
+			continue
+		}
+		spikes = append(spikes, spike{
+			phraseID: phraseID,
+			PhraseID: t.phrases.getStableID(phraseID),
+			Count:    int(latest),
+			Baseline: mean,
+			Z:        z,
+			Ratio:    (latest + 1) / (mean + 1),
+			Text:     text,
+		})
+	}
+	sort.Slice(spikes, func(i, j int) bool {
+		return math.Abs(spikes[i].Z) > math.Abs(spikes[j].Z)
+	})
+	return spikes, nil
+}
@@ -0,0 +1,181 @@
+package rarelogdetector
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	cTemplateParam = "<*>"
+)
+
+// one line of the Loghub style "_structured" file
+type structuredLine struct {
+	LineId        int      `json:"LineId"`
+	Timestamp     string   `json:"Timestamp"`
+	EventId       string   `json:"EventId"`
+	EventTemplate string   `json:"EventTemplate"`
+	ParameterList []string `json:"ParameterList"`
+}
+
+// one line of the Loghub style "_templates" file
+type structuredTemplate struct {
+	EventId       string `json:"EventId"`
+	EventTemplate string `json:"EventTemplate"`
+	Occurrences   int    `json:"Occurrences"`
+}
+
+// splitLine returns the timestamp and the message part of a log line
+// according to logFormat
+func (t *trans) splitLine(line string) (string, string) {
+	if t.timestampPos < 0 && t.messagePos < 0 {
+		return "", line
+	}
+	match := t.logFormatRe.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return "", line
+	}
+	timestamp := ""
+	if t.timestampPos >= 0 && len(match) > t.timestampPos {
+		timestamp = match[t.timestampPos]
+	}
+	if t.messagePos >= 0 && len(match) > t.messagePos {
+		line = match[t.messagePos]
+	}
+	return timestamp, line
+}
+
+// toTemplate converts a message to a template with "<*>" in the positions
+// of the phrase which are "*" and returns the words replaced as parameters.
+// The words are split by splitTerms, so that each token corresponds to
+// a position of the phrase, and the delimiters between them are kept.
+func (t *trans) toTemplate(message, phrasestr string) (string, []string) {
+	phraseWords := strings.Split(phrasestr, " ")
+	pos := 0
+	params := make([]string, 0)
+	var sb strings.Builder
+
+	offset := 0
+	for _, tw := range t.splitTerms(message) {
+		start := strings.Index(message[offset:], tw.orig)
+		if start < 0 {
+			continue
+		}
+		sb.WriteString(message[offset : offset+start])
+		offset += start + len(tw.orig)
+
+		isParam := false
+		switch tw.kind {
+		case cWordTerm, cWordKeyword:
+			isParam = pos < len(phraseWords) && phraseWords[pos] == "*"
+			pos++
+		case cWordAsterisk:
+			isParam = tw.reason == cReasonIgnoreword
+			pos++
+		default:
+			isParam = tw.reason == cReasonDigits || utils.IsInt(tw.word)
+		}
+
+		if isParam {
+			sb.WriteString(cTemplateParam)
+			params = append(params, tw.orig)
+		} else {
+			sb.WriteString(tw.orig)
+		}
+	}
+	sb.WriteString(message[offset:])
+	return sb.String(), params
+}
+
+func formatParameterList(params []string) string {
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		quoted[i] = "'" + strings.ReplaceAll(p, "'", "\\'") + "'"
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// structuredWriter writes "<prefix>_structured.<format>" line by line
+// and "<prefix>_templates.<format>" at close
+type structuredWriter struct {
+	format    string
+	prefix    string
+	file      *os.File
+	csvWriter *csv.Writer
+	encoder   *json.Encoder
+}
+
+func newStructuredWriter(prefix, format string) (*structuredWriter, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("output file prefix is required")
+	}
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("format must be csv or json")
+	}
+	sw := new(structuredWriter)
+	sw.format = format
+	sw.prefix = prefix
+
+	file, err := os.Create(fmt.Sprintf("%s_structured.%s", prefix, format))
+	if err != nil {
+		return nil, fmt.Errorf("error creating file: %w", err)
+	}
+	sw.file = file
+	if format == "csv" {
+		sw.csvWriter = csv.NewWriter(file)
+		sw.csvWriter.Write([]string{"LineId", "Timestamp", "EventId", "EventTemplate", "ParameterList"})
+	} else {
+		sw.encoder = json.NewEncoder(file)
+	}
+	return sw, nil
+}
+
+func (sw *structuredWriter) write(l structuredLine) error {
+	if sw.csvWriter != nil {
+		return sw.csvWriter.Write([]string{strconv.Itoa(l.LineId), l.Timestamp,
+			l.EventId, l.EventTemplate, formatParameterList(l.ParameterList)})
+	}
+	return sw.encoder.Encode(l)
+}
+
+func (sw *structuredWriter) close(templates []structuredTemplate) error {
+	if sw.csvWriter != nil {
+		sw.csvWriter.Flush()
+		if err := sw.csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+	if err := sw.file.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.Create(fmt.Sprintf("%s_templates.%s", sw.prefix, sw.format))
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer file.Close()
+	if sw.format == "csv" {
+		w := csv.NewWriter(file)
+		w.Write([]string{"EventId", "EventTemplate", "Occurrences"})
+		for _, tp := range templates {
+			w.Write([]string{tp.EventId, tp.EventTemplate, strconv.Itoa(tp.Occurrences)})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	encoder := json.NewEncoder(file)
+	for _, tp := range templates {
+		if err := encoder.Encode(tp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
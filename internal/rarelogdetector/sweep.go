@@ -0,0 +1,120 @@
+package rarelogdetector
+
+import (
+	"fmt"
+)
+
+// statistics of phrases grouped with a pair of parameters
+type sweepResult struct {
+	MinMatchRate        float64
+	TermCountBorderRate float64
+	TermCountBorder     int
+	Phrases             int
+	Singletons          int
+	BiggestShare        float64
+	Evaluation          *evaluation
+}
+
+// groupStats returns the number of items with counts, the number of items
+// appeared only once and the share of the biggest item in the total count
+func (i *items) groupStats() (int, int, float64) {
+	n := 0
+	singletons := 0
+	total := 0
+	biggest := 0
+	for _, cnt := range i.counts {
+		if cnt <= 0 {
+			continue
+		}
+		n++
+		if cnt == 1 {
+			singletons++
+		}
+		if cnt > biggest {
+			biggest = cnt
+		}
+		total += cnt
+	}
+	if total == 0 {
+		return n, singletons, 0
+	}
+	return n, singletons, float64(biggest) / float64(total)
+}
+
+// sweep re-clusters the current phrases with each pair of minMatchRate and
+// termCountBorderRate in the same way as rearangePhrases.
+// The phrases are always re-clustered from the phrases of the loaded model,
+// so a pair cannot split lines already grouped together in the model.
+// The state of the phrases is restored at the end.
+func (t *trans) sweep(minMatchRates, termCountBorderRates []float64,
+	maxMatchRate float64, l *labeledLines) ([]sweepResult, error) {
+	base := t.phrases
+	termCountBorder := t.termCountBorder
+	subjects := t.subjects
+	pt := t.pt
+	orgPhrases := t.orgPhrases
+	phraseSources := t.phraseSources
+	changedSources := t.changedSources
+	phraseScores := t.phraseScores
+	ptRegistered := t.ptRegistered
+	rearrangedIDs := t.rearrangedIDs
+	defer func() {
+		t.phrases = base
+		t.termCountBorder = termCountBorder
+		t.subjects = subjects
+		t.pt = pt
+		t.orgPhrases = orgPhrases
+		t.phraseSources = phraseSources
+		t.changedSources = changedSources
+		t.phraseScores = phraseScores
+		t.ptRegistered = ptRegistered
+		t.rearrangedIDs = rearrangedIDs
+	}()
+
+	results := make([]sweepResult, 0, len(minMatchRates)*len(termCountBorderRates))
+	for _, minMatchRate := range minMatchRates {
+		for _, rate := range termCountBorderRates {
+			t.phrases = base
+			t.orgPhrases = orgPhrases
+			t.rearrangedIDs = rearrangedIDs
+			// force re-clustering even if the border does not grow
+			t.termCountBorder = 0
+			if err := t.rearangePhrases(rate, 0, minMatchRate, maxMatchRate); err != nil {
+				return nil, err
+			}
+			r := sweepResult{
+				MinMatchRate:        minMatchRate,
+				TermCountBorderRate: rate,
+				TermCountBorder:     t.termCountBorder,
+			}
+			r.Phrases, r.Singletons, r.BiggestShare = t.phrases.groupStats()
+			if l != nil {
+				predicted, err := t.groupLines(l.contents, minMatchRate, maxMatchRate)
+				if err != nil {
+					return nil, err
+				}
+				r.Evaluation = evaluateGrouping(predicted, l.labels)
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func showSweepResults(results []sweepResult) {
+	withEval := len(results) > 0 && results[0].Evaluation != nil
+	fmt.Printf("minMatchRate,termCountBorderRate,termCountBorder,phrases,singletons,biggestShare")
+	if withEval {
+		fmt.Printf(",templates,expectedTemplates,groupingAccuracy,precision,recall,f1")
+	}
+	fmt.Println()
+	for _, r := range results {
+		fmt.Printf("%g,%g,%d,%d,%d,%f", r.MinMatchRate, r.TermCountBorderRate,
+			r.TermCountBorder, r.Phrases, r.Singletons, r.BiggestShare)
+		if e := r.Evaluation; e != nil {
+			fmt.Printf(",%d,%d,%f,%f,%f,%f", e.Templates, e.ExpectedTemplates,
+				e.GroupingAccuracy, e.Precision, e.Recall, e.F1)
+		}
+		fmt.Println()
+	}
+}
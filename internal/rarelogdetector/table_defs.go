@@ -7,7 +7,18 @@ var (
 			"minMatchRate", "maxMatchRate",
 			"termCountBorderRate", "termCountBorder",
 			"timestampLayout", "logFormat"},
-		"lastStatus": {"lastRowID", "lastFileEpoch", "lastFileRow"},
-		"items":      {"count", "createEpoch", "lastUpdate", "item", "lastValue"},
+		"lastStatus": {"lastRowID", "lastFileEpoch", "lastFileRow",
+			"termsLastIndex", "termsRowNo", "phrasesLastIndex", "phrasesRowNo"},
+		"items":         {"count", "createEpoch", "lastUpdate", "item", "lastValue", "stableID"},
+		"terms":         {"count", "createEpoch", "lastUpdate", "item", "lastValue"},
+		"phraseSources": {"phrase", "file", "row", "epoch"},
+		"acks":          {"phraseID", "phrase", "ackedAt", "expireAt", "comment"},
+		"annotations":   {"phraseID", "phrase", "label", "severity", "owner", "notes"},
+		"decay":         {"countHalfLife"},
+		"decayedCounts": {"item", "decayedCount", "decayEpoch", "createEpoch", "lastUpdate", "lastValue", "stableID"},
+		"valueSketches": {"phraseID", "pos", "zeros", "buckets"},
+		"phraseOrigins": {"phraseID", "origin", "count"},
+		"termBudget":    {"maxTerms"},
+		"dataVersion":   {"version"},
 	}
 )
@@ -0,0 +1,174 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"goRareLogDetector/pkg/utils"
+	"sort"
+	"time"
+)
+
+// layouts of date times accepted by ParseTimeArg
+var timeArgLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// TimeArg is a point of time given as a duration before the latest log
+// like 6h or 2d, or as a date time like "2024-10-01 08:00:00".
+// The zero value is the latest log.
+type TimeArg struct {
+	before time.Duration
+	epoch  int64
+}
+
+func ParseTimeArg(s string) (TimeArg, error) {
+	if s == "" {
+		return TimeArg{}, nil
+	}
+	if d, err := utils.ParseDuration(s); err == nil {
+		return TimeArg{before: d}, nil
+	}
+	for _, layout := range timeArgLayouts {
+		if dt, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return TimeArg{epoch: dt.Unix()}, nil
+		}
+	}
+	return TimeArg{}, fmt.Errorf("time must be a duration like 6h or a date time like 2006-01-02 15:04:05: %s", s)
+}
+
+func (ta TimeArg) epochFrom(latest int64) int64 {
+	if ta.epoch > 0 {
+		return ta.epoch
+	}
+	return latest - int64(ta.before.Seconds())
+}
+
+// a phrase first seen in the window of the timeline
+type timelinePhrase struct {
+	phraseID  int
+	PhraseID  string
+	FirstSeen int64
+	Count     int
+	Score     float64
+	Text      string
+}
+
+// a pair of phrases in a burst seen together more often than chance
+type cooccurrence struct {
+	PhraseID1 string
+	PhraseID2 string
+	Together  int
+	Lift      float64
+}
+
+// phrases which first appeared close together in time
+type burst struct {
+	Start         int64
+	End           int64
+	Phrases       []timelinePhrase
+	Cooccurrences []cooccurrence
+}
+
+// getTimelinePhrases returns the phrases first seen between from and to
+// in the order of the first seen time. Acked phrases are not included.
+func (t *trans) getTimelinePhrases(from, to int64,
+	termCountBorderRate float64, termCountBorder int,
+	minMatchRate, maxMatchRate float64) ([]timelinePhrase, error) {
+	if err := t.rearangePhrases(termCountBorderRate, termCountBorder,
+		minMatchRate, maxMatchRate); err != nil {
+		return nil, err
+	}
+
+	p := t.phrases
+	acked := t.ackedPhrases(t.latestUpdate)
+	annotations := t.phraseAnnotations()
+	res := make([]timelinePhrase, 0)
+	for phraseID, createEpoch := range p.createEpochs {
+		if createEpoch <= 0 || createEpoch < from || createEpoch > to {
+			continue
+		}
+		text := p.getMember(phraseID)
+		if acked[phraseID] || p.getCount(phraseID) <= 0 || !t.match(text) {
+			continue
+		}
+		score, _ := t.scorePhrase(phraseID, annotations[phraseID])
+		res = append(res, timelinePhrase{
+			phraseID:  phraseID,
+			PhraseID:  p.getStableID(phraseID),
+			FirstSeen: createEpoch,
+			Count:     p.getCount(phraseID),
+			Score:     score,
+			Text:      text,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].FirstSeen != res[j].FirstSeen {
+			return res[i].FirstSeen < res[j].FirstSeen
+		}
+		return res[i].PhraseID < res[j].PhraseID
+	})
+	return res, nil
+}
+
+// groupBursts splits the phrases into bursts where the first seen times
+// are not more than gap apart.
+// occurrences are the time bins of the size gap where each phrase was seen,
+// and nBins is the number of the bins in the window.
+// Two phrases co-occur in a bin if both are seen in it or its neighbours.
+// lift is the co-occurring bins divided by the ones expected by chance.
+func groupBursts(phrases []timelinePhrase, occurrences map[int]map[int64]bool,
+	nBins int64, gap int64) []burst {
+	bursts := make([]burst, 0)
+	for _, tp := range phrases {
+		n := len(bursts)
+		if n == 0 || tp.FirstSeen-bursts[n-1].End > gap {
+			bursts = append(bursts, burst{Start: tp.FirstSeen})
+			n++
+		}
+		bursts[n-1].End = tp.FirstSeen
+		bursts[n-1].Phrases = append(bursts[n-1].Phrases, tp)
+	}
+
+	for bi := range bursts {
+		b := &bursts[bi]
+		b.Cooccurrences = make([]cooccurrence, 0)
+		for i, tp1 := range b.Phrases {
+			bins1 := occurrences[tp1.phraseID]
+			for _, tp2 := range b.Phrases[i+1:] {
+				near2 := make(map[int64]bool)
+				for bin := range occurrences[tp2.phraseID] {
+					near2[bin-1] = true
+					near2[bin] = true
+					near2[bin+1] = true
+				}
+				together := 0
+				for bin := range bins1 {
+					if near2[bin] {
+						together++
+					}
+				}
+				if together == 0 {
+					continue
+				}
+				expected := float64(len(bins1)) * float64(len(near2)) / float64(nBins)
+				lift := float64(together) / expected
+				if lift <= 1 {
+					continue
+				}
+				b.Cooccurrences = append(b.Cooccurrences, cooccurrence{
+					PhraseID1: tp1.PhraseID,
+					PhraseID2: tp2.PhraseID,
+					Together:  together,
+					Lift:      lift,
+				})
+			}
+		}
+		sort.SliceStable(b.Cooccurrences, func(i, j int) bool {
+			return b.Cooccurrences[i].Lift > b.Cooccurrences[j].Lift
+		})
+	}
+	return bursts
+}
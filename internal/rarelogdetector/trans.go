@@ -20,12 +20,16 @@ type trans struct {
 	orgPhrases          *items
 	customPhrases       *items
 	phraseScores        map[int]float64
+	phraseTokens        map[string][]int // terms of the phrases used in phraseScores
+	snapshotTokens      map[string][]int // phraseTokens in the snapshot to load
+	dataDir             string
 	subjects            map[int]string
 	replacer            *strings.Replacer
 	logFormatRe         *regexp.Regexp
 	timestampLayout     string
 	timestampPos        int
 	messagePos          int
+	severityPos         int
 	blockSize           int
 	lastMessage         string
 	ptRegistered        bool
@@ -46,13 +50,40 @@ type trans struct {
 	keyTermIds          map[int]string
 	ignorewords         map[string]string
 	pt                  *phraseTree
+	phraseSources       map[int]sourcePos
+	changedSources      map[int]bool // phrases whose source is not saved yet
+	currSource          sourcePos
+	rearrangedIDs       map[int]int
+	acks                map[string]ack
+	annotations         map[string]PhraseAnnotation
+	annotatedPhrases    map[string]string
+	customAnnotations   map[string]PhraseAnnotation
+	scoring             *scoring
+	valueSketches       map[valueKey]*valueSketch
+	outlierK            float64
+	valueOutliers       []valueOutlier
+	phraseOrigins       map[string]map[string]int
+}
+
+// location in the original log file where a phrase was seen last.
+// epoch is the modification time of the file when it was read.
+type sourcePos struct {
+	file  string
+	row   int
+	epoch int64
 }
 
 type phraseScore struct {
-	phraseID int
-	Count    int
-	Score    float64
-	Text     string
+	phraseID   int
+	PhraseID   string
+	Count      int
+	Score      float64
+	Text       string
+	File       string
+	FileEpoch  int64
+	Row        int
+	Annotation PhraseAnnotation
+	Components scoreComponents
 }
 
 type phraseTree struct {
@@ -80,6 +111,7 @@ func newTrans(dataDir, logFormat, timestampLayout string,
 		return nil, err
 	}
 
+	t.dataDir = dataDir
 	t.terms = te
 	t.phrases = p
 	t.blockSize = blockSize
@@ -92,6 +124,16 @@ func newTrans(dataDir, logFormat, timestampLayout string,
 	t.minLineToDetect = 0
 	t.phraseScores = make(map[int]float64, 10000)
 	t.subjects = make(map[int]string, 0)
+	t.phraseSources = make(map[int]sourcePos, 10000)
+	t.changedSources = make(map[int]bool)
+	t.rearrangedIDs = make(map[int]int, 0)
+	t.acks = make(map[string]ack)
+	t.annotations = make(map[string]PhraseAnnotation)
+	t.annotatedPhrases = make(map[string]string)
+	t.customAnnotations = make(map[string]PhraseAnnotation)
+	t.scoring, _ = newScoring(DefaultScoringModel())
+	t.valueSketches = make(map[valueKey]*valueSketch)
+	t.phraseOrigins = make(map[string]map[string]int)
 	t.filterRe = filterRe
 	t.xFilterRe = xFilterRe
 	t.countByBlock = 0
@@ -104,6 +146,7 @@ func newTrans(dataDir, logFormat, timestampLayout string,
 	t.keyTermIds = make(map[int]string)
 	for _, word := range _keywords {
 		t.keywords[word] = ""
+		t.terms.pin(strings.ToLower(word))
 	}
 	for _, word := range _ignorewords {
 		t.ignorewords[word] = ""
@@ -163,12 +206,15 @@ func (t *trans) parseLogFormat(logFormat string) {
 	names := re.SubexpNames()
 	t.timestampPos = -1
 	t.messagePos = -1
+	t.severityPos = -1
 	for i, name := range names {
 		switch {
 		case name == "timestamp":
 			t.timestampPos = i
 		case name == "message":
 			t.messagePos = i
+		case name == "severity" || name == "level":
+			t.severityPos = i
 		}
 	}
 	t.logFormatRe = re
@@ -184,12 +230,21 @@ func (t *trans) close() {
 }
 
 func (t *trans) load() error {
+	s := t.readSnapshot()
+	if s != nil {
+		t.terms.snapshot = &s.Terms
+		t.phrases.snapshot = &s.Phrases
+	}
 	if err := t.terms.load(); err != nil {
 		return err
 	}
 	if err := t.phrases.load(); err != nil {
 		return err
 	}
+	// the terms of the phrases are kept if both the snapshots are used
+	if s != nil && t.terms.replayedBlocks >= 0 && t.phrases.replayedBlocks >= 0 {
+		t.snapshotTokens = s.PhraseTokens
+	}
 
 	if err := t.calcPhrasesScore(); err != nil {
 		return err
@@ -217,8 +272,17 @@ func (t *trans) calcPhrasesScore() error {
 	te := t.terms
 	p := *t.phrases
 	phraseScores := make(map[int]float64, 0)
+	phraseTokens := make(map[string][]int, len(p.memberMap))
+	cached := t.snapshotTokens
+	t.snapshotTokens = nil
 	for phraseID, line := range p.memberMap {
-		if tokens, _, err := t.toTermList(line, 0, false); err == nil {
+		tokens, ok := cached[line]
+		var err error
+		if !ok || !t.validTokens(tokens) {
+			tokens, _, err = t.toTermList(line, 0, false)
+		}
+		if err == nil {
+			phraseTokens[line] = tokens
 			//scores := make([]float64, len(tokens))
 			scores := make([]float64, 0)
 			for _, itemID := range tokens {
@@ -241,10 +305,22 @@ func (t *trans) calcPhrasesScore() error {
 		}
 	}
 	t.phraseScores = phraseScores
+	t.phraseTokens = phraseTokens
 
 	return nil
 }
 
+// validTokens returns false if a term of the tokens was evicted or
+// was out of the budget, so the phrase must be tokenized again
+func (t *trans) validTokens(tokens []int) bool {
+	for _, termID := range tokens {
+		if _, ok := t.terms.memberMap[termID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *trans) registerCustomPhrase(phrase string, addCount int,
 	createEpoch int64, lastUpdate int64, lastValue string) error {
 	cp := t.customPhrases
@@ -257,6 +333,11 @@ func (t *trans) registerCustomPhrase(phrase string, addCount int,
 	} else {
 		cID := cp.register(phrase, addCount, createEpoch, lastUpdate, lastValue, false)
 		cp.tokensMap[cID] = tokens
+		for _, termID := range tokens {
+			if termID >= 0 {
+				t.terms.pin(t.terms.getMember(termID))
+			}
+		}
 	}
 	return nil
 }
@@ -426,31 +507,49 @@ func (t *trans) registerSubject(phraseID int, line string, replaces map[string]s
 	return line
 }
 
-func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
-	addCnt int, minMatchRate, maxMatchRate float64, useCustomPhrase bool,
-	excludesMap map[string]string) (int, string) {
+// how toPhrase made the phrase from the tokens
+type phraseDecision struct {
+	phrase   []int
+	customID int // -1 if no custom phrase matched
+	minLen   int
+	maxLen   int
+	minCnt   int
+	pos      int      // where searchPt stopped
+	freqLen  int      // terms kept in the phrase
+	reasons  []string // why each token became "*", "" if kept
+	fallback string   // why the tokens are used as they are
+}
+
+// toPhrase replaces the rare terms in tokens with "*" using the phrase tree
+// and returns the terms of the phrase. Nothing is registered.
+func (t *trans) toPhrase(tokens []int, minMatchRate, maxMatchRate float64,
+	useCustomPhrase bool, excludesMap map[string]string) []int {
+	return t.decidePhrase(tokens, minMatchRate, maxMatchRate, useCustomPhrase, excludesMap).phrase
+}
+
+// decidePhrase makes the phrase of toPhrase and records the decisions
+func (t *trans) decidePhrase(tokens []int, minMatchRate, maxMatchRate float64,
+	useCustomPhrase bool, excludesMap map[string]string) *phraseDecision {
 	te := t.terms
 	n := len(tokens)
-	if excludesMap == nil {
-		excludesMap = make(map[string]string)
-	}
 
+	d := &phraseDecision{customID: -1, pos: -1, reasons: make([]string, n)}
 	phrase := make([]int, 0)
 	counts := make([]int, n)
 	for i, itemID := range tokens {
 		counts[i] = te.getCount(itemID)
 	}
 
-	cID := -1
 	if useCustomPhrase {
-		cID = t.searchCustomPhrase(tokens)
+		cID := t.searchCustomPhrase(tokens)
 		if cID > 0 {
 			//t.customPhrases.update(cID, addCnt, lastUpdate, lastValue, false)
 			phrase = t.customPhrases.tokensMap[cID]
+			d.customID = cID
 		}
 	}
 
-	if cID == -1 {
+	if d.customID == -1 {
 		maxLen := 0
 		minLen := 3
 		if n > 3 {
@@ -460,6 +559,7 @@ func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
 			maxLen = int(math.Floor(float64(n) * maxMatchRate))
 		}
 		minCnt, pos := t.searchPt(tokens, minLen, maxLen)
+		d.minLen, d.maxLen, d.minCnt, d.pos = minLen, maxLen, minCnt, pos
 
 		//lastToken := 0
 		if pos >= minLen {
@@ -467,14 +567,6 @@ func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
 			for i, count := range counts {
 				termID := tokens[i]
 
-				//if t.terms.memberMap[termID] == "call-id" {
-				//	print("")
-				//}
-
-				//if strings.Contains(t.terms.memberMap[termID], "ordinary@ims.mnc020.mcc440.3gppnetwork.o") {
-				//	print("")
-				//}
-
 				_, ok := t.keyTermIds[termID]
 				if ok || (count >= minCnt && count >= t.termCountBorder) {
 					phrase = append(phrase, termID)
@@ -488,18 +580,44 @@ func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
 					phrase = append(phrase, cAsteriskItemID)
 					if termID != cAsteriskItemID {
 						excludesMap[t.terms.getMember(termID)] = ""
+						if count < t.termCountBorder {
+							d.reasons[i] = cReasonTermCountBorder
+						} else {
+							d.reasons[i] = cReasonMinCnt
+						}
 					}
 				}
 			}
+			d.freqLen = freqlen
 			// avoid phrases like "* * * *"
 			if freqlen < minLen {
 				phrase = tokens
+				d.reasons = make([]string, n)
+				d.fallback = fmt.Sprintf("only %d terms are frequent, less than minLen", freqlen)
 			}
 		} else {
 			phrase = tokens
+			if pos < 0 {
+				d.fallback = "the phrase tree matched all tokens"
+			} else {
+				d.fallback = fmt.Sprintf("the phrase tree matched %d terms, less than minLen", pos)
+			}
 		}
 	}
 
+	d.phrase = phrase
+	return d
+}
+
+func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
+	addCnt int, minMatchRate, maxMatchRate float64, useCustomPhrase bool,
+	excludesMap map[string]string) (int, string) {
+	te := t.terms
+	if excludesMap == nil {
+		excludesMap = make(map[string]string)
+	}
+	phrase := t.toPhrase(tokens, minMatchRate, maxMatchRate, useCustomPhrase, excludesMap)
+
 	registerItem := false
 	if addCnt > 0 {
 		registerItem = true
@@ -519,6 +637,10 @@ func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
 	if lastValue != "" {
 		t.registerSubject(phraseID, lastValue, excludesMap)
 	}
+	if addCnt > 0 && t.currSource.file != "" && t.phraseSources[phraseID] != t.currSource {
+		t.phraseSources[phraseID] = t.currSource
+		t.changedSources[phraseID] = true
+	}
 
 	return phraseID, phrasestr
 }
@@ -526,88 +648,117 @@ func (t *trans) registerPhrase(tokens []int, lastUpdate int64, lastValue string,
 func (t *trans) toTermList(line string,
 	lastUpdate int64,
 	registerItem bool) ([]int, map[string]string, error) {
+	return t.registerTerms(t.splitTerms(line), lastUpdate, registerItem)
+}
+
+// splitTerms normalizes the words of the message and tells how each word
+// is used in the phrase and why. It does not change trans, so it is called
+// by the workers in parallel.
+func (t *trans) splitTerms(line string) []termWord {
 	line = t.replacer.Replace(line)
 	words := strings.Split(line, " ")
-	tokens := make([]int, 0)
-	excludesMap := make(map[string]string)
-	addCnt := 0
-	if registerItem {
-		addCnt = 1
-	}
-	termID := -1
+	res := make([]termWord, 0, len(words))
 
 	for _, w := range words {
 		if w == "" {
 			continue
 		}
-
-		//if strings.Contains(w, "ordinary@ims.mnc020.mcc440.3gppnetwork.o") {
-		//	print("")
-		//}
+		tw := termWord{orig: w}
 
 		if _, ok := t.ignorewords[w]; ok {
 			w = "*"
+			tw.reason = cReasonIgnoreword
 		}
 		_, keyOK := t.keywords[w]
 		if _, ok := enStopWords[w]; ok {
 			if !keyOK {
 				w = "*"
+				tw.reason = cReasonStopword
 			}
 		}
 
 		word := strings.ToLower(w)
 		lenw := len(word)
-		//if lenw > cMaxWordLen {
-		//	word = word[:cMaxWordLen]
-		//	lenw = cMaxWordLen
-		//}
 		//remove '.' in the end
 		if lenw > 1 && string(word[lenw-1]) == "." {
 			word = word[:lenw-1]
 		}
-
-		//if word == "call-id" {
-		//	print("")
-		//}
+		tw.word = word
 
 		if keyOK || len(word) > 2 {
-			if !keyOK && utils.IsInt(word) && len(word) > cMaxNumDigits {
-				excludesMap[word] = ""
-				continue
+			switch {
+			case !keyOK && utils.IsInt(word) && len(word) > cMaxNumDigits:
+				tw.kind = cWordExcluded
+				tw.reason = cReasonDigits
+			case keyOK:
+				tw.kind = cWordKeyword
+			default:
+				tw.kind = cWordTerm
 			}
-			termID = t.terms.register(word, addCnt, lastUpdate, lastUpdate, "", registerItem)
+		} else if word == "*" {
+			tw.kind = cWordAsterisk
+		} else {
+			tw.kind = cWordExcluded
+			tw.reason = cReasonShort
+		}
+		res = append(res, tw)
+	}
+	return res
+}
+
+// registerTerms converts the words split by splitTerms to term IDs
+func (t *trans) registerTerms(words []termWord,
+	lastUpdate int64,
+	registerItem bool) ([]int, map[string]string, error) {
+	tokens := make([]int, 0, len(words))
+	excludesMap := make(map[string]string)
+	addCnt := 0
+	if registerItem {
+		addCnt = 1
+	}
 
+	for _, tw := range words {
+		switch tw.kind {
+		case cWordTerm, cWordKeyword:
+			termID := t.terms.register(tw.word, addCnt, lastUpdate, lastUpdate, "", registerItem)
 			tokens = append(tokens, termID)
-			if keyOK {
+			if tw.kind == cWordKeyword {
 				t.keyTermIds[termID] = ""
 			}
-			//} else if word == "*" && len(tokens) > 1 && tokens[len(tokens)-1] != cAsteriskItemID {
-		} else if word == "*" {
+		case cWordAsterisk:
 			tokens = append(tokens, cAsteriskItemID)
-		} else {
-			excludesMap[word] = ""
+		default:
+			excludesMap[tw.word] = ""
 		}
 	}
 
 	return tokens, excludesMap, nil
 }
 
-/*
-stage: 1=registerTerm 2=registerPT 3=registerPhrase
-*/
-func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int,
-	minMatchRate, maxMatchRate float64, useCustomPhrases bool) (int, []int, string, error) {
+// registerTermCounts registers the terms summed by countTerms
+// in the same way as registerTerms does line by line.
+func (t *trans) registerTermCounts(terms []termCount) {
+	for _, tc := range terms {
+		termID := t.terms.register(tc.word, tc.count, tc.createEpoch, tc.lastUpdate, "", true)
+		if tc.keyword {
+			t.keyTermIds[termID] = ""
+		}
+	}
+}
+
+// parseLine parses the timestamp and the message of the line and splits
+// the message into words. It does not change trans, so lines are parsed
+// by the workers in parallel and registered by tokenizeParsed in order.
+func (t *trans) parseLine(line string, fileEpoch int64) *parsedLine {
 	var lastdt time.Time
 	var err error
-	phrasestr := ""
 
+	pl := &parsedLine{line: line, epoch: fileEpoch}
 	if !t.match(line) {
-		return -1, nil, "", nil
+		return pl
 	}
+	pl.matched = true
 
-	orgLine := line
-	phraseCnt := -1
-	retentionPos := 0
 	lastUpdate := fileEpoch
 	if t.timestampPos >= 0 || t.messagePos >= 0 {
 		match := t.logFormatRe.FindStringSubmatch(line)
@@ -616,11 +767,15 @@ func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int
 				lastdt, err = utils.Str2date(t.timestampLayout, match[t.timestampPos])
 				switch t.frequency {
 				case "hour":
-					retentionPos = lastdt.Year()*100000 + lastdt.YearDay()*100 + lastdt.Hour()
+					pl.retentionPos = lastdt.Year()*100000 + lastdt.YearDay()*100 + lastdt.Hour()
 				case "day":
-					retentionPos = lastdt.Year()*1000 + lastdt.YearDay()
+					pl.retentionPos = lastdt.Year()*1000 + lastdt.YearDay()
 				default:
-					retentionPos = 0
+					pl.retentionPos = 0
+				}
+				// same as lineEpoch
+				if err == nil && match[t.timestampPos] != "" {
+					pl.epoch = lastdt.Unix()
 				}
 			}
 			if err == nil {
@@ -633,6 +788,34 @@ func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int
 			}
 		}
 	}
+	pl.lastUpdate = lastUpdate
+	pl.message = line
+	pl.words = t.splitTerms(line)
+	pl.values = numericValues(line)
+	return pl
+}
+
+/*
+stage: 1=registerTerm 2=registerPT 3=registerPhrase
+*/
+func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int,
+	minMatchRate, maxMatchRate float64, useCustomPhrases bool) (int, []int, string, error) {
+	return t.tokenizeParsed(t.parseLine(line, fileEpoch), addCnt, stage,
+		minMatchRate, maxMatchRate, useCustomPhrases)
+}
+
+// tokenizeParsed registers the line parsed by parseLine in the stage
+func (t *trans) tokenizeParsed(pl *parsedLine, addCnt int, stage int,
+	minMatchRate, maxMatchRate float64, useCustomPhrases bool) (int, []int, string, error) {
+	phrasestr := ""
+
+	if !pl.matched {
+		return -1, nil, "", nil
+	}
+
+	phraseCnt := -1
+	retentionPos := pl.retentionPos
+	lastUpdate := pl.lastUpdate
 
 	if stage == cStageRegisterPhrases {
 		if t.phrases.DataDir != "" && !t.readOnly {
@@ -649,11 +832,16 @@ func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int
 		registerItem = true
 	}
 
-	t.lastMessage = line
+	t.lastMessage = pl.message
 
-	tokens, excludeMap, err := t.toTermList(line, lastUpdate, registerItem)
-	if err != nil {
-		return -1, nil, "", err
+	var tokens []int
+	var excludeMap map[string]string
+	var err error
+	if !pl.termsCounted {
+		tokens, excludeMap, err = t.registerTerms(pl.words, lastUpdate, registerItem)
+		if err != nil {
+			return -1, nil, "", err
+		}
 	}
 
 	t.countByBlock++
@@ -674,11 +862,11 @@ func (t *trans) tokenizeLine(line string, addCnt int, fileEpoch int64, stage int
 			return -1, nil, "", errors.New("phrase tree not registered")
 		}
 		phraseID := -1
-		phraseID, phrasestr = t.registerPhrase(tokens, lastUpdate, orgLine, addCnt, minMatchRate, maxMatchRate, useCustomPhrases, excludeMap)
+		phraseID, phrasestr = t.registerPhrase(tokens, lastUpdate, pl.line, addCnt, minMatchRate, maxMatchRate, useCustomPhrases, excludeMap)
 		phraseCnt = t.phrases.getCount(phraseID)
 	default:
 		phraseID := -1
-		phraseID, phrasestr = t.registerPhrase(tokens, lastUpdate, orgLine, 0, minMatchRate, maxMatchRate, useCustomPhrases, excludeMap)
+		phraseID, phrasestr = t.registerPhrase(tokens, lastUpdate, pl.line, 0, minMatchRate, maxMatchRate, useCustomPhrases, excludeMap)
 		phraseCnt = t.phrases.getCount(phraseID)
 	}
 
@@ -740,10 +928,15 @@ func (t *trans) getTopNScores(N, minCnt int, maxLastUpdate int64,
 
 	phraseScores := t.phraseScores
 	p := t.phrases
+	acked := t.ackedPhrases(time.Now().Unix())
+	annotations := t.phraseAnnotations()
 
 	var scores []phraseScore
 	var text string
-	for phraseID, score := range phraseScores {
+	for phraseID := range phraseScores {
+		if acked[phraseID] {
+			continue
+		}
 		if showLastText {
 			text = p.getLastValue(phraseID)
 		} else {
@@ -757,7 +950,11 @@ func (t *trans) getTopNScores(N, minCnt int, maxLastUpdate int64,
 		cnt := p.getCount(phraseID)
 		lastUpdate := p.getLastUpdate(phraseID)
 		if cnt <= minCnt && (maxLastUpdate == 0 || lastUpdate >= maxLastUpdate) {
-			scores = append(scores, phraseScore{phraseID, cnt, score, text})
+			src := t.phraseSources[phraseID]
+			an := annotations[phraseID]
+			score, components := t.scorePhrase(phraseID, an)
+			scores = append(scores, phraseScore{phraseID, p.getStableID(phraseID),
+				cnt, score, text, src.file, src.epoch, src.row, an, components})
 		}
 	}
 
@@ -820,6 +1017,24 @@ func (t *trans) OLDstr2Tokens(line string) []int {
 	return tokens
 }
 
+// findPhrase returns the phrase ID of a stable ID.
+// Stable IDs of the phrases before rearangePhrases are mapped to
+// the phrases they were re-clustered into, so that an ID shown with
+// different -R or -b still points to the phrase.
+func (t *trans) findPhrase(stableID string) int {
+	if phraseID := t.phrases.getItemIDByStableID(stableID); phraseID >= 0 {
+		return phraseID
+	}
+	if t.orgPhrases == nil {
+		return -1
+	}
+	orgID := t.orgPhrases.getItemIDByStableID(stableID)
+	if phraseID, ok := t.rearrangedIDs[orgID]; ok {
+		return phraseID
+	}
+	return -1
+}
+
 func (t *trans) rearangePhrases(termCountBorderRate float64, termCountBorder int,
 	minMatchRate, maxMatchRate float64) error {
 
@@ -846,8 +1061,14 @@ func (t *trans) rearangePhrases(termCountBorderRate float64, termCountBorder int
 		depth:      0,
 	}
 
+	prevOrgPhrases := t.orgPhrases
+	prevRearrangedIDs := t.rearrangedIDs
 	t.orgPhrases = t.phrases
 	t.phrases = p
+	orgSources := t.phraseSources
+	t.phraseSources = make(map[int]sourcePos, len(orgSources))
+	t.changedSources = make(map[int]bool)
+	t.rearrangedIDs = make(map[int]int, len(t.orgPhrases.memberMap))
 
 	t.resetCustomPhrases()
 
@@ -873,10 +1094,19 @@ func (t *trans) rearangePhrases(termCountBorderRate float64, termCountBorder int
 					return err
 				}
 			case cStageRegisterPhrases:
-				_, _, _, err := t.tokenizeLine(lastValue, cnt, lastUpdate, cStageRegisterPhrases, minMatchRate, maxMatchRate, true)
+				t.currSource = orgSources[phraseID]
+				_, _, phrasestr, err := t.tokenizeLine(lastValue, cnt, lastUpdate, cStageRegisterPhrases, minMatchRate, maxMatchRate, true)
+				t.currSource = sourcePos{}
 				if err != nil {
 					return err
 				}
+				rearrangedID := t.phrases.getItemID(phrasestr)
+				t.rearrangedIDs[phraseID] = rearrangedID
+				// the phrase was first seen with the first of the original phrases
+				createEpoch := t.orgPhrases.getCreateEpoch(phraseID)
+				if createEpoch > 0 && createEpoch < t.phrases.getCreateEpoch(rearrangedID) {
+					t.phrases.createEpochs[rearrangedID] = createEpoch
+				}
 
 				//t.registerPhrase(tokens, lastUpdate, lastValue, cnt, minMatchRate, maxMatchRate, true, excludeMap)
 				//_, phrasestr := t.registerPhrase(tokens, lastUpdate, lastValue, cnt, 0, 0)
@@ -892,6 +1122,18 @@ func (t *trans) rearangePhrases(termCountBorderRate float64, termCountBorder int
 		}
 	}
 
+	// keep mapping from the phrases of the model when rearranged again
+	if prevOrgPhrases != nil {
+		rearrangedIDs := make(map[int]int, len(prevRearrangedIDs))
+		for orgID, midID := range prevRearrangedIDs {
+			if phraseID, ok := t.rearrangedIDs[midID]; ok {
+				rearrangedIDs[orgID] = phraseID
+			}
+		}
+		t.rearrangedIDs = rearrangedIDs
+		t.orgPhrases = prevOrgPhrases
+	}
+
 	//t.orgPhrases = t.phrases
 	//t.phrases = p
 
@@ -936,19 +1178,26 @@ func (t *trans) outputPhrases(termCountBorderRate float64, termCountBorder int,
 	defer writer.Flush()
 
 	// Add the header row
-	header := []string{"Created", "Updated", "Count", "Member"}
+	header := []string{"Created", "Updated", "Count", "Member",
+		"Label", "Severity", "Owner", "Notes"}
 	if outfile == "" {
 		// Print header to stdout
-		fmt.Printf("%-15s %-15s %-10s %-30s\n", header[0], header[1], header[2], header[3])
-		fmt.Printf("%-15s %-15s %-10s %-30s\n",
+		fmt.Printf("%-15s %-15s %-10s %-30s %-15s %-10s %-15s %s\n", header[0], header[1], header[2], header[3],
+			header[4], header[5], header[6], header[7])
+		fmt.Printf("%-15s %-15s %-10s %-30s %-15s %-10s %-15s %s\n",
 			strings.Repeat("-", 15),
 			strings.Repeat("-", 15),
 			strings.Repeat("-", 10),
-			strings.Repeat("-", 30))
+			strings.Repeat("-", 30),
+			strings.Repeat("-", 15),
+			strings.Repeat("-", 10),
+			strings.Repeat("-", 15),
+			strings.Repeat("-", 15))
 	} else {
 		writer.Write(header)
 	}
 
+	annotations := t.phraseAnnotations()
 	format := "2006-01-02 15:04:05"
 	for _, phraseID := range phraseRanks {
 		line := t.phrases.memberMap[phraseID]
@@ -965,10 +1214,13 @@ func (t *trans) outputPhrases(termCountBorderRate float64, termCountBorder int,
 		row = append(row, strconv.Itoa(int(t.phrases.getCount(phraseID))))
 		//row = append(row, t.phrases.getMember(phraseID))
 		row = append(row, t.subjects[phraseID])
+		an := annotations[phraseID]
+		row = append(row, an.Label, an.Severity, an.Owner, an.Notes)
 
 		if outfile == "" {
 			// Pretty print each row to stdout
-			fmt.Printf("%-15s %-15s %-10s %-30s\n", row[0], row[1], row[2], row[3])
+			fmt.Printf("%-15s %-15s %-10s %-30s %-15s %-10s %-15s %s\n", row[0], row[1], row[2], row[3],
+				row[4], row[5], row[6], row[7])
 		} else {
 			writer.Write(row)
 		}
@@ -1024,7 +1276,8 @@ func (t *trans) outputPhrasesHistory(
 		var createEpoch int64
 		var lastUpdate int64
 		var lastValue string
-		err = rows.Scan(&itemCount, &createEpoch, &lastUpdate, &item, &lastValue)
+		var stableID string
+		err = rows.Scan(&itemCount, &createEpoch, &lastUpdate, &item, &lastValue, &stableID)
 		if err != nil {
 			return err
 		}
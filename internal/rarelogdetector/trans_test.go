@@ -1,7 +1,10 @@
 package rarelogdetector
 
 import (
+	"fmt"
 	"goRareLogDetector/pkg/utils"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -131,3 +134,154 @@ func Test_tokenizeLine_regex(t *testing.T) {
 	t.Logf("%s", phrasestr)
 
 }
+
+func Test_numericValues(t *testing.T) {
+	for _, tc := range []struct {
+		message string
+		values  string
+	}{
+		{"request took 5321 ms", "[5321]"},
+		{"latency=120ms size=1.5KB cpu 95%", "[120 1.5 95]"},
+		{"from 10.0.0.1 on 2024-10-01 id 3f2a9 done in 0.25s.", "[0.25]"},
+		{"retry (3) after 12:30", "[3 12 30]"},
+		{"no numbers here", "[]"},
+	} {
+		got := fmt.Sprintf("%v", numericValues(tc.message))
+		if err := utils.GetGotExpErr(tc.message, got, tc.values); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+}
+
+// parseBatches parses the lines of the log written by writeFeedLog in batches like readLines
+func parseBatches(tr *trans, logPath string) ([][]readLine, error) {
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	batches := make([][]readLine, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if len(batches) == 0 || len(batches[len(batches)-1]) >= cFeedBatchSize {
+			batches = append(batches, make([]readLine, 0, cFeedBatchSize))
+		}
+		n := len(batches) - 1
+		batches[n] = append(batches[n], readLine{text: line, parsed: tr.parseLine(line, 0)})
+	}
+	return batches, nil
+}
+
+func Test_registerTermCounts(t *testing.T) {
+	testDir, err := utils.InitTestDir("Test_registerTermCounts")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	logPath := testDir + "/terms.log"
+	if err := writeFeedLog(logPath, 0, 3000); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	pattern := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	dateFormat := "2006-01-02 15:04:05"
+
+	// the terms registered by the batches must be the same as line by line
+	trs := make([]*trans, 2)
+	for n := range trs {
+		trs[n], err = newTrans("", pattern, dateFormat, 0, 1000, 0, "", 0, nil, nil,
+			[]string{"reset"}, nil, nil, false, false)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		batches, err := parseBatches(trs[n], logPath)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		for _, lines := range batches {
+			if n == 1 {
+				terms := countTerms(lines)
+				if terms == nil {
+					t.Errorf("terms are not counted")
+					return
+				}
+				trs[n].registerTermCounts(terms)
+			}
+			for _, rl := range lines {
+				if _, _, _, err := trs[n].tokenizeParsed(rl.parsed, 1, cStageRegisterTerms, 0, 0, false); err != nil {
+					t.Errorf("%v", err)
+					return
+				}
+			}
+		}
+	}
+	byLine, byBatch := trs[0], trs[1]
+	if err := diffStates("terms", itemsState(byBatch.terms), itemsState(byLine.terms)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for term, termID := range byLine.terms.members {
+		if err := utils.GetGotExpErr("term ID of "+term, byBatch.terms.members[term], termID); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+	if err := utils.GetGotExpErr("keywords", fmt.Sprintf("%v", byBatch.keyTermIds),
+		fmt.Sprintf("%v", byLine.keyTermIds)); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("lines", byBatch.totalLines, byLine.totalLines); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// lines without timestamps are registered line by line
+	lines := []readLine{{parsed: byLine.parseLine("connection reset by peer", 0)}}
+	if terms := countTerms(lines); terms != nil {
+		t.Errorf("terms of a line without timestamp are counted")
+		return
+	}
+}
+
+func Benchmark_registerTermCounts(b *testing.B) {
+	testDir, err := utils.InitTestDir("Benchmark_registerTermCounts")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	logPath := testDir + "/terms.log"
+	if err := writeFeedLog(logPath, 0, 20000); err != nil {
+		b.Fatalf("%v", err)
+	}
+	pattern := `^(?P<timestamp>\d+-\d+-\d+ \d+:\d+:\d+) (?P<message>.+)$`
+	dateFormat := "2006-01-02 15:04:05"
+
+	// "line" is how the terms were registered before the batches
+	for _, mode := range []string{"line", "batch"} {
+		b.Run(mode, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tr, err := newTrans("", pattern, dateFormat, 0, 1000, 0, "", 0, nil, nil, nil, nil, nil, false, false)
+				if err != nil {
+					b.Fatalf("%v", err)
+				}
+				batches, err := parseBatches(tr, logPath)
+				if err != nil {
+					b.Fatalf("%v", err)
+				}
+				b.StartTimer()
+				for _, lines := range batches {
+					if mode == "batch" {
+						tr.registerTermCounts(countTerms(lines))
+					}
+					for _, rl := range lines {
+						if _, _, _, err := tr.tokenizeParsed(rl.parsed, 1, cStageRegisterTerms, 0, 0, false); err != nil {
+							b.Fatalf("%v", err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package rarelogdetector
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Numbers in lines of a phrase like "took 5321 ms" are measured values.
+// The distribution of the values at each position of each phrase is kept
+// in a sketch with buckets of log scale, and a value out of
+// [p0.1 / k, p99.9 * k] of the values seen before is an outlier.
+
+// the position of a number in the lines of a phrase
+type valueKey struct {
+	phraseID string // stable ID
+	pos      int
+}
+
+// valueSketch counts values in buckets whose bounds grow by
+// (1 + cSketchAccuracy) / (1 - cSketchAccuracy),
+// so that quantiles have relative errors less than cSketchAccuracy.
+type valueSketch struct {
+	count   int
+	zeros   int
+	buckets map[int]int
+	indexes []int // sorted keys of buckets
+}
+
+// a line with a value far from the ones of the phrase
+type valueOutlier struct {
+	PhraseID  string
+	Pos       int
+	Value     float64
+	Low       float64
+	High      float64
+	Epoch     int64
+	Text      string
+	Line      string
+	File      string
+	FileEpoch int64
+	Row       int
+}
+
+var sketchLogGamma = math.Log((1 + cSketchAccuracy) / (1 - cSketchAccuracy))
+
+func newValueSketch() *valueSketch {
+	return &valueSketch{buckets: make(map[int]int)}
+}
+
+func (s *valueSketch) addCount(idx, cnt int) {
+	if _, ok := s.buckets[idx]; !ok {
+		pos := sort.SearchInts(s.indexes, idx)
+		s.indexes = append(s.indexes, 0)
+		copy(s.indexes[pos+1:], s.indexes[pos:])
+		s.indexes[pos] = idx
+	}
+	s.buckets[idx] += cnt
+	s.count += cnt
+}
+
+func (s *valueSketch) add(v float64) {
+	if v < cMinSketchValue {
+		s.zeros++
+		s.count++
+		return
+	}
+	s.addCount(int(math.Ceil(math.Log(v)/sketchLogGamma)), 1)
+}
+
+// quantile returns the value at q (0-1) in the middle of its bucket
+func (s *valueSketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := int(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+	cum := s.zeros
+	for _, idx := range s.indexes {
+		cum += s.buckets[idx]
+		if cum > rank {
+			return 2 * math.Exp(float64(idx)*sketchLogGamma) / (math.Exp(sketchLogGamma) + 1)
+		}
+	}
+	return 0
+}
+
+// bounds returns the range of the values which are not outliers
+func (s *valueSketch) bounds(k float64) (float64, float64) {
+	return s.quantile(cLowValueQuantile) / k, s.quantile(cHighValueQuantile) * k
+}
+
+// String encodes the buckets like "-3:1 12:40 13:2"
+func (s *valueSketch) String() string {
+	parts := make([]string, len(s.indexes))
+	for i, idx := range s.indexes {
+		parts[i] = fmt.Sprintf("%d:%d", idx, s.buckets[idx])
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseValueSketch(zeros int, buckets string) (*valueSketch, error) {
+	s := newValueSketch()
+	s.zeros = zeros
+	s.count = zeros
+	for _, part := range strings.Fields(buckets) {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid bucket of value sketch: %s", part)
+		}
+		idx, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		cnt, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		s.addCount(idx, cnt)
+	}
+	return s, nil
+}
+
+func isValueDelim(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`=:,;()[]{}"'<>|`, r)
+}
+
+// numericValues returns the numbers in the message like 5321, 0.25, 120ms or 95%.
+// Words like IP addresses, dates or IDs are not numbers.
+func numericValues(message string) []float64 {
+	values := make([]float64, 0)
+	for _, w := range strings.FieldsFunc(message, isValueDelim) {
+		if w[0] < '0' || w[0] > '9' {
+			continue
+		}
+		w = strings.TrimSuffix(w, ".")
+		end := 0
+		dots := 0
+		for end < len(w) && (w[end] >= '0' && w[end] <= '9' || w[end] == '.') {
+			if w[end] == '.' {
+				dots++
+			}
+			end++
+		}
+		if dots > 1 || w[end-1] == '.' {
+			continue
+		}
+		// a unit like ms, KB or %
+		unit := w[end:]
+		if len(unit) > cMaxValueUnitLen || strings.IndexFunc(unit, func(r rune) bool {
+			return !unicode.IsLetter(r) && r != '%'
+		}) >= 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(w[:end], 64)
+		if err != nil {
+			continue
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// observeValues checks the numbers in the line of the phrase with the values
+// seen before and adds them to the sketches.
+// The numbers are found by parseLine apart from the terms,
+// so they do not change the phrase.
+// Outliers are kept only if outlierK is set.
+func (t *trans) observeValues(pl *parsedLine, phrasestr string) {
+	phraseID := t.phrases.getItemID(phrasestr)
+	if phraseID < 0 {
+		return
+	}
+	stableID := t.phrases.getStableID(phraseID)
+	for pos, v := range pl.values {
+		key := valueKey{stableID, pos}
+		s, ok := t.valueSketches[key]
+		if !ok {
+			s = newValueSketch()
+			t.valueSketches[key] = s
+		}
+		if t.outlierK > 0 && s.count >= cMinValueSamples {
+			low, high := s.bounds(t.outlierK)
+			if v < low || v > high {
+				t.valueOutliers = append(t.valueOutliers, valueOutlier{
+					PhraseID:  stableID,
+					Pos:       pos,
+					Value:     v,
+					Low:       low,
+					High:      high,
+					Epoch:     pl.epoch,
+					Text:      phrasestr,
+					Line:      pl.line,
+					File:      t.currSource.file,
+					FileEpoch: t.currSource.epoch,
+					Row:       t.currSource.row,
+				})
+			}
+		}
+		s.add(v)
+	}
+}
+
+func (a *Analyzer) saveValueSketches() error {
+	if a.dataDir == "" || a.readOnly {
+		return nil
+	}
+	if err := a.valueSketchesTable.Truncate(); err != nil {
+		return err
+	}
+	for key, s := range a.trans.valueSketches {
+		if err := a.valueSketchesTable.InsertRow(nil,
+			key.phraseID, key.pos, s.zeros, s.String()); err != nil {
+			return err
+		}
+	}
+	return a.valueSketchesTable.Flush()
+}
+
+func (a *Analyzer) loadValueSketches() error {
+	rows, err := a.valueSketchesTable.SelectRows(nil, tableDefs["valueSketches"])
+	if err != nil {
+		return err
+	}
+	if rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		var key valueKey
+		var zeros int
+		var buckets string
+		if err := rows.Scan(&key.phraseID, &key.pos, &zeros, &buckets); err != nil {
+			return err
+		}
+		s, err := parseValueSketch(zeros, buckets)
+		if err != nil {
+			return err
+		}
+		a.trans.valueSketches[key] = s
+	}
+	return nil
+}
+
+// Outliers shows the lines with numbers far outside the distribution of
+// the numbers at the same position of the same phrase seen before,
+// which is below p0.1 / k or above p99.9 * k.
+// The distributions are kept in the data directory.
+func (a *Analyzer) Outliers(k float64) ([]valueOutlier, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("k must be 1 or more")
+	}
+	a.trans.outlierK = k
+	a.trans.valueOutliers = make([]valueOutlier, 0)
+	if err := a.Feed(0); err != nil {
+		return nil, err
+	}
+	return a.trans.valueOutliers, nil
+}
+
+func (a *Analyzer) OutliersShow(k float64, contextLines int) error {
+	outliers, err := a.Outliers(k)
+	if err != nil {
+		return err
+	}
+	format := "2006-01-02 15:04:05"
+	for _, o := range outliers {
+		fmt.Printf("%s,%s,%d,%g,%g,%g,%s\n", time.Unix(o.Epoch, 0).Format(format),
+			o.PhraseID, o.Pos, o.Value, o.Low, o.High, o.Line)
+		if err := showContext(o.File, o.FileEpoch, o.Row, contextLines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
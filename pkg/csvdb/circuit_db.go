@@ -3,6 +3,7 @@ package csvdb
 import (
 	"fmt"
 	"goRareLogDetector/pkg/utils"
+	"os"
 	"strconv"
 
 	"github.com/pkg/errors"
@@ -101,6 +102,11 @@ func (cdb *CircuitDB) LoadCircuitDBStatus() error {
 	var completed bool
 
 	t := cdb.statusTable
+	if t.Count(nil) <= 0 {
+		// rows of the first block appended before its status was committed
+		_, err := cdb.currTable.truncateRows(0)
+		return err
+	}
 	if err := t.Max(nil, "lastIndex", &lastIndex); err != nil {
 		return errors.WithStack(err)
 	}
@@ -116,8 +122,7 @@ func (cdb *CircuitDB) LoadCircuitDBStatus() error {
 	cdb.blockNo = blockNo
 	cdb.lastIndex = lastIndex
 	cdb.lastEpoch = lastEpoch
-	//cdb.RowNo = RowNo // no need to load RowNo because it will be incremented when inserting rows
-	cdb.RowNo = 0
+	cdb.RowNo = RowNo
 	cdb.writeMode = CWriteModeAppend
 
 	if completed {
@@ -126,15 +131,89 @@ func (cdb *CircuitDB) LoadCircuitDBStatus() error {
 		}
 	}
 
-	t, err := cdb.GetBlockTable(cdb.blockNo)
+	bt, err := cdb.GetBlockTable(cdb.blockNo)
 	if err != nil {
 		return err
 	}
-	cdb.currTable = t
+	cdb.currTable = bt
+
+	if !completed {
+		// rows appended after the status was committed are rolled back
+		n, err := bt.truncateRows(RowNo)
+		if err != nil {
+			return err
+		}
+		cdb.RowNo = n
+	}
 
 	return nil
 }
 
+// Rollback removes the rows committed to the blocks after the position
+// given by lastIndex and rowNo of the current block, which is saved with
+// the other tables of the caller. It is called before LoadCircuitDBStatus
+// in case the process stopped after committing the blocks but before the
+// other tables. It returns false if the blocks are not rolled back.
+func (cdb *CircuitDB) Rollback(lastIndex int64, rowNo int) (bool, error) {
+	if cdb.DataDir == "" {
+		return false, nil
+	}
+	statuses, err := cdb.BlockStatuses()
+	if err != nil {
+		return false, err
+	}
+	var target *BlockStatus
+	newBlockNos := make([]int, 0)
+	for i, bs := range statuses {
+		if bs.LastIndex == lastIndex {
+			target = &statuses[i]
+		} else if bs.LastIndex > lastIndex {
+			newBlockNos = append(newBlockNos, bs.BlockNo)
+		}
+	}
+	// the block of the position was reused
+	if target == nil {
+		return false, nil
+	}
+	if len(newBlockNos) == 0 && target.RowNo == rowNo {
+		return false, nil
+	}
+
+	// blocks not in the status table are not loaded
+	if err := cdb.statusTable.Delete(func(v []string) bool {
+		return utils.StringToInt64(v[ColIndex]) > lastIndex
+	}); err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, blockNo := range newBlockNos {
+		t, err := cdb.GetBlockTable(blockNo)
+		if err != nil {
+			return false, err
+		}
+		if err := t.Delete(nil); err != nil {
+			return false, errors.WithStack(err)
+		}
+	}
+
+	t, err := cdb.GetBlockTable(target.BlockNo)
+	if err != nil {
+		return false, err
+	}
+	if _, err := t.truncateRows(rowNo); err != nil {
+		return false, err
+	}
+	blockNoStr := strconv.Itoa(target.BlockNo)
+	if err := cdb.statusTable.Update(func(v []string) bool {
+		return v[ColBlockNo] == blockNoStr
+	}, map[string]interface{}{
+		"rowNo":     rowNo,
+		"completed": false,
+	}); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
 func (cdb *CircuitDB) NextBlock(lastEpoch int64) error {
 	cdb.lastEpoch = lastEpoch
 
@@ -180,11 +259,9 @@ func (cdb *CircuitDB) InsertRow(columns []string, row ...interface{}) error {
 		return nil
 	}
 	if cdb.writeMode == CWriteModeWrite {
-		if err := cdb.currTable.Delete(nil); err != nil {
-			return errors.WithStack(err)
+		if err := cdb.resetCurrentBlock(); err != nil {
+			return err
 		}
-		cdb.writeMode = CWriteModeAppend
-		cdb.RowNo = 0
 	}
 
 	if err := cdb.currTable.InsertRow(columns, row...); err != nil {
@@ -195,6 +272,24 @@ func (cdb *CircuitDB) InsertRow(columns []string, row ...interface{}) error {
 	return nil
 }
 
+// resetCurrentBlock empties the block reused after NextBlock.
+// The status of the block is deleted before the block, so the old rows
+// are not loaded again if the process stops before the block is committed.
+func (cdb *CircuitDB) resetCurrentBlock() error {
+	blockNoStr := strconv.Itoa(cdb.blockNo)
+	if err := cdb.statusTable.Delete(func(v []string) bool {
+		return v[ColBlockNo] == blockNoStr
+	}); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := cdb.currTable.Delete(nil); err != nil {
+		return errors.WithStack(err)
+	}
+	cdb.writeMode = CWriteModeAppend
+	cdb.RowNo = 0
+	return nil
+}
+
 func (cdb *CircuitDB) deleteOldBlocks() error {
 	if cdb.DataDir == "" {
 		return nil
@@ -218,11 +313,21 @@ func (cdb *CircuitDB) deleteOldBlocks() error {
 		return err
 	}
 
+	blockNos := make([]int, 0)
 	var blockNo int
 	for rows.Next() {
 		if err := rows.Scan(&blockNo); err != nil {
 			return err
 		}
+		blockNos = append(blockNos, blockNo)
+	}
+
+	// blocks not in the status table are not loaded
+	if err := cdb.statusTable.Delete(selectOldBlocks); err != nil {
+		return err
+	}
+
+	for _, blockNo := range blockNos {
 		if t, err := cdb.GetBlockTable(blockNo); err != nil {
 			return err
 		} else {
@@ -232,10 +337,6 @@ func (cdb *CircuitDB) deleteOldBlocks() error {
 		}
 	}
 
-	if err := cdb.statusTable.Delete(selectOldBlocks); err != nil {
-		return err
-	}
-
 	return nil
 }
 
@@ -243,6 +344,12 @@ func (cdb *CircuitDB) UpdateBlockStatus(completed bool) error {
 	if cdb.DataDir == "" {
 		return nil
 	}
+	// the block is written before its status
+	if cdb.writeMode == CWriteModeWrite {
+		if err := cdb.resetCurrentBlock(); err != nil {
+			return err
+		}
+	}
 	blockID := cdb.getBlockTableName(cdb.blockNo)
 
 	if err := cdb.statusTable.Upsert(func(v []string) bool {
@@ -311,6 +418,52 @@ func (cdb *CircuitDB) Select1RowFromStatusTable(conditionCheckFunc func([]string
 	return cdb.statusTable.Select1Row(conditionCheckFunc, colNames, args...)
 }
 
+// BlockStatus is a row of the status table of a block
+type BlockStatus struct {
+	LastIndex int64
+	BlockNo   int
+	RowNo     int
+	LastEpoch int64
+	Completed bool
+	Size      int64 // size of the block file
+	ModTime   int64 // modification time of the block file in nanoseconds
+}
+
+// CurrentBlock returns the block rows are inserted to
+func (cdb *CircuitDB) CurrentBlock() (int, int64) {
+	return cdb.blockNo, cdb.lastIndex
+}
+
+// BlockStatuses returns the status of the blocks in the status table
+func (cdb *CircuitDB) BlockStatuses() ([]BlockStatus, error) {
+	if cdb.DataDir == "" || cdb.statusTable.Count(nil) <= 0 {
+		return nil, nil
+	}
+	rows, err := cdb.statusTable.SelectRows(nil,
+		[]string{"lastIndex", "blockNo", "rowNo", "lastEpoch", "completed"})
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		return nil, nil
+	}
+	res := make([]BlockStatus, 0)
+	for rows.Next() {
+		var bs BlockStatus
+		if err := rows.Scan(&bs.LastIndex, &bs.BlockNo, &bs.RowNo,
+			&bs.LastEpoch, &bs.Completed); err != nil {
+			return nil, err
+		}
+		path := cdb.Groups[cdb.Name].getTablePath(cdb.getBlockTableName(bs.BlockNo))
+		if fi, err := os.Stat(path); err == nil {
+			bs.Size = fi.Size()
+			bs.ModTime = fi.ModTime().UnixNano()
+		}
+		res = append(res, bs)
+	}
+	return res, nil
+}
+
 func (cdb *CircuitDB) getBlockNos() ([]int, error) {
 	cnt := cdb.statusTable.Count(nil)
 	if cnt <= 0 {
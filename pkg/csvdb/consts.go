@@ -4,6 +4,7 @@ const (
 	cRModePlain       = "plain"
 	cRModeGZip        = "gzip"
 	cTblIniExt        = "tbl.ini"
+	cTmpExt           = ".tmp"
 	cDefaultBuffSize  = 10000
 	CWriteModeAppend  = "a"
 	CWriteModeWrite   = "w"
@@ -86,6 +86,8 @@ func (c *Reader) open() error {
 		r = csv.NewReader(fr)
 		mode = cRModePlain
 	}
+	// rows written before columns were added to the table have less fields
+	r.FieldsPerRecord = -1
 
 	c.fr = fr
 	c.zr = zr
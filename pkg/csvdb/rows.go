@@ -95,7 +95,7 @@ func (r *Rows) Scan(args ...interface{}) error {
 				len(args), len(r.tableCols)))
 		}
 		for i, _ := range r.tableCols {
-			src := v[i]
+			src := columnValue(v, i)
 			dst := args[i]
 			if err := convFromString(src, dst); err != nil {
 				return err
@@ -107,7 +107,7 @@ func (r *Rows) Scan(args ...interface{}) error {
 				len(args), len(r.selectedColIndexes)))
 		}
 		for argidx, colidx := range r.selectedColIndexes {
-			src := v[colidx]
+			src := columnValue(v, colidx)
 			dst := args[argidx]
 			if err := convFromString(src, dst); err != nil {
 				return err
@@ -117,6 +117,15 @@ func (r *Rows) Scan(args ...interface{}) error {
 	return nil
 }
 
+// columnValue returns "" for columns added to the table
+// after the row was written
+func columnValue(v []string, i int) string {
+	if i >= len(v) {
+		return ""
+	}
+	return v[i]
+}
+
 /*
 fieldTypes:
 int, int8, int32, int64,
@@ -249,8 +249,7 @@ func (t *Table) flush(wmode string) error {
 		}
 	}
 	t.iBuff.init()
-	writer.flush()
-	return nil
+	return writer.commit()
 }
 
 func (t *Table) openW(writeMode string) (*Writer, error) {
@@ -333,11 +332,53 @@ func (t *Table) Truncate() error {
 			return err
 		}
 		defer writer.close()
-		writer.flush()
+		if err := writer.commit(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// truncateRows keeps the first n rows and returns the number of rows kept.
+// The rows after them were appended by a process stopped before committing.
+func (t *Table) truncateRows(n int) (int, error) {
+	reader, err := newReader(t.path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.close()
+	rows := make([][]string, 0, n)
+	for len(rows) < n && reader.next() {
+		rows = append(rows, reader.values)
+	}
+	if len(rows) < n {
+		if reader.err != io.EOF {
+			return len(rows), reader.err
+		}
+		return len(rows), nil
+	}
+	if !reader.next() && reader.err == io.EOF {
+		return n, nil
+	}
+	reader.close()
+
+	buff := newInsertBuffer(len(rows))
+	buff.setBuff(rows)
+	t.iBuff = buff
+	err = t.flush(CWriteModeWrite)
+	t.iBuff = newInsertBuffer(t.bufferSize)
+	if err != nil {
+		return 0, err
+	}
+	if t.reader.readBuff != nil {
+		t.reader.readBuff.init()
+		for _, row := range rows {
+			t.reader.readBuff.append(row)
+		}
+	}
+	return n, nil
+}
+
 func (t *Table) update(conditionCheckFunc func([]string) bool,
 	updates map[string]interface{}, isUpsert bool) error {
 	if conditionCheckFunc == nil && updates == nil {
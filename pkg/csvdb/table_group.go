@@ -3,6 +3,7 @@ package csvdb
 import (
 	"fmt"
 	"goRareLogDetector/pkg/utils"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -134,15 +135,17 @@ func (g *TableGroup) save() error {
 		i++
 	}
 
-	file, err := os.OpenFile(g.iniFile, os.O_CREATE, 0640)
-	if err != nil {
-		return errors.WithStack(err)
+	cfg := ini.Empty()
+	if utils.PathExist(g.iniFile) {
+		var err error
+		cfg, err = ini.Load(g.iniFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 	}
-	defer file.Close()
-
-	cfg, err := ini.Load(g.iniFile)
-	if err != nil {
-		return errors.WithStack(err)
+	// not to touch the data directory when only reading existing tables
+	if g.savedAs(cfg, tableNames) {
+		return nil
 	}
 	cfg.Section("conf").Key("groupName").SetValue(g.groupName)
 	cfg.Section("conf").Key("columns").SetValue(strings.Join(g.columns, ","))
@@ -151,8 +154,8 @@ func (g *TableGroup) save() error {
 	cfg.Section("conf").Key("bufferSize").SetValue(strconv.Itoa(g.bufferSize))
 	cfg.Section("conf").Key("readBufferSize").SetValue(strconv.Itoa(g.readBufferSize))
 
-	if err := cfg.SaveTo(g.iniFile); err != nil {
-		return errors.WithStack(err)
+	if err := saveIniFile(cfg, g.iniFile); err != nil {
+		return err
 	}
 
 	if _, err := os.Stat(g.dataDir); os.IsNotExist(err) {
@@ -163,6 +166,37 @@ func (g *TableGroup) save() error {
 	return nil
 }
 
+// saveIniFile writes the ini file through a temporary file like Writer
+func saveIniFile(cfg *ini.File, iniFile string) error {
+	return WriteFile(iniFile, 0640, func(w io.Writer) error {
+		_, err := cfg.WriteTo(w)
+		return err
+	})
+}
+
+// savedAs tells if the ini file already has the conf of the group
+// and all of its tables
+func (g *TableGroup) savedAs(cfg *ini.File, tableNames []string) bool {
+	conf := cfg.Section("conf")
+	if conf.Key("groupName").String() != g.groupName ||
+		conf.Key("columns").String() != strings.Join(g.columns, ",") ||
+		conf.Key("useGzip").String() != strconv.FormatBool(g.useGzip) ||
+		conf.Key("bufferSize").String() != strconv.Itoa(g.bufferSize) ||
+		conf.Key("readBufferSize").String() != strconv.Itoa(g.readBufferSize) {
+		return false
+	}
+	saved := make(map[string]bool)
+	for _, tableName := range strings.Split(conf.Key("tableNames").String(), ",") {
+		saved[tableName] = true
+	}
+	for _, tableName := range tableNames {
+		if !saved[tableName] {
+			return false
+		}
+	}
+	return true
+}
+
 func (g *TableGroup) DropTable(tableName string) error {
 	t, err := g.GetTable(tableName)
 	if err != nil {
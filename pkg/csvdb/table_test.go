@@ -3,7 +3,10 @@ package csvdb
 import (
 	"fmt"
 	"goRareLogDetector/pkg/utils"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -972,3 +975,345 @@ func TestTableWithBuffer(t *testing.T) {
 		return
 	}
 }
+
+func TestInterruptedFlush(t *testing.T) {
+	rootDir, err := utils.InitTestDir("TestInterruptedFlush")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	defer func() {
+		syncFile = func(f *os.File) error {
+			return f.Sync()
+		}
+	}()
+	// fails writing the files with the name
+	interrupt := func(name string) {
+		syncFile = func(f *os.File) error {
+			if strings.Contains(f.Name(), name) {
+				return fmt.Errorf("no space left on device")
+			}
+			return f.Sync()
+		}
+	}
+	tmpFiles := func() []string {
+		files, _ := filepath.Glob(rootDir + "/*" + cTmpExt)
+		files2, _ := filepath.Glob(rootDir + "/*/*/*" + cTmpExt)
+		return append(files, files2...)
+	}
+	checkIDs := func(tb *Table, title, expected string) error {
+		rows, err := tb.SelectRows(nil, []string{"id"})
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0)
+		var id int
+		for rows != nil && rows.Next() {
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return utils.GetGotExpErr(title, fmt.Sprint(ids), expected)
+	}
+
+	db, err := NewCsvDB(rootDir)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for _, useGzip := range []bool{false, true} {
+		name := fmt.Sprintf("interrupted%v", useGzip)
+		tb, err := db.CreateTable(name, []string{"id", "name"}, useGzip, 10, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		for id := 1; id <= 3; id++ {
+			if err := tb.InsertRow(nil, id, "user"+strconv.Itoa(id)); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+		if err := tb.Flush(); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+
+		interrupt(name)
+		if err := tb.InsertRow(nil, 4, "user4"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := tb.Flush(); err == nil {
+			t.Errorf("%s: flush is not interrupted", name)
+			return
+		}
+		if err := checkIDs(tb, name+" interrupted append", "[1 2 3]"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := tb.Update(func(v []string) bool {
+			return v[0] == "2"
+		}, map[string]interface{}{"name": "updated"}); err == nil {
+			t.Errorf("%s: update is not interrupted", name)
+			return
+		}
+		if err := tb.Delete(func(v []string) bool {
+			return v[0] == "1"
+		}); err == nil {
+			t.Errorf("%s: delete is not interrupted", name)
+			return
+		}
+		if err := checkIDs(tb, name+" interrupted update", "[1 2 3]"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := utils.GetGotExpErr(name+" temporary files", len(tmpFiles()), 0); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+
+		// a temporary file left by a killed process
+		if err := os.WriteFile(tb.path+cTmpExt, []byte("1,broken"), 0644); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		interrupt("none")
+		if err := checkIDs(tb, name+" temporary file left", "[1 2 3]"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := tb.Upsert(func(v []string) bool {
+			return v[0] == "4"
+		}, map[string]interface{}{"id": 4, "name": "user4"}); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := checkIDs(tb, name+" after recovery", "[1 2 3 4]"); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+	}
+
+	// the process stops while the block reused is emptied
+	cdb, err := NewCircuitDB(rootDir, "circuit", []string{"id"}, 2, 10, 0, "", false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	for id := 1; id <= 3; id++ {
+		if err := cdb.InsertRow(nil, id); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if err := cdb.Commit(); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if id >= 2 {
+			if err := cdb.NextBlock(int64(id)); err != nil {
+				t.Errorf("%v", err)
+				return
+			}
+		}
+	}
+	interrupt("BLK")
+	if err := cdb.InsertRow(nil, 4); err == nil {
+		t.Errorf("rotation is not interrupted")
+		return
+	}
+	interrupt("none")
+
+	cdb, err = NewCircuitDB(rootDir, "circuit", []string{"id"}, 2, 10, 0, "", false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := cdb.LoadCircuitDBStatus(); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	statuses, err := cdb.BlockStatuses()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	blockNos := make([]int, 0)
+	for _, bs := range statuses {
+		blockNos = append(blockNos, bs.BlockNo)
+	}
+	// the old rows of block 0 are not loaded
+	if err := utils.GetGotExpErr("blocks after the interrupted rotation", fmt.Sprint(blockNos), "[1]"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := cdb.InsertRow(nil, 5); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := cdb.Commit(); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	tb, err := cdb.GetBlockTable(0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkIDs(tb, "block 0 after the rotation", "[5]"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+}
+
+func TestCircuitDBRollback(t *testing.T) {
+	rootDir, err := utils.InitTestDir("TestCircuitDBRollback")
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	checkIDs := func(cdb *CircuitDB, blockNo int, title, expected string) error {
+		tb, err := cdb.GetBlockTable(blockNo)
+		if err != nil {
+			return err
+		}
+		rows, err := tb.SelectRows(nil, []string{"id"})
+		if err != nil {
+			return err
+		}
+		ids := make([]int, 0)
+		var id int
+		for rows != nil && rows.Next() {
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return utils.GetGotExpErr(title, fmt.Sprint(ids), expected)
+	}
+	load := func() (*CircuitDB, error) {
+		cdb, err := NewCircuitDB(rootDir, "circuit", []string{"id"}, 3, 10, 0, "", false)
+		if err != nil {
+			return nil, err
+		}
+		return cdb, cdb.LoadCircuitDBStatus()
+	}
+	insert := func(cdb *CircuitDB, ids ...int) error {
+		for _, id := range ids {
+			if err := cdb.InsertRow(nil, id); err != nil {
+				return err
+			}
+		}
+		return cdb.Commit()
+	}
+
+	cdb, err := load()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := insert(cdb, 1, 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	// the position saved with other tables
+	_, lastIndex := cdb.CurrentBlock()
+	rowNo := cdb.RowNo
+
+	// rows appended by a process stopped before committing the status
+	tb, err := cdb.GetBlockTable(0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	f, err := os.OpenFile(tb.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if _, err := f.WriteString("9\n1"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	f.Close()
+	cdb, err = load()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkIDs(cdb, 0, "rows not committed", "[1 2]"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("rowNo after loading", cdb.RowNo, 2); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// the process stops before saving the other tables
+	if err := insert(cdb, 3); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := cdb.NextBlock(3); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := insert(cdb, 4, 5); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	cdb, err = NewCircuitDB(rootDir, "circuit", []string{"id"}, 3, 10, 0, "", false)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	rolledBack, err := cdb.Rollback(lastIndex, rowNo)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !rolledBack {
+		t.Errorf("the blocks are not rolled back")
+		return
+	}
+	if err := cdb.LoadCircuitDBStatus(); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	statuses, err := cdb.BlockStatuses()
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("blocks after the rollback", len(statuses), 1); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := utils.GetGotExpErr("status after the rollback",
+		fmt.Sprint(statuses[0].BlockNo, statuses[0].RowNo, statuses[0].Completed), "0 2 false"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkIDs(cdb, 0, "block 0 after the rollback", "[1 2]"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if err := checkIDs(cdb, 1, "block 1 after the rollback", "[]"); err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	// nothing to roll back at the position
+	rolledBack, err = cdb.Rollback(lastIndex, rowNo)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if rolledBack {
+		t.Errorf("the blocks are rolled back twice")
+		return
+	}
+}
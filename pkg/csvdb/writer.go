@@ -3,36 +3,61 @@ package csvdb
 import (
 	"compress/gzip"
 	"encoding/csv"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/pkg/errors"
 )
 
+// Writer writes rows to a table file.
+// In the write mode the rows are written to a temporary file next to the table file
+// and commit syncs and renames it to the table file.
+// In the append mode the rows are appended to the table file and commit syncs it.
+// The appended rows are truncated if not committed, so the table file is never
+// left half written when the disk is full. Rows left by a killed process are
+// rolled back by the row count committed in the status of CircuitDB.
 type Writer struct {
-	fw     *os.File
-	zw     *gzip.Writer
-	writer *csv.Writer
-	path   string
-	mode   string
+	fw      *os.File
+	zw      *gzip.Writer
+	writer  *csv.Writer
+	path    string
+	tmpPath string
+	size    int64 // size of the table file before appending
+	mode    string
+}
+
+// replaced in tests to interrupt writing
+var syncFile = func(f *os.File) error {
+	return f.Sync()
 }
 
 func newWriter(path, writeMode string) (*Writer, error) {
 	ext := filepath.Ext(path)
-	var fw *os.File
 	var zw *gzip.Writer
 	var writer *csv.Writer
 	mode := ""
 
-	flags := 0
-	switch writeMode {
-	case CWriteModeWrite:
-		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	default:
-		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	tmpPath := ""
+	var size int64
+	var fw *os.File
+	var err error
+	if writeMode == CWriteModeWrite {
+		tmpPath = path + cTmpExt
+		fw, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	} else {
+		// gzip files can be appended as another member
+		fw, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			var fi os.FileInfo
+			if fi, err = fw.Stat(); err == nil {
+				size = fi.Size()
+			} else {
+				fw.Close()
+			}
+		}
 	}
-
-	fw, err := os.OpenFile(path, flags, 0644)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -48,6 +73,8 @@ func newWriter(path, writeMode string) (*Writer, error) {
 
 	c := new(Writer)
 	c.path = path
+	c.tmpPath = tmpPath
+	c.size = size
 	c.writer = writer
 	c.fw = fw
 	c.zw = zw
@@ -60,16 +87,90 @@ func (c *Writer) write(record []string) error {
 	return c.writer.Write(record)
 }
 
-func (c *Writer) flush() {
+// commit syncs the rows written to the table file
+func (c *Writer) commit() error {
 	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		return errors.WithStack(err)
+	}
+	if c.zw != nil {
+		if err := c.zw.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		c.zw = nil
+	}
+	if err := syncFile(c.fw); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := c.fw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	c.fw = nil
+	if c.tmpPath == "" {
+		return nil
+	}
+	return renameFile(c.tmpPath, c.path)
 }
 
+// close discards the rows if not committed
 func (c *Writer) close() {
-	if c.zw != nil {
-		c.zw.Close()
+	if c.fw == nil {
+		return
 	}
-
-	if c.fw != nil {
+	if c.tmpPath != "" {
 		c.fw.Close()
+		os.Remove(c.tmpPath)
+		return
+	}
+	c.fw.Truncate(c.size)
+	c.fw.Close()
+}
+
+// WriteFile writes a file to a temporary file, syncs and renames it,
+// so that the file is not left half written when the process stops
+func WriteFile(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmpPath := path + cTmpExt
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.WithStack(err)
+	}
+	if err := syncFile(f); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return errors.WithStack(err)
+	}
+	return renameFile(tmpPath, path)
+}
+
+// renameFile renames and syncs the directory so that the rename survives a crash
+func renameFile(tmpPath, path string) error {
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	// directories cannot be synced on windows, where the rename is journaled
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return errors.WithStack(err)
 	}
+	return errors.WithStack(d.Close())
 }
@@ -57,6 +57,16 @@ func (fp *FilePointer) CurrFileEpoch() int64 {
 	return fp.epochs[fp.pos]
 }
 
+func (fp *FilePointer) CurrFileName() string {
+	return fp.files[fp.currPos]
+}
+
+// TextFileEpoch returns the epoch of the file of Text().
+// CurrFileEpoch is already of the next file when the last line of a file is read.
+func (fp *FilePointer) TextFileEpoch() int64 {
+	return fp.epochs[fp.currPos]
+}
+
 func (fp *FilePointer) Err() error {
 	return fp.currErr
 }
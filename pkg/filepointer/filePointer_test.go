@@ -34,6 +34,15 @@ func TestFilePointer_run1(t *testing.T) {
 	}
 	s := []string{"001", "002", "003", "004", "005",
 		"006", "007", "008", "009", "010", "011", "012"}
+	epochs, files, err := utils.GetSortedGlob(logPathRegex)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	fileEpochs := make(map[string]int64)
+	for j, f := range files {
+		fileEpochs[f] = epochs[j]
+	}
 
 	i := 0
 	for fp.Next() {
@@ -42,6 +51,11 @@ func TestFilePointer_run1(t *testing.T) {
 			t.Errorf("want=%s got=%s", s[i], te)
 			return
 		}
+		// including the last line of the rotated file
+		if fp.TextFileEpoch() != fileEpochs[fp.CurrFileName()] {
+			t.Errorf("epoch of %s want=%d got=%d", te, fileEpochs[fp.CurrFileName()], fp.TextFileEpoch())
+			return
+		}
 		i++
 	}
 
@@ -116,3 +116,48 @@ func (lr *reader) isOpen() bool {
 	}
 	return true
 }
+
+// ReadContext returns the lines from row-before to row+after of filename.
+// Rows are 1-based as returned by FilePointer.Row().
+// It also returns the row number of the first returned line.
+// If epoch is not 0, the file must still have the epoch as returned by
+// FilePointer.TextFileEpoch(), otherwise the rows may not match any more.
+func ReadContext(filename string, epoch int64, row, before, after int) (int, []string, error) {
+	if filename == "" {
+		return 0, nil, errors.New("no file to read context from")
+	}
+	if epoch != 0 {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return 0, nil, errors.WithStack(err)
+		}
+		if fi.ModTime().Unix() != epoch {
+			return 0, nil, errors.Errorf("%s was changed after it was read", filename)
+		}
+	}
+	lr, err := newReader(filename)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer lr.close()
+
+	from := row - before
+	if from < 1 {
+		from = 1
+	}
+	to := row + after
+	lines := make([]string, 0, to-from+1)
+	for lr.next() {
+		if lr.rowNum < from {
+			continue
+		}
+		lines = append(lines, lr.text())
+		if lr.rowNum >= to {
+			break
+		}
+	}
+	if err := lr.err(); err != nil {
+		return 0, nil, err
+	}
+	return from, lines, nil
+}
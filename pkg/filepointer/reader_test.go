@@ -1,6 +1,7 @@
 package filepointer
 
 import (
+	"os"
 	"testing"
 )
 
@@ -39,3 +40,44 @@ func TestReader_basic(t *testing.T) {
 		})
 	}
 }
+
+func TestReader_readContext(t *testing.T) {
+	for _, infile := range []string{"../../test/data/filepointer/reader_sample.txt",
+		"../../test/data/filepointer/reader_sample.txt.gz"} {
+		from, lines, err := ReadContext(infile, 0, 3, 1, 1)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if from != 2 {
+			t.Errorf("%s: from want=2 got=%d", infile, from)
+		}
+		if len(lines) != 3 || lines[1] != "apple lemon melon orange" {
+			t.Errorf("%s: unexpected lines %v", infile, lines)
+		}
+
+		from, lines, err = ReadContext(infile, 0, 1, 2, 0)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if from != 1 || len(lines) != 1 {
+			t.Errorf("%s: from=%d lines=%v", infile, from, lines)
+		}
+
+		fi, err := os.Stat(infile)
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		if _, _, err := ReadContext(infile, fi.ModTime().Unix(), 3, 1, 1); err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		// the file was changed after it was read
+		if _, _, err := ReadContext(infile, fi.ModTime().Unix()-1, 3, 1, 1); err == nil {
+			t.Errorf("%s: no error for a changed epoch", infile)
+			return
+		}
+	}
+}
@@ -358,6 +358,23 @@ func AddDaysToEpoch(epoch int64, days int) int64 {
 	return epochTime.Unix()
 }
 
+// ParseDuration is the same as time.ParseDuration but also accepts
+// days and weeks like "7d" or "2w"
+func ParseDuration(s string) (time.Duration, error) {
+	if n := len(s); n > 1 && (s[n-1] == 'd' || s[n-1] == 'w') {
+		v, err := strconv.ParseFloat(s[:n-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		unit := 24 * time.Hour
+		if s[n-1] == 'w' {
+			unit *= 7
+		}
+		return time.Duration(v * float64(unit)), nil
+	}
+	return time.ParseDuration(s)
+}
+
 func StringToInt64(s string) int64 {
 	// Use strconv.ParseInt to convert string to int64
 	i, err := strconv.ParseInt(s, 10, 64)